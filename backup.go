@@ -0,0 +1,322 @@
+package bitcaskKV
+
+import (
+	"context"
+	"encoding/json"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/fio"
+	"go-bitcask-kv/index"
+	"go-bitcask-kv/utils"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 在线备份只在切换active文件时加锁，之后需要备份的文件都不会再被修改，
+// 拷贝过程中DB可以继续读写。备份目录中的备份清单记录了每个文件的大小和校验值，
+// 再次备份到同一个目录时，没有发生变化的文件直接跳过
+
+const backupManifestName = "backup_manifest"
+
+// backupManifest 备份清单
+type backupManifest struct {
+	// 备份完成的时间
+	CreatedAt int64 `json:"created_at"`
+
+	Files []backupManifestFile `json:"files"`
+}
+
+// backupManifestFile 备份中的一个文件
+type backupManifestFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+
+	// 文件内容的crc32校验值
+	Checksum uint32 `json:"checksum"`
+
+	// 源文件的修改时间，增量备份时和大小一起判断文件是否发生了变化
+	ModTime int64 `json:"mod_time"`
+}
+
+// Backup 在线备份到dir目录，备份目录可以直接打开，也可以通过Restore校验之后恢复
+// 不可变的数据文件优先使用硬链接，dir中已经存在并且没有变化的文件会被跳过
+func (db *DB) Backup(dir string) error {
+	return db.BackupWithContext(context.Background(), dir)
+}
+
+// BackupWithContext 和Backup相同，ctx被取消时中止拷贝并返回ctx.Err()
+// 被中止的备份没有写入新的备份清单，不能用于恢复，再次备份到同一个目录即可
+func (db *DB) BackupWithContext(ctx context.Context, dir string) error {
+	db.mu.Lock()
+	if db.isClosed {
+		db.mu.Unlock()
+		return ErrDatabaseIsClosed
+	}
+
+	// 备份需要切换active文件，只读模式下可以使用Checkpoint
+	if db.option.ReadOnly {
+		db.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	// 切换active文件，之后需要备份的文件都不会再被修改
+	if db.activeFile != nil && db.activeFile.WriteOff > db.activeFile.DataOffset() {
+		if err := db.activeFile.Sync(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		if err := db.setNewActiveDataFile(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+
+	fileIds := make([]int, 0, len(db.olderFiles))
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, int(fid))
+	}
+
+	// B+树索引需要和数据文件在同一时刻获取快照
+	var indexSnap *index.BPlusTreeSnapshot
+	if bpTree, ok := db.index.(*index.BPlusTree); ok {
+		snap, err := bpTree.Snapshot()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		indexSnap = snap
+	}
+	db.mu.Unlock()
+
+	if indexSnap != nil {
+		defer func() {
+			_ = indexSnap.Release()
+		}()
+	}
+
+	sort.Ints(fileIds)
+	var fileNames []string
+	for _, fid := range fileIds {
+		fileNames = append(fileNames, filepath.Base(data.GetDataFileName(db.option.DirPath, uint32(fid))))
+	}
+
+	// 最后一个数据文件在备份目录被打开时会成为active文件继续写入，不能和源文件共享
+	var lastDataFile string
+	if len(fileNames) > 0 {
+		lastDataFile = fileNames[len(fileNames)-1]
+	}
+
+	// merge之后的hint文件在运行期间不会被修改
+	if _, err := os.Stat(filepath.Join(db.option.DirPath, data.HintFileName)); err == nil {
+		fileNames = append(fileNames, data.HintFileName)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// 上一次备份的清单，不存在或者无法解析时全量备份
+	prevFiles := make(map[string]backupManifestFile)
+	if prev, err := readBackupManifest(dir); err == nil {
+		for _, file := range prev.Files {
+			prevFiles[file.Name] = file
+		}
+	}
+
+	manifest := &backupManifest{}
+	for _, name := range fileNames {
+		src, dest := filepath.Join(db.option.DirPath, name), filepath.Join(dir, name)
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+
+		file := backupManifestFile{
+			Name:    name,
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		}
+
+		if prev, ok := prevFiles[name]; ok && prev.Size == file.Size && prev.ModTime == file.ModTime &&
+			fileSizeEqual(dest, file.Size) {
+			file.Checksum = prev.Checksum
+		} else {
+			if file.Checksum, err = linkOrCopyFile(ctx, src, dest, name != lastDataFile, db.backupLimiter); err != nil {
+				return err
+			}
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	if indexSnap != nil {
+		file, err := writeIndexSnapshot(indexSnap, dir)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	manifest.CreatedAt = time.Now().UnixNano()
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return err
+	}
+
+	// 删除上一次备份中已经不存在的文件，比如merge之后被替换掉的数据文件
+	for _, file := range manifest.Files {
+		delete(prevFiles, file.Name)
+	}
+	for name := range prevFiles {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore 校验dir中的备份并恢复到target目录，target目录必须不存在或者为空
+// 任意一个文件的大小或者校验值和备份清单不一致时返回ErrBackupCorrupted, 并清理已经恢复的文件
+func Restore(dir, target string) (err error) {
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrBackupManifestNotFound
+		}
+		return err
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreTargetNotEmpty
+	}
+	if err := os.MkdirAll(target, os.ModePerm); err != nil {
+		return err
+	}
+
+	// 恢复失败时清理target目录
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(target)
+		}
+	}()
+
+	for _, file := range manifest.Files {
+		dest := filepath.Join(target, file.Name)
+		// 恢复之后的文件会被写入，因此不使用硬链接
+		if err := utils.CopyFile(context.Background(), filepath.Join(dir, file.Name), dest, fio.DataFilePerm, nil); err != nil {
+			if os.IsNotExist(err) {
+				return ErrBackupCorrupted
+			}
+			return err
+		}
+
+		checksum, err := utils.FileChecksum(context.Background(), dest, nil)
+		if err != nil {
+			return err
+		}
+		if !fileSizeEqual(dest, file.Size) || checksum != file.Checksum {
+			return ErrBackupCorrupted
+		}
+	}
+
+	return nil
+}
+
+// linkOrCopyFile 拷贝不可变的文件，link为true时优先使用硬链接
+// 返回源文件内容的crc32校验值，拷贝时在读取源文件的同时计算，不需要再读取一遍目标文件
+func linkOrCopyFile(ctx context.Context, src, dest string, link bool, limiter *utils.RateLimiter) (uint32, error) {
+	// 目标文件可能是上一次备份时创建的硬链接，直接覆盖写入会修改源文件，需要先删除
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if link {
+		// 不在同一个文件系统中时无法创建硬链接，改为拷贝
+		if err := os.Link(src, dest); err == nil {
+			return utils.FileChecksum(ctx, src, limiter)
+		}
+	}
+	return utils.CopyFileChecksum(ctx, src, dest, fio.DataFilePerm, limiter)
+}
+
+// writeIndexSnapshot 将B+树索引的快照写入到备份目录中
+func writeIndexSnapshot(snap *index.BPlusTreeSnapshot, dir string) (backupManifestFile, error) {
+	path := filepath.Join(dir, index.BPlusTreeIndexFileName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return backupManifestFile{}, err
+	}
+
+	indexFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return backupManifestFile{}, err
+	}
+	// 写入的同时计算校验值
+	hash := crc32.NewIEEE()
+	size, err := snap.WriteTo(io.MultiWriter(indexFile, hash))
+	if err == nil {
+		err = indexFile.Sync()
+	}
+	if closeErr := indexFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return backupManifestFile{}, err
+	}
+
+	return backupManifestFile{
+		Name:     index.BPlusTreeIndexFileName,
+		Size:     size,
+		Checksum: hash.Sum32(),
+	}, nil
+}
+
+func readBackupManifest(dir string) (*backupManifest, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &backupManifest{}
+	if err := json.Unmarshal(buf, manifest); err != nil {
+		return nil, ErrBackupCorrupted
+	}
+	return manifest, nil
+}
+
+// writeBackupManifest 先写入临时文件再重命名，备份清单写入完成才表示备份完成
+func writeBackupManifest(dir string, manifest *backupManifest) error {
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(dir, backupManifestName+".tmp")
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(buf)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(dir, backupManifestName))
+}
+
+func fileSizeEqual(path string, size int64) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() == size
+}
@@ -0,0 +1,210 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/index"
+	"go-bitcask-kv/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_Backup_Incremental(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-incr")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.GetTestRandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-incr-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+
+	manifest, err := readBackupManifest(backupDir)
+	assert.Nil(t, err)
+	assert.True(t, len(manifest.Files) > 1)
+	infos := make(map[string]os.FileInfo)
+	for _, file := range manifest.Files {
+		info, err := os.Stat(filepath.Join(backupDir, file.Name))
+		assert.Nil(t, err)
+		infos[file.Name] = info
+	}
+
+	// 再次备份时已经存在的文件被跳过
+	for i := 1000; i < 1500; i++ {
+		values[i] = utils.GetTestRandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, db.Backup(backupDir))
+
+	manifest2, err := readBackupManifest(backupDir)
+	assert.Nil(t, err)
+	assert.True(t, len(manifest2.Files) > len(manifest.Files))
+	for name, info := range infos {
+		info2, err := os.Stat(filepath.Join(backupDir, name))
+		assert.Nil(t, err)
+		assert.True(t, os.SameFile(info, info2))
+	}
+
+	// 备份之后的写入不在备份中
+	assert.Nil(t, db.Put([]byte("after-backup"), []byte("value")))
+
+	target := filepath.Join(os.TempDir(), "bitcask-go-backup-incr-restore")
+	_ = os.RemoveAll(target)
+	assert.Nil(t, Restore(backupDir, target))
+
+	restoreOpts := opts
+	restoreOpts.DirPath = target
+	db2, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+
+	assert.Equal(t, len(values), db2.index.Size())
+	for i, value := range values {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	_, err = db2.Get([]byte("after-backup"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 恢复之后的数据库可以继续写入，不会影响源数据库
+	assert.Nil(t, db2.Put(utils.GetTestKey(0), []byte("restored")))
+	val, err := db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, values[0], val)
+}
+
+func TestRestore_Verify(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-restore-verify")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-restore-verify-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+	destroyDB(db)
+
+	target, _ := os.MkdirTemp("", "bitcask-go-restore-verify-target")
+	defer func() {
+		_ = os.RemoveAll(target)
+	}()
+
+	// 目标目录不为空
+	assert.Nil(t, os.WriteFile(filepath.Join(target, "file"), []byte("data"), 0644))
+	assert.Equal(t, ErrRestoreTargetNotEmpty, Restore(backupDir, target))
+	assert.Nil(t, os.Remove(filepath.Join(target, "file")))
+
+	// 没有备份清单
+	assert.Equal(t, ErrBackupManifestNotFound, Restore(target, filepath.Join(target, "restore")))
+
+	// 修改备份中的数据，校验失败并清理目标目录
+	manifest, err := readBackupManifest(backupDir)
+	assert.Nil(t, err)
+	path := filepath.Join(backupDir, manifest.Files[0].Name)
+	buf, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, buf, 0644))
+
+	assert.Equal(t, ErrBackupCorrupted, Restore(backupDir, target))
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// 备份过程中不会阻塞写入
+func TestDB_Backup_Online(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-online")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.BackupRateLimit = 64 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-online-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		done <- db.Backup(backupDir)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	putStart := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+	putElapsed := time.Since(putStart)
+
+	assert.Nil(t, <-done)
+	assert.True(t, time.Since(start) > time.Second)
+	assert.True(t, putElapsed < 500*time.Millisecond, putElapsed)
+}
+
+func TestDB_Backup_BPlusTree(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-bptree")
+	opts.DirPath = dir
+	opts.IndexType = index.BPlusTreeIndex
+	opts.indexPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-bptree-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+
+	target := filepath.Join(os.TempDir(), "bitcask-go-backup-bptree-restore")
+	_ = os.RemoveAll(target)
+	assert.Nil(t, Restore(backupDir, target))
+
+	restoreOpts := opts
+	restoreOpts.DirPath = target
+	restoreOpts.indexPath = target
+	db2, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+
+	assert.Equal(t, 500, db2.index.Size())
+	for i := 0; i < 500; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
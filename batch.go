@@ -1,7 +1,6 @@
 package bitcaskKV
 
 import (
-	"encoding/binary"
 	"go-bitcask-kv/data"
 	"sync"
 	"sync/atomic"
@@ -94,20 +93,38 @@ func (wb *WriteBatch) Commit() error {
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
 
+	if err := wb.db.commitRecords(wb.pendingWrites, wb.option.SyncWriteBatch); err != nil {
+		return err
+	}
+
+	// 清空暂存数据，防止重复使用同一个writeBatch
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return nil
+}
+
+// commitRecords 以事务的方式原子写入一批记录，并更新内存索引
+// 所有记录使用同一个序列号，最后追加一条事务完成的标识，重启时只有读到完成标识的事务才会生效
+// 访问该方法前必须持有db互斥锁
+func (db *DB) commitRecords(records map[string]*data.LogRecord, sync bool) error {
+	if db.option.ReadOnly {
+		return ErrReadOnly
+	}
+
 	// 获取事务id
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	// 暂存索引信息，成功后统一更新
 	positions := make(map[string]*data.LogRecordPos)
 
 	// 将数据写入到日志文件中
-	for _, record := range wb.pendingWrites {
+	for _, record := range records {
 		// 不能直接使用Put, Put操作会更新索引信息
-		//err := wb.db.Put(record.Key, record.Value)
-		pos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   encodeRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
+		pos, err := db.appendLogRecord(&data.LogRecord{
+			Key:    data.EncodeRecordKeyWithSeq(record.Key, seqNo),
+			Value:  record.Value,
+			Type:   record.Type,
+			Expire: record.Expire,
 		})
 
 		if err != nil {
@@ -119,57 +136,41 @@ func (wb *WriteBatch) Commit() error {
 
 	// 追加一条标识事务完成的数据
 	finishedRecord := &data.LogRecord{
-		Key:   encodeRecordKeyWithSeq(txnFish, seqNo),
+		Key:   data.EncodeRecordKeyWithSeq(txnFish, seqNo),
 		Value: nil,
 		Type:  data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
-		return nil
+	finishedPos, err := db.appendLogRecord(finishedRecord)
+	if err != nil {
+		return err
 	}
+	// 事务完成标识只在重启时使用，本身也可以回收
+	db.markGarbage(finishedPos)
 
 	// 此时表示事务已经完成，根据配置持久化
-	if wb.option.SyncWriteBatch && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+	if sync && db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
 			return err
 		}
 	}
 
 	// 更新内存索引
-	for _, record := range wb.pendingWrites {
+	for _, record := range records {
 		pos := positions[string(record.Key)]
 		var oldValue *data.LogRecordPos
 		if record.Type == data.LogRecordNormal {
-			oldValue, _ = wb.db.index.Put(record.Key, pos)
+			oldValue, _ = db.index.Put(record.Key, pos)
 		}
 
 		if record.Type == data.LogRecordDeleted {
-			oldValue, _ = wb.db.index.Delete(record.Key)
+			oldValue, _ = db.index.Delete(record.Key)
+			// 删除记录本身也可以回收
+			db.markGarbage(pos)
 		}
 		if oldValue != nil {
-			wb.db.recycleSize += oldValue.Size
+			db.markGarbage(oldValue)
 		}
 	}
 
-	// 清空暂存数据，防止重复使用同一个writeBatch
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-
 	return nil
 }
-
-// 把序号编码进key中
-func encodeRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
-	seq := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(seq[:], seqNo)
-
-	encKey := make([]byte, n+len(key))
-	copy(encKey[:n], seq[:n])
-	copy(encKey[n:], key)
-	return encKey
-}
-
-// 解析出序号和key
-func decodeRecordKeyWithSeq(buf []byte) ([]byte, uint64) {
-	seqNo, n := binary.Uvarint(buf)
-	realKey := buf[n:]
-	return realKey, seqNo
-}
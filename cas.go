@@ -0,0 +1,152 @@
+package bitcaskKV
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go-bitcask-kv/data"
+	"hash/fnv"
+)
+
+// 条件写操作，检查和写入都在db互斥锁中完成，保证操作的原子性
+
+// CompareAndSwap 只有当key存在并且当前值等于oldValue时才写入newValue, 返回是否写入成功
+func (db *DB) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pos := db.getValidPosition(key)
+	if pos == nil {
+		return false, nil
+	}
+
+	value, err := db.getValueByPosition(pos)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(value, oldValue) {
+		return false, nil
+	}
+
+	if err := db.putRecord(key, newValue, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutIfAbsent 只有当key不存在时才写入, 返回是否写入成功
+func (db *DB) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.getValidPosition(key) != nil {
+		return false, nil
+	}
+
+	if err := db.putRecord(key, value, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteIfEquals 只有当key的当前值等于value时才删除, 返回是否删除成功
+func (db *DB) DeleteIfEquals(key []byte, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pos := db.getValidPosition(key)
+	if pos == nil {
+		return false, nil
+	}
+
+	cur, err := db.getValueByPosition(pos)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(cur, value) {
+		return false, nil
+	}
+
+	if err := db.deleteRecord(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetWithVersion 获取key对应的value以及当前的版本号
+// 版本号由记录在数据文件中的位置得到，每次写入都会产生新的版本号
+// merge会重写数据文件，之前获取的版本号在merge生效之后全部失效，PutIfVersion不会再成功，需要重新获取
+func (db *DB) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	if len(key) == 0 {
+		return nil, 0, ErrKeyIsEmpty
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	pos := db.getValidPosition(key)
+	if pos == nil {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	value, err := db.getValueByPosition(pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, db.positionVersion(pos), nil
+}
+
+// PutIfVersion 只有当key的当前版本号等于version时才写入, 返回是否写入成功
+// version为0表示期望key不存在
+func (db *DB) PutIfVersion(key []byte, value []byte, version uint64) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.positionVersion(db.getValidPosition(key)) != version {
+		return false, nil
+	}
+
+	if err := db.putRecord(key, value, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// positionVersion 根据位置信息以及所在文件的创建时间计算版本号，0表示key不存在
+// merge之后的文件会重新编号或者在原来的id上重写，只用位置计算时新的记录可能恰好得到旧的版本号，
+// 重写之后的文件有新的创建时间，因此merge之前的版本号不会和之后的版本号相同
+func (db *DB) positionVersion(pos *data.LogRecordPos) uint64 {
+	if pos == nil {
+		return 0
+	}
+
+	var createdAt int64
+	if dataFile := db.getDataFile(pos.Fid); dataFile != nil && dataFile.Header != nil {
+		createdAt = dataFile.Header.CreatedAt
+	}
+	buf := make([]byte, 20)
+	binary.LittleEndian.PutUint32(buf[:4], pos.Fid)
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(createdAt))
+	binary.LittleEndian.PutUint64(buf[12:], uint64(pos.Offset))
+	h := fnv.New64a()
+	_, _ = h.Write(buf)
+	if version := h.Sum64(); version != 0 {
+		return version
+	}
+	return 1
+}
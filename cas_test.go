@@ -0,0 +1,176 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-cas")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// key不存在
+	ok, err := db.CompareAndSwap(utils.GetTestKey(1), nil, []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = db.PutIfAbsent(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.PutIfAbsent(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 旧值不匹配
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v2"), []byte("v3"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v1"), []byte("v3"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), val)
+
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(1), []byte("v3"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_PutIfVersion(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-put-if-version")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	_, _, err = db.GetWithVersion(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 版本号为0表示期望key不存在
+	ok, err := db.PutIfVersion(utils.GetTestKey(1), []byte("v1"), 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	val, ver1, err := db.GetWithVersion(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	assert.NotEqual(t, uint64(0), ver1)
+
+	ok, err = db.PutIfVersion(utils.GetTestKey(1), []byte("v2"), ver1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// 使用过期的版本号写入失败
+	ok, err = db.PutIfVersion(utils.GetTestKey(1), []byte("v3"), ver1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	val, ver2, err := db.GetWithVersion(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	assert.NotEqual(t, ver1, ver2)
+}
+
+func TestDB_PutIfVersion_AfterMerge(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-put-if-version-merge")
+	opts.DirPath = dir
+	opts.mergeMinSizeThr = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 第一条记录位于第一个文件的开头
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("v1")))
+	_, ver1, err := db.GetWithVersion(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestRandomValue(24)))
+	}
+	val, ver2, err := db.GetWithVersion(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	// 没有merge时重启之后版本号不变
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, ver, err := db.GetWithVersion(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, ver2, ver)
+
+	// merge之后最新的记录被移动到第一个文件的开头，也就是v1原来的位置，但是之前的版本号全部失效
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	pos := db.index.Get(utils.GetTestKey(1))
+	assert.Equal(t, uint32(0), pos.Fid)
+	assert.Equal(t, int64(data.FileHeaderSize), pos.Offset)
+	for _, version := range []uint64{ver1, ver2} {
+		ok, err := db.PutIfVersion(utils.GetTestKey(1), []byte("v3"), version)
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+	cur, ver3, err := db.GetWithVersion(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val, cur)
+	ok, err := db.PutIfVersion(utils.GetTestKey(1), []byte("v3"), ver3)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestDB_CompareAndSwap_Concurrent(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-cas-concurrent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("0"))
+	assert.Nil(t, err)
+
+	// 多个协程通过CAS累加计数器，不会丢失更新
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; {
+				val, err := db.Get(utils.GetTestKey(1))
+				assert.Nil(t, err)
+				n, _ := strconv.Atoi(string(val))
+				ok, err := db.CompareAndSwap(utils.GetTestKey(1), val, []byte(strconv.Itoa(n+1)))
+				assert.Nil(t, err)
+				if ok {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1000"), val)
+}
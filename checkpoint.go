@@ -0,0 +1,129 @@
+package bitcaskKV
+
+import (
+	"context"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/fio"
+	"go-bitcask-kv/index"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint 在dir目录中创建一个可以直接打开的数据库副本，dir必须不存在或者为空
+// 旧数据文件使用硬链接，active文件只拷贝到当前的写入位置，不需要切换active文件，
+// 加锁只用于获取当前的文件列表，之后的写入不会出现在副本中
+func (db *DB) Checkpoint(dir string) (err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrCheckpointDirNotEmpty
+	}
+
+	db.mu.Lock()
+	if db.isClosed {
+		db.mu.Unlock()
+		return ErrDatabaseIsClosed
+	}
+
+	var olderFileIds []uint32
+	for fid := range db.olderFiles {
+		olderFileIds = append(olderFileIds, fid)
+	}
+
+	// active文件只会追加写入，写入位置之前的数据不会再改变
+	var activeFile *data.SegDataFile
+	var activeSize int64
+	if db.activeFile != nil {
+		activeFile, activeSize = db.activeFile, db.activeFile.WriteOff
+	}
+
+	// B+树索引需要和数据文件在同一时刻获取快照
+	var indexSnap *index.BPlusTreeSnapshot
+	if bpTree, ok := db.index.(*index.BPlusTree); ok {
+		snap, err := bpTree.Snapshot()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		indexSnap = snap
+	}
+	db.mu.Unlock()
+
+	if indexSnap != nil {
+		defer func() {
+			_ = indexSnap.Release()
+		}()
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// 失败时清理创建的副本
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	// 旧数据文件不会再被修改，使用硬链接
+	// 副本被打开时active文件是最后一个文件，因此旧数据文件在副本中也不会被写入
+	for _, fid := range olderFileIds {
+		src := data.GetDataFileName(db.option.DirPath, fid)
+		if _, err := linkOrCopyFile(context.Background(), src, data.GetDataFileName(dir, fid), true, nil); err != nil {
+			return err
+		}
+	}
+
+	// merge之后的hint文件以及merge完成文件同样不会被修改
+	for _, name := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		src := filepath.Join(db.option.DirPath, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := linkOrCopyFile(context.Background(), src, filepath.Join(dir, name), true, nil); err != nil {
+			return err
+		}
+	}
+
+	if activeFile != nil {
+		src := data.GetDataFileName(db.option.DirPath, activeFile.FileId)
+		if err := copyFilePrefix(src, data.GetDataFileName(dir, activeFile.FileId), activeSize); err != nil {
+			return err
+		}
+	}
+
+	if indexSnap != nil {
+		if _, err := writeIndexSnapshot(indexSnap, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyFilePrefix 拷贝文件的前n个字节
+func copyFilePrefix(src, dest string, n int64) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(destFile, srcFile, n)
+	if err == nil {
+		err = destFile.Sync()
+	}
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.GetTestRandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+
+	// merge之后重启，数据目录中有hint文件
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 1000; i < 1200; i++ {
+		values[i] = utils.GetTestRandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+
+	checkpointDir := filepath.Join(os.TempDir(), "bitcask-go-checkpoint-dest")
+	_ = os.RemoveAll(checkpointDir)
+	assert.Nil(t, db.Checkpoint(checkpointDir))
+	defer func() {
+		_ = os.RemoveAll(checkpointDir)
+	}()
+
+	// 之后的写入不在副本中
+	assert.Nil(t, db.Put([]byte("after-checkpoint"), []byte("value")))
+
+	_, err = os.Stat(filepath.Join(checkpointDir, fileLockName))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(checkpointDir, data.HintFileName))
+	assert.Nil(t, err)
+
+	// 旧数据文件和源文件是同一个文件，active文件是拷贝
+	for fid := range db.olderFiles {
+		src, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		dest, err := os.Stat(data.GetDataFileName(checkpointDir, fid))
+		assert.Nil(t, err)
+		assert.True(t, os.SameFile(src, dest))
+	}
+	src, err := os.Stat(data.GetDataFileName(dir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	dest, err := os.Stat(data.GetDataFileName(checkpointDir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	assert.False(t, os.SameFile(src, dest))
+	assert.True(t, dest.Size() < src.Size())
+
+	// 目录不为空
+	assert.Equal(t, ErrCheckpointDirNotEmpty, db.Checkpoint(checkpointDir))
+
+	checkpointOpts := opts
+	checkpointOpts.DirPath = checkpointDir
+	db2, err := Open(checkpointOpts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+
+	assert.Equal(t, len(values), db2.index.Size())
+	for i, value := range values {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	_, err = db2.Get([]byte("after-checkpoint"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 副本中的写入不影响源数据库
+	assert.Nil(t, db2.Put(utils.GetTestKey(600), []byte("checkpoint")))
+	val, err := db.Get(utils.GetTestKey(600))
+	assert.Nil(t, err)
+	assert.Equal(t, values[600], val)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"go-bitcask-kv/data"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checker 检查以及修复一个数据目录
+type checker struct {
+	// 解密加密记录使用的密钥，修复时使用最后一个密钥重新加密，通过-keys参数指定
+	// 为nil时加密的记录无法解析，会被记录为损坏的区间
+	keys *data.KeyRing
+}
+
+// corruptRange 文件中一段无法解析的数据
+type corruptRange struct {
+	file       string
+	start, end int64
+	reason     string
+}
+
+// orphanTxn 没有事务完成标识的事务，其中的数据在启动时会被丢弃
+type orphanTxn struct {
+	seqNo   uint64
+	records int
+
+	// 第一条记录所在的文件
+	file string
+}
+
+// report 检查结果
+type report struct {
+	dir string
+
+	// 检查过的文件数量以及有效记录数量
+	files   int
+	records int
+
+	// 有效记录中使用自定义算法压缩的记录数量，这些记录的value没有解压校验
+	compressed int
+
+	corrupts []corruptRange
+	orphans  []orphanTxn
+
+	// hint文件、merge完成文件以及merge目录的问题
+	issues []string
+
+	// 不影响数据的提示，比如等待下次启动时生效的merge
+	notes []string
+}
+
+func (r *report) healthy() bool {
+	return len(r.corrupts) == 0 && len(r.orphans) == 0 && len(r.issues) == 0
+}
+
+func (r *report) addRecord(rec *scannedRecord) {
+	r.records++
+	if rec.compressed {
+		r.compressed++
+	}
+}
+
+func (r *report) addIssue(format string, args ...interface{}) {
+	r.issues = append(r.issues, fmt.Sprintf(format, args...))
+}
+
+func (r *report) addNote(format string, args ...interface{}) {
+	r.notes = append(r.notes, fmt.Sprintf(format, args...))
+}
+
+// scannedRecord 扫描文件时得到的一条完整的记录
+type scannedRecord struct {
+	record *data.LogRecord
+	offset int64
+	size   int64
+
+	// value使用fsck不知道的自定义算法压缩，record中的value是压缩之后的数据
+	compressed bool
+}
+
+// scanFile 读取文件中所有可以解析的记录，无法解析的部分会被跳过，
+// 从下一个有效的记录继续读取，跳过的部分记录为损坏的区间
+// 损坏的数据中可能恰好有片段能通过crc校验，因此只有紧跟着的下一条记录也能解析时才从该位置继续读取
+// 文件头和文件类型或者文件id不一致时，文件头同样记录为损坏的区间
+func (c *checker) scanFile(path string, fileType data.FileType, fid uint32, fn func(rec *scannedRecord)) ([]corruptRange, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupts []corruptRange
+	var start int64 = 0
+	header, err := data.DecodeFileHeader(buf)
+	if err == nil && header != nil && (header.Type != fileType || header.FileId != fid) {
+		err = fmt.Errorf("file header mismatch, type %d file id %d", header.Type, header.FileId)
+	}
+	if err != nil {
+		corrupts = append(corrupts, corruptRange{file: path, start: 0, end: data.FileHeaderSize, reason: err.Error()})
+	}
+	// 没有文件头的旧文件从头开始读取
+	if err != nil || header != nil {
+		start = data.FileHeaderSize
+	}
+
+	var badStart int64 = -1
+	var badReason string
+	for offset := start; offset < int64(len(buf)); {
+		record, size, err := data.DecodeLogRecordBufWithKeys(buf[offset:], c.keys, nil)
+		var compressed bool
+		if err == data.ErrUnknownCompressor {
+			// crc校验已经通过，数据是完整的，只是无法解压，保留压缩之后的value
+			record, size, compressed, err = data.DecodeCompressedLogRecordBuf(buf[offset:], c.keys)
+		}
+		if err == nil && !validRecordType(record.Type) {
+			err = fmt.Errorf("unknown record type %d", record.Type)
+		}
+		if err != nil {
+			if badStart < 0 {
+				badStart, badReason = offset, err.Error()
+			}
+			// 跳过损坏的数据，从之后第一条有效的记录继续读取
+			next := data.FindNextLogRecord(buf[offset+1:])
+			if next < 0 {
+				break
+			}
+			offset += 1 + next
+			continue
+		}
+
+		if badStart >= 0 {
+			corrupts = append(corrupts, corruptRange{file: path, start: badStart, end: offset, reason: badReason})
+			badStart = -1
+		}
+		fn(&scannedRecord{record: record, offset: offset, size: size, compressed: compressed})
+		offset += size
+	}
+
+	if badStart >= 0 {
+		corrupts = append(corrupts, corruptRange{file: path, start: badStart, end: int64(len(buf)), reason: badReason})
+	}
+	return corrupts, nil
+}
+
+func validRecordType(typ data.LogRecordType) bool {
+	return typ >= data.LogRecordNormal && typ <= data.LogRecordMerge
+}
+
+// dataFileIds 获取目录下所有数据文件的id, 从小到大排列
+func dataFileIds(dir string) ([]uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileIds []uint32
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, data.SegDataFileNamePrefix) || !strings.HasSuffix(name, data.SegDataFileNameSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, data.SegDataFileNamePrefix), data.SegDataFileNameSuffix)
+		fid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data file name %s", name)
+		}
+		fileIds = append(fileIds, uint32(fid))
+	}
+
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+	return fileIds, nil
+}
+
+// checkDir 检查数据目录以及对应的merge目录
+func (c *checker) checkDir(dir string) (*report, error) {
+	r := &report{dir: dir}
+	if err := c.checkDataDir(r, dir); err != nil {
+		return nil, err
+	}
+
+	mergePath := filepath.Join(filepath.Dir(filepath.Clean(dir)), filepath.Base(dir)+data.MergeDirSuffix)
+	if _, err := os.Stat(mergePath); err == nil {
+		if err := c.checkMergeDir(r, mergePath); err != nil {
+			return nil, err
+		}
+	}
+	if r.compressed > 0 {
+		r.addNote("%d records are compressed with custom compressors, only their crc is verified", r.compressed)
+	}
+	return r, nil
+}
+
+// checkDataDir 检查目录下的数据文件、hint文件以及merge完成文件
+func (c *checker) checkDataDir(r *report, dir string) error {
+	fileIds, err := dataFileIds(dir)
+	if err != nil {
+		return err
+	}
+
+	type pendingTxn struct {
+		records int
+		file    string
+	}
+	pendingTxns := make(map[uint64]*pendingTxn)
+	records := make(fileRecords)
+
+	for _, fid := range fileIds {
+		path := data.GetDataFileName(dir, fid)
+		records[fid] = make(map[int64]int64)
+		corrupts, err := c.scanFile(path, data.FileTypeData, fid, func(rec *scannedRecord) {
+			r.addRecord(rec)
+			records[fid][rec.offset] = rec.size
+			_, seqNo := data.DecodeRecordKeyWithSeq(rec.record.Key)
+			if seqNo == 0 {
+				return
+			}
+			if rec.record.Type == data.LogRecordTxnFinished {
+				delete(pendingTxns, seqNo)
+				return
+			}
+			if txn, ok := pendingTxns[seqNo]; ok {
+				txn.records++
+			} else {
+				pendingTxns[seqNo] = &pendingTxn{records: 1, file: path}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		r.files++
+		r.corrupts = append(r.corrupts, corrupts...)
+	}
+
+	for seqNo, txn := range pendingTxns {
+		r.orphans = append(r.orphans, orphanTxn{seqNo: seqNo, records: txn.records, file: txn.file})
+	}
+	sort.Slice(r.orphans, func(i, j int) bool {
+		return r.orphans[i].seqNo < r.orphans[j].seqNo
+	})
+
+	if err := c.checkHintFile(r, dir, records); err != nil {
+		return err
+	}
+	_, err = c.checkMergeFinishedFile(r, dir)
+	return err
+}
+
+// fileRecords 每个数据文件中所有完整记录的偏移以及长度
+type fileRecords map[uint32]map[int64]int64
+
+// checkHintFile hint文件中的每条索引都必须指向数据文件中的一条记录
+func (c *checker) checkHintFile(r *report, dir string, records fileRecords) error {
+	path := filepath.Join(dir, data.HintFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	corrupts, err := c.scanFile(path, data.FileTypeHint, data.HintFileId, func(rec *scannedRecord) {
+		pos := data.DecodeLogRecordPos(rec.record.Value)
+		offsets, ok := records[pos.Fid]
+		if !ok {
+			// 加载索引时会跳过已经不存在的文件的索引
+			r.addNote("%s: key %q at offset %d references missing data file %d", path, rec.record.Key, rec.offset, pos.Fid)
+		} else if size, ok := offsets[pos.Offset]; !ok || size != int64(pos.Size) {
+			r.addIssue("%s: key %q at offset %d references no valid record at offset %d of data file %d",
+				path, rec.record.Key, rec.offset, pos.Offset, pos.Fid)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	r.files++
+	r.corrupts = append(r.corrupts, corrupts...)
+	return nil
+}
+
+// checkMergeFinishedFile 检查merge完成文件的格式，文件不存在时返回false
+func (c *checker) checkMergeFinishedFile(r *report, dir string) (bool, error) {
+	path := filepath.Join(dir, data.MergeFinishedFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	var records []*data.LogRecord
+	corrupts, err := c.scanFile(path, data.FileTypeMergeFinished, data.MergeFinishedId, func(rec *scannedRecord) {
+		records = append(records, rec.record)
+	})
+	if err != nil {
+		return false, err
+	}
+	r.files++
+	r.corrupts = append(r.corrupts, corrupts...)
+
+	if len(records) == 0 || string(records[0].Key) != data.MergeFinishedKey {
+		r.addIssue("%s: missing %s record", path, data.MergeFinishedKey)
+		return true, nil
+	}
+	if _, err := strconv.ParseUint(string(records[0].Value), 10, 32); err != nil {
+		r.addIssue("%s: invalid non-merged file id %q", path, records[0].Value)
+	}
+	if len(records) > 1 {
+		if string(records[1].Key) != data.MergeFilesKey {
+			r.addIssue("%s: unexpected record %q", path, records[1].Key)
+			return true, nil
+		}
+		for _, s := range strings.Split(string(records[1].Value), ",") {
+			if _, err := strconv.ParseUint(s, 10, 32); err != nil {
+				r.addIssue("%s: invalid merged file id %q", path, s)
+				break
+			}
+		}
+	}
+	return true, nil
+}
+
+// checkMergeDir merge目录中没有merge完成文件时，说明merge没有完成，下次启动时会被删除
+func (c *checker) checkMergeDir(r *report, mergePath string) error {
+	finished, err := c.checkMergeFinishedFile(r, mergePath)
+	if err != nil {
+		return err
+	}
+	if !finished {
+		r.addIssue("%s: stale merge directory without %s, it is removed on the next open",
+			mergePath, data.MergeFinishedFileName)
+		return nil
+	}
+
+	r.addNote("%s: finished merge is applied on the next open", mergePath)
+
+	// merge目录中的数据文件都是重写之后的数据，不包含事务
+	fileIds, err := dataFileIds(mergePath)
+	if err != nil {
+		return err
+	}
+	records := make(fileRecords)
+	for _, fid := range fileIds {
+		path := data.GetDataFileName(mergePath, fid)
+		records[fid] = make(map[int64]int64)
+		corrupts, err := c.scanFile(path, data.FileTypeData, fid, func(rec *scannedRecord) {
+			r.addRecord(rec)
+			records[fid][rec.offset] = rec.size
+		})
+		if err != nil {
+			return err
+		}
+		r.files++
+		r.corrupts = append(r.corrupts, corrupts...)
+	}
+
+	return c.checkHintFile(r, mergePath, records)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	bitcaskKV "go-bitcask-kv"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/fio"
+	"go-bitcask-kv/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 写入数据、事务以及合并记录之后关闭
+func prepareDB(t *testing.T, name string) bitcaskKV.Option {
+	opts := bitcaskKV.DefaultOption
+	dir, _ := os.MkdirTemp("", name)
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+
+	db, err := bitcaskKV.Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("counter"), []byte("100")))
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(64)))
+		if i%30 == 0 {
+			_, err := db.Apply([]byte("counter"), bitcaskKV.Int64AddOperatorName, []byte("1"))
+			assert.Nil(t, err)
+		}
+	}
+	wb := db.NewWriteBatch(bitcaskKV.DefaultWriteBachOption)
+	assert.Nil(t, wb.Put([]byte("txn-key"), []byte("txn-value")))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+	return opts
+}
+
+func removeDB(opts bitcaskKV.Option) {
+	_ = os.RemoveAll(opts.DirPath)
+	_ = os.RemoveAll(opts.DirPath + data.MergeDirSuffix)
+}
+
+func TestCheckDir_Healthy(t *testing.T) {
+	opts := prepareDB(t, "bitcask-fsck-healthy")
+	defer removeDB(opts)
+
+	c := &checker{}
+	r, err := c.checkDir(opts.DirPath)
+	assert.Nil(t, err)
+	assert.True(t, r.healthy())
+	assert.True(t, r.files > 1)
+	assert.True(t, r.records > 300)
+}
+
+func TestCheckDir_Repair(t *testing.T) {
+	opts := prepareDB(t, "bitcask-fsck-repair")
+	defer removeDB(opts)
+
+	// 破坏第一个文件中间的一条记录
+	var corruptKey []byte
+	var corruptOffset int64
+	path := data.GetDataFileName(opts.DirPath, 0)
+	c := &checker{}
+	_, err := c.scanFile(path, data.FileTypeData, 0, func(rec *scannedRecord) {
+		if rec.offset > 4096 && corruptKey == nil {
+			corruptKey, _ = data.DecodeRecordKeyWithSeq(rec.record.Key)
+			corruptOffset = rec.offset
+		}
+	})
+	assert.Nil(t, err)
+	buf, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	buf[corruptOffset+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, buf, 0644))
+
+	// 最后一个文件末尾有没有提交的事务
+	fileIds, err := dataFileIds(opts.DirPath)
+	assert.Nil(t, err)
+	lastFile, err := os.OpenFile(data.GetDataFileName(opts.DirPath, fileIds[len(fileIds)-1]), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   data.EncodeRecordKeyWithSeq(utils.GetTestKey(1000+i), 1000),
+			Value: []byte("uncommitted"),
+			Type:  data.LogRecordNormal,
+		})
+		_, err = lastFile.Write(encRecord)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, lastFile.Close())
+
+	// 没有完成的merge留下的目录
+	assert.Nil(t, os.MkdirAll(opts.DirPath+data.MergeDirSuffix, os.ModePerm))
+
+	r, err := c.checkDir(opts.DirPath)
+	assert.Nil(t, err)
+	assert.False(t, r.healthy())
+	assert.Equal(t, 1, len(r.corrupts))
+	assert.Equal(t, corruptOffset, r.corrupts[0].start)
+	assert.Equal(t, []orphanTxn{{seqNo: 1000, records: 2, file: lastFile.Name()}}, r.orphans)
+	assert.Equal(t, 1, len(r.issues))
+
+	out := filepath.Join(os.TempDir(), filepath.Base(opts.DirPath)+"-repaired")
+	defer func() {
+		_ = os.RemoveAll(out)
+	}()
+	res, err := c.salvage(opts.DirPath, out)
+	assert.Nil(t, err)
+	assert.Equal(t, len(fileIds), res.files)
+	assert.Equal(t, 2, res.dropped)
+
+	// 修复之后的目录没有问题，并且可以正常打开
+	r, err = c.checkDir(out)
+	assert.Nil(t, err)
+	assert.True(t, r.healthy())
+
+	opts.DirPath = out
+	db, err := bitcaskKV.Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	_, err = db.Get(corruptKey)
+	assert.Equal(t, bitcaskKV.ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(1000))
+	assert.Equal(t, bitcaskKV.ErrKeyNotFound, err)
+	assert.Equal(t, 300+2-1, len(db.ListKeys()))
+
+	val, err := db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("110"), val)
+	val, err = db.Get([]byte("txn-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn-value"), val)
+}
+
+func TestCheckDir_Encrypted(t *testing.T) {
+	opts := bitcaskKV.DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-fsck-encrypted")
+	opts.DirPath = dir
+	opts.EncryptionKey = []byte("0123456789abcdef")
+	opts.EncryptionKeyId = 3
+	defer removeDB(opts)
+
+	db, err := bitcaskKV.Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(64)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 没有密钥时加密的记录无法解析
+	c := &checker{}
+	r, err := c.checkDir(dir)
+	assert.Nil(t, err)
+	assert.False(t, r.healthy())
+	assert.Equal(t, 0, r.records)
+
+	keyRing, err := parseKeys("3:30313233343536373839616263646566")
+	assert.Nil(t, err)
+	c = &checker{keys: keyRing}
+	r, err = c.checkDir(dir)
+	assert.Nil(t, err)
+	assert.True(t, r.healthy())
+	assert.Equal(t, 100, r.records)
+
+	// 修复之后的记录使用同一个密钥加密
+	out := dir + "-repaired"
+	defer func() {
+		_ = os.RemoveAll(out)
+	}()
+	res, err := c.salvage(dir, out)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, res.records)
+
+	opts.DirPath = out
+	db, err = bitcaskKV.Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
+
+func TestScanFile_Resync(t *testing.T) {
+	dir := t.TempDir()
+	encode := func(key string) []byte {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   data.EncodeRecordKeyWithSeq([]byte(key), 0),
+			Value: []byte("value-" + key),
+			Type:  data.LogRecordNormal,
+		})
+		return encRecord
+	}
+
+	// 损坏的区间中恰好有一条能通过crc校验的孤立记录，之后仍然是损坏的数据
+	garbage := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03}
+	var tail []byte
+	tail = append(tail, garbage...)
+	tail = append(tail, encode("phantom")...)
+	tail = append(tail, garbage...)
+	record1, record2, record3 := encode("key-1"), encode("key-2"), encode("key-3")
+
+	dataFile, err := data.OpenDataFile(dir, 0, fio.StandardIO)
+	assert.Nil(t, err)
+	for _, buf := range [][]byte{record1, tail, record2, record3} {
+		assert.Nil(t, dataFile.Write(buf))
+	}
+	assert.Nil(t, dataFile.Close())
+
+	var keys []string
+	c := &checker{}
+	corrupts, err := c.scanFile(data.GetDataFileName(dir, 0), data.FileTypeData, 0, func(rec *scannedRecord) {
+		key, _ := data.DecodeRecordKeyWithSeq(rec.record.Key)
+		keys = append(keys, string(key))
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key-1", "key-2", "key-3"}, keys)
+	badStart := int64(data.FileHeaderSize + len(record1))
+	assert.Equal(t, 1, len(corrupts))
+	assert.Equal(t, badStart, corrupts[0].start)
+	assert.Equal(t, badStart+int64(len(tail)), corrupts[0].end)
+}
+
+// reverseCompressor 使用flate压缩之后反转数据，fsck中没有该算法
+type reverseCompressor struct{}
+
+func (c *reverseCompressor) Type() uint8 {
+	return 100
+}
+
+func reverse(src []byte) []byte {
+	dst := make([]byte, len(src))
+	for i := range src {
+		dst[len(src)-1-i] = src[i]
+	}
+	return dst
+}
+
+func (c *reverseCompressor) Compress(src []byte) ([]byte, error) {
+	compressed, err := (&data.FlateCompressor{Level: 6}).Compress(src)
+	if err != nil {
+		return nil, err
+	}
+	return reverse(compressed), nil
+}
+
+func (c *reverseCompressor) Decompress(src []byte) ([]byte, error) {
+	return (&data.FlateCompressor{Level: 6}).Decompress(reverse(src))
+}
+
+func TestCheckDir_CustomCompressor(t *testing.T) {
+	opts := bitcaskKV.DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-fsck-compressor")
+	opts.DirPath = dir
+	opts.Compressor = &reverseCompressor{}
+	defer removeDB(opts)
+
+	db, err := bitcaskKV.Open(opts)
+	assert.Nil(t, err)
+	values := make(map[int][]byte)
+	for i := 0; i < 100; i++ {
+		values[i] = bytes.Repeat([]byte(fmt.Sprintf("value-%d", i)), 16)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, db.Put([]byte("raw"), []byte("v")))
+	assert.Nil(t, db.Close())
+
+	// 无法解压的记录crc校验通过，不是损坏的数据
+	c := &checker{}
+	r, err := c.checkDir(dir)
+	assert.Nil(t, err)
+	assert.True(t, r.healthy())
+	assert.Equal(t, 101, r.records)
+	assert.Equal(t, 100, r.compressed)
+	assert.Equal(t, 1, len(r.notes))
+
+	// 修复时原样保留压缩之后的value, 配置同样的算法之后可以读取
+	out := dir + "-repaired"
+	defer func() {
+		_ = os.RemoveAll(out)
+	}()
+	res, err := c.salvage(dir, out)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, res.records)
+	assert.Equal(t, 0, res.dropped)
+
+	opts.DirPath = out
+	db, err = bitcaskKV.Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	val, err := db.Get([]byte("raw"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+}
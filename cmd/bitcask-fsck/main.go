@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"go-bitcask-kv/data"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bitcask-fsck 离线检查数据目录，数据库不能同时处于打开状态
+//
+//	bitcask-fsck -dir /path/to/db
+//	bitcask-fsck -dir /path/to/db -repair /path/to/new-db
+//	bitcask-fsck -dir /path/to/db -keys 1:<hex key>,2:<hex key>
+//
+// 没有发现问题时退出码为0, 发现问题时为1, 执行出错时为2
+func main() {
+	dir := flag.String("dir", "", "the database directory to check")
+	repair := flag.String("repair", "", "salvage valid records into this directory, which must be empty or not exist")
+	keys := flag.String("keys", "", "encryption keys as id:hex pairs separated by commas, the last one is used by repair")
+	flag.Parse()
+
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	keyRing, err := parseKeys(*keys)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	c := &checker{keys: keyRing}
+	if _, err := os.Stat(*dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	r, err := c.checkDir(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	printReport(r)
+
+	if *repair != "" {
+		res, err := c.salvage(*dir, *repair)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		fmt.Printf("salvaged %d records from %d data files into %s, dropped %d records\n",
+			res.records, res.files, *repair, res.dropped)
+	}
+
+	if !r.healthy() {
+		os.Exit(1)
+	}
+}
+
+// parseKeys 解析-keys参数，为空时返回nil
+func parseKeys(s string) (*data.KeyRing, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	keys := make(map[uint32][]byte)
+	var currentId uint32
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid key %q, expect id:hex", pair)
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key id %q", parts[0])
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key of id %d: %v", id, err)
+		}
+		keys[uint32(id)] = key
+		currentId = uint32(id)
+	}
+	return data.NewKeyRing(currentId, keys)
+}
+
+func printReport(r *report) {
+	fmt.Printf("checked %d files, %d valid records\n", r.files, r.records)
+	for _, c := range r.corrupts {
+		fmt.Printf("corrupt: %s [%d, %d) %d bytes: %s\n", c.file, c.start, c.end, c.end-c.start, c.reason)
+	}
+	for _, txn := range r.orphans {
+		fmt.Printf("orphan txn: seq %d, %d records, first in %s\n", txn.seqNo, txn.records, txn.file)
+	}
+	for _, issue := range r.issues {
+		fmt.Printf("issue: %s\n", issue)
+	}
+	for _, note := range r.notes {
+		fmt.Printf("note: %s\n", note)
+	}
+	if r.healthy() {
+		fmt.Println("no problems found")
+	}
+}
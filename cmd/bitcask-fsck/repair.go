@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/fio"
+	"os"
+)
+
+// 修复时只从数据文件中抢救完整的记录，写入到新目录中同一个id的文件
+// 记录的偏移会发生变化，因此不拷贝hint文件以及B+树索引，打开新目录时从数据文件重建索引
+// merge目录中的数据在原来的数据文件中都还存在，不需要处理
+
+// salvageResult 修复的结果
+type salvageResult struct {
+	files   int
+	records int
+
+	// 没有提交的事务中的记录，引用的记录已经丢失的合并记录，
+	// 以及之前有记录的位置发生变化之后，使用自定义算法压缩的合并记录
+	dropped int
+
+	// 是否已经有记录写入到和原来不同的位置
+	shifted bool
+}
+
+// salvage 将dir中所有可以解析并且有效的记录写入到out目录，out目录必须不存在或者为空
+func (c *checker) salvage(dir, out string) (*salvageResult, error) {
+	entries, err := os.ReadDir(out)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("the repair directory %s is not empty", out)
+	}
+	if err := os.MkdirAll(out, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	fileIds, err := dataFileIds(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先找出所有已经提交的事务
+	committed := make(map[uint64]bool)
+	for _, fid := range fileIds {
+		_, err := c.scanFile(data.GetDataFileName(dir, fid), data.FileTypeData, fid, func(rec *scannedRecord) {
+			if rec.record.Type == data.LogRecordTxnFinished {
+				_, seqNo := data.DecodeRecordKeyWithSeq(rec.record.Key)
+				committed[seqNo] = true
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &salvageResult{}
+	// 原来的记录位置到新位置的映射，用于修正合并记录中引用的上一条记录
+	moved := make(map[data.LogRecordPos]*data.LogRecordPos)
+	for _, fid := range fileIds {
+		if err := c.salvageFile(dir, out, fid, committed, moved, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (c *checker) salvageFile(dir, out string, fid uint32, committed map[uint64]bool,
+	moved map[data.LogRecordPos]*data.LogRecordPos, res *salvageResult) error {
+	dataFile, err := data.OpenDataFile(out, fid, fio.StandardIO)
+	if err != nil {
+		return err
+	}
+
+	var writeErr error
+	_, err = c.scanFile(data.GetDataFileName(dir, fid), data.FileTypeData, fid, func(rec *scannedRecord) {
+		if writeErr != nil {
+			return
+		}
+
+		_, seqNo := data.DecodeRecordKeyWithSeq(rec.record.Key)
+		if seqNo != 0 && !committed[seqNo] {
+			res.dropped++
+			return
+		}
+
+		if rec.record.Type == data.LogRecordMerge {
+			// 无法解压的合并记录无法修正其中引用的上一条记录，只有之前所有记录的位置都没有变化时才能原样保留
+			if rec.compressed && res.shifted {
+				res.dropped++
+				return
+			}
+			if !rec.compressed {
+				value, ok := relocateMergeValue(rec.record.Value, moved)
+				if !ok {
+					res.dropped++
+					return
+				}
+				rec.record.Value = value
+			}
+		}
+
+		// 使用自定义算法压缩的记录保留压缩之后的value, 使用原来的算法编号写入
+		var encRecord []byte
+		var size int64
+		var err error
+		if rec.compressed {
+			encRecord, size, err = data.EncodeCompressedLogRecord(rec.record, c.keys)
+		} else {
+			encRecord, size, err = data.EncodeLogRecordWithKeys(rec.record, nil, 0, c.keys)
+		}
+		if err != nil {
+			writeErr = err
+			return
+		}
+		oldPos := data.LogRecordPos{Fid: fid, Offset: rec.offset, Size: uint32(rec.size)}
+		moved[oldPos] = &data.LogRecordPos{Fid: fid, Offset: dataFile.WriteOff, Size: uint32(size)}
+		if dataFile.WriteOff != rec.offset || size != rec.size {
+			res.shifted = true
+		}
+		if writeErr = dataFile.Write(encRecord); writeErr == nil {
+			res.records++
+		}
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = dataFile.Sync()
+	}
+	if closeErr := dataFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	res.files++
+	return nil
+}
+
+// relocateMergeValue 将合并记录中引用的上一条记录的位置替换为修复之后的位置
+func relocateMergeValue(value []byte, moved map[data.LogRecordPos]*data.LogRecordPos) ([]byte, bool) {
+	mv, err := data.DecodeMergeValue(value)
+	if err != nil {
+		return nil, false
+	}
+	if mv.Prev == nil {
+		return value, true
+	}
+
+	prev := mv.Prev
+	newPrev, ok := moved[data.LogRecordPos{Fid: prev.Fid, Offset: prev.Offset, Size: prev.Size}]
+	if !ok {
+		return nil, false
+	}
+	mv.Prev = &data.LogRecordPos{
+		Fid:    newPrev.Fid,
+		Offset: newPrev.Offset,
+		Size:   newPrev.Size,
+		Expire: prev.Expire,
+	}
+	return data.EncodeMergeValue(mv), true
+}
@@ -0,0 +1,348 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/fio"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 每个数据文件中无效数据的大小在写入和启动加载索引时维护，
+// 配置了MergeFileGarbageRatio之后merge只压缩无效数据比例达到阈值的文件，
+// 压缩之后的文件使用原来的文件id, 重启时替换掉原来的文件，没有参与merge的文件保持不变
+// 之前的文件没有参与merge时，其中可能还有被删除或者过期的key的旧值，
+// 因此压缩之后的文件中需要保留这些key的删除标记，重启时删除标记在旧值之后加载
+
+// FileStat 单个数据文件的统计信息
+type FileStat struct {
+	FileId uint32
+
+	// 文件大小
+	Size int64
+
+	// 有效数据大小
+	LiveSize int64
+
+	// 无效数据大小，即merge可以回收的空间
+	DeadSize int64
+}
+
+// FileStats 获取每个数据文件的统计信息，按照文件id从小到大排列
+func (db *DB) FileStats() ([]FileStat, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	files := make([]*data.SegDataFile, 0, len(db.olderFiles)+1)
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+
+	stats := make([]FileStat, 0, len(files))
+	for _, file := range files {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		dead := db.deadBytes[file.FileId]
+		stats = append(stats, FileStat{
+			FileId:   file.FileId,
+			Size:     size,
+			LiveSize: size - dead,
+			DeadSize: dead,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].FileId < stats[j].FileId
+	})
+	return stats, nil
+}
+
+// markGarbage 记录一条已经失效的记录，同时累加总的以及所在文件的无效数据大小
+// 访问该方法前必须持有db互斥锁
+func (db *DB) markGarbage(pos *data.LogRecordPos) {
+	db.recycleSize += pos.Size
+	db.deadBytes[pos.Fid] += int64(pos.Size)
+}
+
+// loadBPlusTreeFileStats B+树索引启动时不扫描数据文件，根据索引中有效记录的大小重新统计每个文件中的无效数据
+// 文件中除了文件头和有效记录之外都是可以回收的空间，包括被覆盖的旧值、删除标记以及事务完成标识
+// 索引中没有记录类型，无法知道文件中是否有合并记录，按照都有合并记录处理，压缩之前的文件时这些文件同样参与merge
+func (db *DB) loadBPlusTreeFileStats() error {
+	now := time.Now().UnixNano()
+	liveBytes := make(map[uint32]int64)
+	it := db.index.Iterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if pos := it.Value(); !pos.IsExpired(now) {
+			liveBytes[pos.Fid] += int64(pos.Size)
+		}
+	}
+	it.Close()
+
+	files := make([]*data.SegDataFile, 0, len(db.olderFiles)+1)
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+
+	// 处理损坏尾部时记录的无效数据同样包含在文件大小中，重新统计
+	db.recycleSize = 0
+	db.deadBytes = make(map[uint32]int64, len(files))
+	for _, file := range files {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		if dead := size - file.DataOffset() - liveBytes[file.FileId]; dead > 0 {
+			db.markGarbage(&data.LogRecordPos{Fid: file.FileId, Size: uint32(dead)})
+		}
+		db.mergeRecordNum[file.FileId] = 1
+	}
+	return nil
+}
+
+// pickMergeFiles 挑选参与merge的文件，包括当前的active文件
+// 没有配置MergeFileGarbageRatio时所有文件都参与merge, 否则只挑选无效数据比例达到阈值以及需要重新加密的文件
+// 访问该方法前必须持有db互斥锁
+func (db *DB) pickMergeFiles() ([]*data.SegDataFile, error) {
+	files := make([]*data.SegDataFile, 0, len(db.olderFiles)+1)
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	files = append(files, db.activeFile)
+
+	if db.option.MergeFileGarbageRatio <= 0 {
+		return files, nil
+	}
+
+	var picked, rest []*data.SegDataFile
+	var minPickedId uint32
+	for _, file := range files {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		stale, err := db.isStaleKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if stale || (size > 0 && float32(db.deadBytes[file.FileId])/float32(size) >= db.option.MergeFileGarbageRatio) {
+			if len(picked) == 0 || file.FileId < minPickedId {
+				minPickedId = file.FileId
+			}
+			picked = append(picked, file)
+		} else {
+			rest = append(rest, file)
+		}
+	}
+	if len(picked) == 0 {
+		return nil, nil
+	}
+
+	// 合并记录可能引用之前文件中的记录，被引用的文件压缩之后偏移会发生变化,
+	// 因此之后包含合并记录的文件也需要参与merge, 将合并记录替换为完整的值
+	for _, file := range rest {
+		if file.FileId > minPickedId && db.mergeRecordNum[file.FileId] > 0 {
+			picked = append(picked, file)
+		}
+	}
+	return picked, nil
+}
+
+// minUncompactedFileId 获取没有参与merge的文件中最小的文件id, 所有文件都参与merge时返回math.MaxUint32
+// 访问该方法前必须持有db互斥锁
+func (db *DB) minUncompactedFileId(mergeFiles []*data.SegDataFile) uint32 {
+	picked := make(map[uint32]bool, len(mergeFiles))
+	for _, file := range mergeFiles {
+		picked[file.FileId] = true
+	}
+
+	var minId uint32 = math.MaxUint32
+	for fid := range db.olderFiles {
+		if !picked[fid] && fid < minId {
+			minId = fid
+		}
+	}
+	if !picked[db.activeFile.FileId] && db.activeFile.FileId < minId {
+		minId = db.activeFile.FileId
+	}
+	return minId
+}
+
+// compactFile 将文件中的有效数据写入到merge目录下同一个id的文件中
+// 文件id不变，重启之后加载索引时和其他文件之间的先后顺序也不会改变
+// keepTombstones为true时之前有没有参与merge的文件，被删除或者过期的key写入一条删除标记
+// 文件中没有有效数据以及删除标记时不会保留输出文件，重启时原来的文件直接被删除
+func (db *DB) compactFile(task *mergeTask, mergePath string, dataFile *data.SegDataFile, hintFile *data.SegDataFile,
+	getMergeFile func(fid uint32) *data.SegDataFile, keepTombstones bool) error {
+	compactedFile, err := data.OpenDataFile(mergePath, dataFile.FileId, fio.StandardIO)
+	if err != nil {
+		return err
+	}
+
+	write := func(realKey []byte, logRecord *data.LogRecord) error {
+		encRecord, size, err := db.encodeLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		pos := &data.LogRecordPos{
+			Fid:    dataFile.FileId,
+			Offset: compactedFile.WriteOff,
+			Size:   uint32(size),
+			Expire: logRecord.Expire,
+		}
+		if err := compactedFile.Write(encRecord); err != nil {
+			return err
+		}
+		if err := task.written(size); err != nil {
+			return err
+		}
+		return db.writeHintRecord(hintFile, realKey, logRecord.Type, pos)
+	}
+
+	// 同一个key在文件中只需要一条删除标记
+	var onRemoved func(realKey []byte) error
+	if keepTombstones {
+		tombstones := make(map[string]bool)
+		onRemoved = func(realKey []byte) error {
+			if tombstones[string(realKey)] {
+				return nil
+			}
+			tombstones[string(realKey)] = true
+			return write(realKey, &data.LogRecord{
+				Key:  data.EncodeRecordKeyWithSeq(realKey, nonTransactionSeqNo),
+				Type: data.LogRecordDeleted,
+			})
+		}
+	}
+
+	now := time.Now().UnixNano()
+	err = db.foreachLiveRecord(task, dataFile, getMergeFile, now, write, onRemoved)
+	if err == nil {
+		err = compactedFile.Sync()
+	}
+	if closeErr := compactedFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	task.finishFile()
+	if compactedFile.WriteOff == compactedFile.DataOffset() {
+		return os.Remove(data.GetDataFileName(mergePath, dataFile.FileId))
+	}
+	return nil
+}
+
+// hintReader 按顺序读取hint文件中的索引
+// merge时按照文件id从小到大写入hint文件，因此加载索引时可以和数据文件一起按顺序处理
+type hintReader struct {
+	file   *data.SegDataFile
+	offset int64
+
+	// 下一条索引，pos为nil表示已经读完
+	// typ为LogRecordDeleted时pos是删除标记的位置，否则是有效数据的位置
+	key []byte
+	typ data.LogRecordType
+	pos *data.LogRecordPos
+}
+
+// openHintReader 打开目录下的hint文件，不存在时返回nil, keys用于解密加密的hint文件
+func openHintReader(dirPath string, keys *data.KeyRing) (*hintReader, error) {
+	hintFileName := filepath.Join(dirPath, data.HintFileName)
+	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	hintFile, err := data.OpenHintFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	hintFile.Keys = keys
+
+	r := &hintReader{file: hintFile, offset: hintFile.DataOffset()}
+	if err := r.next(); err != nil {
+		_ = hintFile.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// readHintFileIds 读取hint文件中有索引的所有文件id, hint文件不存在时返回nil
+func readHintFileIds(dirPath string, keys *data.KeyRing) (map[uint32]bool, error) {
+	r, err := openHintReader(dirPath, keys)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.close()
+	}()
+
+	fileIds := make(map[uint32]bool)
+	for r.pos != nil {
+		fileIds[r.pos.Fid] = true
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+	}
+	return fileIds, nil
+}
+
+// next 读取下一条索引
+func (r *hintReader) next() error {
+	logRecord, size, err := r.file.ReadLogRecord(r.offset)
+	if err != nil {
+		if err == io.EOF {
+			r.key, r.pos = nil, nil
+			return nil
+		}
+		return err
+	}
+
+	// hint文件中存的是realKey, 不需要处理事务id
+	// 之前版本的hint文件中没有设置记录类型，都是有效数据的位置
+	r.key = logRecord.Key
+	r.typ = data.LogRecordNormal
+	if logRecord.Type == data.LogRecordDeleted {
+		r.typ = data.LogRecordDeleted
+	}
+	r.pos = data.DecodeLogRecordPos(logRecord.Value)
+	r.offset += size
+	return nil
+}
+
+// load 加载hint文件中属于文件fid的索引，hint文件中没有该文件的索引时返回false
+func (r *hintReader) load(fid uint32, fn func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos)) (bool, error) {
+	// 跳过已经不存在的文件的索引
+	for r.pos != nil && r.pos.Fid < fid {
+		if err := r.next(); err != nil {
+			return false, err
+		}
+	}
+
+	if r.pos == nil || r.pos.Fid != fid {
+		return false, nil
+	}
+
+	for r.pos != nil && r.pos.Fid == fid {
+		fn(r.key, r.typ, r.pos)
+		if err := r.next(); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (r *hintReader) close() error {
+	return r.file.Close()
+}
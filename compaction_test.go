@@ -0,0 +1,309 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/index"
+	"go-bitcask-kv/utils"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDB_FileStats(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-file-stats")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+	for i := 50; i < 80; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBachOption)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.GetTestRandomValue(128)))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(2)))
+	assert.Nil(t, wb.Commit())
+
+	stats, err := db.FileStats()
+	assert.Nil(t, err)
+	assert.True(t, len(stats) > 1)
+	assert.True(t, stats[0].DeadSize > 0)
+
+	var dead int64
+	for i, stat := range stats {
+		assert.Equal(t, stat.Size, stat.LiveSize+stat.DeadSize)
+		if i > 0 {
+			assert.True(t, stats[i-1].FileId < stat.FileId)
+		}
+		dead += stat.DeadSize
+	}
+	assert.Equal(t, int64(db.Stat().RecycleSize), dead)
+
+	// 重启之后重新统计的结果和运行时一致
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+
+	stats2, err := db2.FileStats()
+	assert.Nil(t, err)
+	assert.Equal(t, stats, stats2)
+}
+
+func TestDB_Merge_SelectiveCompaction(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-selective-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.01
+	opts.MergeFileGarbageRatio = 0.5
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 500; i++ {
+		values[i] = utils.GetTestRandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+
+	// 只让第一个文件中的大部分数据失效
+	pos := db.index.Get(utils.GetTestKey(0))
+	assert.Equal(t, uint32(0), pos.Fid)
+	for i := 0; i < 500; i++ {
+		if p := db.index.Get(utils.GetTestKey(i)); p.Fid != 0 || i%5 == 0 {
+			continue
+		}
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+	for i := 500; i < 700; i++ {
+		values[i] = utils.GetTestRandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+
+	stats, err := db.FileStats()
+	assert.Nil(t, err)
+	sizes := make(map[uint32]int64)
+	for _, stat := range stats {
+		sizes[stat.FileId] = stat.Size
+		if stat.FileId > 0 {
+			assert.True(t, float32(stat.DeadSize)/float32(stat.Size) < opts.MergeFileGarbageRatio)
+		}
+	}
+
+	assert.Nil(t, db.Merge())
+
+	// merge目录中只有被压缩的文件
+	entries, err := os.ReadDir(db.getMergePath())
+	assert.Nil(t, err)
+	var dataFiles []string
+	for _, entry := range entries {
+		if entry.Name() != data.HintFileName && entry.Name() != data.MergeFinishedFileName {
+			dataFiles = append(dataFiles, entry.Name())
+		}
+	}
+	assert.Equal(t, []string{"bitcask_000000000.data"}, dataFiles)
+
+	// merge之后继续写入，重启之后同样可以读到
+	values[0] = utils.GetTestRandomValue(128)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), values[0]))
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+
+	stats2, err := db2.FileStats()
+	assert.Nil(t, err)
+	for _, stat := range stats2 {
+		if stat.FileId == 0 {
+			assert.True(t, stat.Size < sizes[0])
+			assert.True(t, float32(stat.DeadSize)/float32(stat.Size) < opts.MergeFileGarbageRatio)
+			continue
+		}
+		// 没有参与merge的文件保持不变
+		if size, ok := sizes[stat.FileId]; ok {
+			assert.Equal(t, size, stat.Size)
+		}
+	}
+
+	assert.Equal(t, len(values), db2.index.Size())
+	for i, value := range values {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestDB_Merge_SelectiveCompaction_MergeRecords(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-selective-merge-records")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.01
+	opts.MergeFileGarbageRatio = 0.5
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// 计数器的基础值在第一个文件中，之后的合并记录写入到后面的文件
+	assert.Nil(t, db.Put([]byte("counter"), []byte("100")))
+	for i := 0; i < 90; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(1000+i), utils.GetTestRandomValue(128)))
+		if i%20 == 0 {
+			_, err := db.Apply([]byte("counter"), Int64AddOperatorName, []byte("1"))
+			assert.Nil(t, err)
+		}
+	}
+	pos := db.index.Get([]byte("counter"))
+	assert.True(t, pos.Fid > 0)
+
+	// 只有第一个文件达到阈值
+	for i := 0; i < 90; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+
+	val, err := db2.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("110"), val)
+}
+
+func TestDB_Merge_SelectiveCompaction_KeepTombstones(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-selective-merge-tombstones")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.01
+	opts.MergeFileGarbageRatio = 0.5
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 第一个文件中的数据大部分有效，不会参与merge
+	assert.Nil(t, db.Put([]byte("key5"), utils.GetTestRandomValue(128)))
+	assert.Nil(t, db.Put([]byte("key6"), utils.GetTestRandomValue(128)))
+	for i := 0; db.activeFile.FileId == 0; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+
+	// 删除记录以及过期的记录在第二个文件中，该文件中的数据大部分都已经失效
+	assert.Nil(t, db.Delete([]byte("key5")))
+	assert.Nil(t, db.PutWithTTL([]byte("key6"), utils.GetTestRandomValue(128), time.Millisecond*20))
+	for db.activeFile.FileId == 1 {
+		assert.Nil(t, db.Put([]byte("hot-key"), utils.GetTestRandomValue(128)))
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	assert.Nil(t, db.Merge())
+	entries, err := os.ReadDir(db.getMergePath())
+	assert.Nil(t, err)
+	var dataFiles []string
+	for _, entry := range entries {
+		if entry.Name() != data.HintFileName && entry.Name() != data.MergeFinishedFileName {
+			dataFiles = append(dataFiles, entry.Name())
+		}
+	}
+	assert.Equal(t, []string{"bitcask_000000001.data"}, dataFiles)
+	hotValue, err := db.Get([]byte("hot-key"))
+	assert.Nil(t, err)
+	// merge时过期的key6已经从索引中移除
+	assert.Nil(t, db.index.Get([]byte("key6")))
+	keyNum := db.index.Size()
+	assert.Nil(t, db.Close())
+
+	// 第一个文件中的旧值不会重新生效
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	_, err = db.Get([]byte("key5"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("key6"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get([]byte("hot-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, hotValue, val)
+	assert.Equal(t, keyNum, db.index.Size())
+
+	// 删除标记同样会在之后的merge中保留
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put([]byte("hot-key"), utils.GetTestRandomValue(128)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key5"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("key6"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_FileStats_BPlusTree(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-file-stats-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.IndexType = index.BPlusTreeIndex
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.01
+	opts.MergeFileGarbageRatio = 0.5
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+	for i := 100; i < 130; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	stats, err := db.FileStats()
+	assert.Nil(t, err)
+	recycleSize := db.Stat().RecycleSize
+	assert.Nil(t, db.Close())
+
+	// B+树索引重启时不扫描数据文件，无效数据的统计根据索引重新计算
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	stats2, err := db.FileStats()
+	assert.Nil(t, err)
+	assert.Equal(t, stats, stats2)
+	assert.Equal(t, recycleSize, db.Stat().RecycleSize)
+
+	// 重启之后仍然能够挑选出无效数据比例达到阈值的文件
+	assert.Nil(t, db.Merge())
+	entries, err := os.ReadDir(db.getMergePath())
+	assert.Nil(t, err)
+	var compacted int
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.SegDataFileNameSuffix) {
+			compacted++
+		}
+	}
+	assert.True(t, compacted > 0)
+}
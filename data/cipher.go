@@ -0,0 +1,160 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// 加密之后的记录格式: header | 密钥编号(4B) | nonce(12B) | 密文
+// 明文为 keySize(uvarint) | key | value，key和value一起加密，header中的keySize为0，valueSize为密文部分的长度
+// 记录类型以及过期时间仍然保存在明文的header中，作为附加数据参与认证，不能被篡改
+// 需要压缩时先压缩value再加密，读取时先校验crc再解密，最后解压
+// 每条记录都带有密钥编号，因此同一个文件中使用不同密钥加密的记录以及没有加密的记录可以混合存在
+
+const (
+	keyIdSize = 4
+)
+
+// KeyRing 加密使用的密钥，写入时使用当前密钥，读取时根据记录中的密钥编号选择密钥
+type KeyRing struct {
+	currentId uint32
+	aeads     map[uint32]cipher.AEAD
+}
+
+// NewKeyRing 创建KeyRing, keys为密钥编号到AES密钥的映射，密钥长度为16、24或32字节
+// keys中必须包含currentId对应的密钥
+func NewKeyRing(currentId uint32, keys map[uint32][]byte) (*KeyRing, error) {
+	if _, ok := keys[currentId]; !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+
+	k := &KeyRing{currentId: currentId, aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// CurrentId 写入时使用的密钥编号
+func (k *KeyRing) CurrentId() uint32 {
+	return k.currentId
+}
+
+// sealRecord 使用当前密钥加密key和value，返回的记录key为空，value为密文
+func (k *KeyRing) sealRecord(record *LogRecord, compressed bool) (*LogRecord, error) {
+	aead := k.aeads[k.currentId]
+
+	plain := make([]byte, binary.MaxVarintLen32+len(record.Key)+len(record.Value))
+	n := binary.PutUvarint(plain, uint64(len(record.Key)))
+	n += copy(plain[n:], record.Key)
+	n += copy(plain[n:], record.Value)
+
+	nonceSize := aead.NonceSize()
+	buf := make([]byte, keyIdSize+nonceSize, keyIdSize+nonceSize+n+aead.Overhead())
+	binary.LittleEndian.PutUint32(buf, k.currentId)
+	if _, err := rand.Read(buf[keyIdSize:]); err != nil {
+		return nil, err
+	}
+	buf = aead.Seal(buf, buf[keyIdSize:], plain[:n], recordAdditionalData(record.Type, record.Expire, compressed))
+
+	return &LogRecord{Value: buf, Type: record.Type, Expire: record.Expire}, nil
+}
+
+// openRecord 解密记录，还原出key和value
+func (k *KeyRing) openRecord(record *LogRecord, compressed bool) error {
+	if len(record.Value) < keyIdSize {
+		return ErrDecryptFailed
+	}
+	aead, ok := k.aeads[binary.LittleEndian.Uint32(record.Value)]
+	if !ok {
+		return ErrEncryptionKeyNotFound
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(record.Value) < keyIdSize+nonceSize {
+		return ErrDecryptFailed
+	}
+	nonce := record.Value[keyIdSize : keyIdSize+nonceSize]
+	plain, err := aead.Open(nil, nonce, record.Value[keyIdSize+nonceSize:],
+		recordAdditionalData(record.Type, record.Expire, compressed))
+	if err != nil {
+		return ErrDecryptFailed
+	}
+
+	keySize, n := binary.Uvarint(plain)
+	if n <= 0 || uint64(len(plain)-n) < keySize {
+		return ErrDecryptFailed
+	}
+	record.Key = plain[n : n+int(keySize) : n+int(keySize)]
+	record.Value = plain[n+int(keySize):]
+	if len(record.Key) == 0 {
+		record.Key = nil
+	}
+	if len(record.Value) == 0 {
+		record.Value = nil
+	}
+	return nil
+}
+
+// recordAdditionalData header中参与认证的字段
+func recordAdditionalData(typ LogRecordType, expire int64, compressed bool) []byte {
+	ad := make([]byte, 1+8)
+	ad[0] = byte(typ)
+	if compressed {
+		ad[0] |= logRecordCompressFlag
+	}
+	binary.LittleEndian.PutUint64(ad[1:], uint64(expire))
+	return ad
+}
+
+// openRecordWithKeys 解密设置了加密标志位的记录，没有提供密钥时返回ErrEncryptionKeyNotFound
+func openRecordWithKeys(keys *KeyRing, record *LogRecord, compressed bool) error {
+	if keys == nil {
+		return ErrEncryptionKeyNotFound
+	}
+	return keys.openRecord(record, compressed)
+}
+
+// RecordKeyId 获取offset处记录加密使用的密钥编号，记录没有加密时encrypted为false
+// 只解析header，不校验crc
+func (df *SegDataFile) RecordKeyId(offset int64) (keyId uint32, encrypted bool, err error) {
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return 0, false, err
+	}
+	var headerBytes int64 = maxLogRecordHeaderSize
+	if offset+headerBytes > fileSize {
+		headerBytes = fileSize - offset
+	}
+	if headerBytes <= 0 {
+		return 0, false, nil
+	}
+
+	headerBuf, err := df.readNBytes(headerBytes, offset)
+	if err != nil {
+		return 0, false, err
+	}
+	header, headSize := DecodeRecordHeader(headerBuf)
+	if header == nil || !header.encrypted {
+		return 0, false, nil
+	}
+	if offset+headSize+keyIdSize > fileSize {
+		return 0, false, nil
+	}
+
+	buf, err := df.readNBytes(keyIdSize, offset+headSize)
+	if err != nil {
+		return 0, false, err
+	}
+	return binary.LittleEndian.Uint32(buf), true, nil
+}
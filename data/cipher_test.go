@@ -0,0 +1,133 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/fio"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func TestEncodeLogRecordWithKeys(t *testing.T) {
+	keys, err := NewKeyRing(1, map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32)})
+	assert.Nil(t, err)
+
+	record := &LogRecord{Key: []byte("secret-key"), Value: []byte("secret-value"), Type: LogRecordNormal, Expire: 1700000000000000000}
+	buf, size, err := EncodeLogRecordWithKeys(record, nil, 0, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(buf)), size)
+	assert.Equal(t, logRecordEncryptFlag|logRecordExpireFlag|byte(LogRecordNormal), buf[4])
+	assert.False(t, bytes.Contains(buf, record.Key))
+	assert.False(t, bytes.Contains(buf, record.Value))
+
+	res, resSize, err := DecodeLogRecordBufWithKeys(buf, keys, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, size, resSize)
+	assert.Equal(t, record, res)
+
+	// 相同的记录每次加密的结果都不相同
+	buf2, _, err := EncodeLogRecordWithKeys(record, nil, 0, keys)
+	assert.Nil(t, err)
+	assert.NotEqual(t, buf, buf2)
+
+	// 没有密钥以及密钥错误
+	_, _, err = DecodeLogRecordBuf(buf)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+	other, err := NewKeyRing(2, map[uint32][]byte{2: bytes.Repeat([]byte("k"), 32)})
+	assert.Nil(t, err)
+	_, _, err = DecodeLogRecordBufWithKeys(buf, other, nil)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+	wrong, err := NewKeyRing(1, map[uint32][]byte{1: bytes.Repeat([]byte("w"), 16)})
+	assert.Nil(t, err)
+	_, _, err = DecodeLogRecordBufWithKeys(buf, wrong, nil)
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	// 篡改header中的过期时间之后重新计算crc, 认证失败
+	tampered := append([]byte(nil), buf...)
+	_, headSize := DecodeRecordHeader(tampered)
+	tampered[headSize-1] ^= 0x01
+	binary.LittleEndian.PutUint32(tampered, crc32.ChecksumIEEE(tampered[crc32.Size:]))
+	_, _, err = DecodeLogRecordBufWithKeys(tampered, keys, nil)
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	// 删除记录没有value
+	deleted := &LogRecord{Key: []byte("secret-key"), Type: LogRecordDeleted}
+	buf, _, err = EncodeLogRecordWithKeys(deleted, nil, 0, keys)
+	assert.Nil(t, err)
+	res, _, err = DecodeLogRecordBufWithKeys(buf, keys, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, deleted, res)
+
+	// 先压缩再加密
+	value := bytes.Repeat([]byte("abcd"), 64)
+	compressed := &LogRecord{Key: []byte("key"), Value: value, Type: LogRecordNormal}
+	buf, size, err = EncodeLogRecordWithKeys(compressed, &FlateCompressor{Level: 6}, 0, keys)
+	assert.Nil(t, err)
+	assert.True(t, size < int64(len(value)))
+	assert.Equal(t, logRecordEncryptFlag|logRecordCompressFlag|byte(LogRecordNormal), buf[4])
+	res, _, err = DecodeLogRecordBufWithKeys(buf, keys, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, compressed, res)
+}
+
+func TestNewKeyRing(t *testing.T) {
+	_, err := NewKeyRing(1, map[uint32][]byte{2: bytes.Repeat([]byte("k"), 16)})
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+
+	_, err = NewKeyRing(1, map[uint32][]byte{1: []byte("short")})
+	assert.NotNil(t, err)
+}
+
+func TestSegDataFile_ReadEncryptedLogRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-cipher")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardIO)
+	assert.Nil(t, err)
+
+	oldKeys, err := NewKeyRing(1, map[uint32][]byte{1: bytes.Repeat([]byte("a"), 16)})
+	assert.Nil(t, err)
+	newKeys, err := NewKeyRing(2, map[uint32][]byte{1: bytes.Repeat([]byte("a"), 16), 2: bytes.Repeat([]byte("b"), 24)})
+	assert.Nil(t, err)
+
+	// 没有加密以及使用不同密钥加密的记录混合存在
+	records := []*LogRecord{
+		{Key: []byte("plain"), Value: []byte("value"), Type: LogRecordNormal},
+		{Key: []byte("old"), Value: []byte("value"), Type: LogRecordNormal},
+		{Key: []byte("new"), Value: []byte("value"), Type: LogRecordNormal},
+	}
+	ringsOf := []*KeyRing{nil, oldKeys, newKeys}
+	var offsets []int64
+	for i, record := range records {
+		offsets = append(offsets, dataFile.WriteOff)
+		buf, _, err := EncodeLogRecordWithKeys(record, nil, 0, ringsOf[i])
+		assert.Nil(t, err)
+		assert.Nil(t, dataFile.Write(buf))
+	}
+
+	_, encrypted, err := dataFile.RecordKeyId(offsets[0])
+	assert.Nil(t, err)
+	assert.False(t, encrypted)
+	keyId, encrypted, err := dataFile.RecordKeyId(offsets[1])
+	assert.Nil(t, err)
+	assert.True(t, encrypted)
+	assert.Equal(t, uint32(1), keyId)
+
+	// 没有密钥时只能读取没有加密的记录
+	res, _, err := dataFile.ReadLogRecord(offsets[0])
+	assert.Nil(t, err)
+	assert.Equal(t, records[0], res)
+	_, _, err = dataFile.ReadLogRecord(offsets[1])
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+
+	dataFile.Keys = newKeys
+	for i, offset := range offsets {
+		res, _, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, records[i], res)
+	}
+	assert.Nil(t, dataFile.Close())
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// 压缩之后的value格式: 压缩算法编号(1B) | 压缩之后的数据
+// 记录头部type字节中的压缩标志位表示value经过了压缩，读取时根据编号找到对应的算法解压，
+// 因此同一个文件中压缩和没有压缩的记录，以及使用不同算法压缩的记录可以混合存在
+
+// Compressor 压缩算法，可以自定义实现snappy、zstd等算法，加入到读取时使用的Compressors中才能解压
+type Compressor interface {
+	// Type 算法编号，写入到每条压缩的记录中，0为保留值
+	Type() uint8
+
+	// Compress 压缩数据
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress 解压数据
+	Decompress(src []byte) ([]byte, error)
+}
+
+// FlateCompressorType 内置flate压缩算法的编号
+const FlateCompressorType uint8 = 1
+
+var flateCompressor = &FlateCompressor{Level: flate.DefaultCompression}
+
+// Compressors 读取压缩的记录时根据编号查找压缩算法，总是包含内置的flate算法
+// 每个DB持有自己的算法表，不同DB配置的自定义算法互不影响，创建之后不会被修改，可以并发读取
+type Compressors struct {
+	m map[uint8]Compressor
+}
+
+// NewCompressors 创建包含内置算法以及cs的算法表，相同编号的算法后面的覆盖前面的
+func NewCompressors(cs ...Compressor) *Compressors {
+	m := map[uint8]Compressor{FlateCompressorType: flateCompressor}
+	for _, c := range cs {
+		if c != nil {
+			m[c.Type()] = c
+		}
+	}
+	return &Compressors{m: m}
+}
+
+// get 根据编号查找算法，cs为nil时只能找到内置的算法
+func (cs *Compressors) get(typ uint8) Compressor {
+	if cs == nil {
+		if typ == FlateCompressorType {
+			return flateCompressor
+		}
+		return nil
+	}
+	return cs.m[typ]
+}
+
+// compressValue 压缩value并在前面加上算法编号
+func compressValue(c Compressor, value []byte) ([]byte, error) {
+	compressed, err := c.Compress(value)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1+len(compressed))
+	buf[0] = c.Type()
+	copy(buf[1:], compressed)
+	return buf, nil
+}
+
+// decompressValue 根据value中的算法编号解压
+func decompressValue(cs *Compressors, value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, ErrUnknownCompressor
+	}
+
+	c := cs.get(value[0])
+	if c == nil {
+		return nil, ErrUnknownCompressor
+	}
+	return c.Decompress(value[1:])
+}
+
+// DecodeCompressedLogRecordBuf 和DecodeLogRecordBufWithKeys相同，但是不解压value
+// compressed为true时value是带有算法编号的压缩数据，用于原样保留没有对应算法无法解压的记录
+func DecodeCompressedLogRecordBuf(buf []byte, keys *KeyRing) (record *LogRecord, size int64, compressed bool, err error) {
+	logRecord, header, recordSize, err := decodeLogRecordBuf(buf)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if header.encrypted {
+		if err := openRecordWithKeys(keys, logRecord, header.compressed); err != nil {
+			return nil, 0, false, err
+		}
+	}
+	return logRecord, recordSize, header.compressed, nil
+}
+
+// EncodeCompressedLogRecord 对value已经压缩的记录编码，value中需要带有算法编号，不需要知道对应的压缩算法
+// keys不为nil时使用当前密钥加密记录
+func EncodeCompressedLogRecord(record *LogRecord, keys *KeyRing) ([]byte, int64, error) {
+	return sealLogRecord(record, logRecordCompressFlag, keys)
+}
+
+// FlateCompressor 基于标准库compress/flate的压缩算法
+type FlateCompressor struct {
+	// 压缩级别，和flate包中的定义一致
+	Level int
+}
+
+func (f *FlateCompressor) Type() uint8 {
+	return FlateCompressorType
+}
+
+func (f *FlateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, f.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *FlateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/fio"
+	"os"
+	"testing"
+)
+
+// 测试用的压缩算法，只是把数据反转
+type reverseCompressor struct{}
+
+func (r *reverseCompressor) Type() uint8 {
+	return 200
+}
+
+func (r *reverseCompressor) Compress(src []byte) ([]byte, error) {
+	dst := make([]byte, len(src)/2)
+	for i := range dst {
+		dst[i] = src[len(src)-1-i]
+	}
+	return dst, nil
+}
+
+func (r *reverseCompressor) Decompress(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src)*2)
+	for i := len(src) - 1; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return append(dst, dst...), nil
+}
+
+func TestEncodeLogRecordWithCompressor(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"bitcask","type":"kv"}`), 20)
+	record := &LogRecord{Key: []byte("key"), Value: value, Type: LogRecordNormal, Expire: 1700000000000000000}
+
+	raw, rawSize := EncodeLogRecord(record)
+	buf, size, err := EncodeLogRecordWithCompressor(record, &FlateCompressor{Level: 6}, 0)
+	assert.Nil(t, err)
+	assert.True(t, size < rawSize/5)
+	assert.Equal(t, logRecordCompressFlag|logRecordExpireFlag|byte(LogRecordNormal), buf[4])
+
+	res, resSize, err := DecodeLogRecordBuf(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, size, resSize)
+	assert.Equal(t, record, res)
+
+	// 没有达到最小压缩大小
+	buf, size, err = EncodeLogRecordWithCompressor(record, &FlateCompressor{Level: 6}, len(value)+1)
+	assert.Nil(t, err)
+	assert.Equal(t, rawSize, size)
+	assert.Equal(t, raw, buf)
+
+	// 压缩之后没有变小
+	small := &LogRecord{Key: []byte("key"), Value: []byte("v"), Type: LogRecordNormal}
+	rawSmall, _ := EncodeLogRecord(small)
+	buf, _, err = EncodeLogRecordWithCompressor(small, &FlateCompressor{Level: 6}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, rawSmall, buf)
+}
+
+func TestSegDataFile_ReadCompressedLogRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-compress")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardIO)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("abcd"), 64)
+	records := []*LogRecord{
+		{Key: []byte("raw"), Value: value, Type: LogRecordNormal},
+		{Key: []byte("flate"), Value: value, Type: LogRecordNormal},
+		{Key: []byte("custom"), Value: value, Type: LogRecordNormal},
+	}
+	compressors := []Compressor{nil, &FlateCompressor{Level: 6}, &reverseCompressor{}}
+	for i, record := range records {
+		buf, _, err := EncodeLogRecordWithCompressor(record, compressors[i], 0)
+		assert.Nil(t, err)
+		assert.Nil(t, dataFile.Write(buf))
+	}
+
+	// 算法表中没有的算法无法解压
+	offset := dataFile.DataOffset()
+	for i := 0; i < 2; i++ {
+		res, size, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, records[i], res)
+		offset += size
+	}
+	customOffset := offset
+	_, _, err = dataFile.ReadLogRecord(customOffset)
+	assert.Equal(t, ErrUnknownCompressor, err)
+
+	dataFile.Compressors = NewCompressors(&reverseCompressor{})
+	res, _, err := dataFile.ReadLogRecord(customOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, records[2], res)
+	assert.Nil(t, dataFile.Close())
+
+	// 算法只对配置了该算法表的文件生效，不影响其他打开的文件
+	other, err := OpenDataFile(dir, 0, fio.StandardIO)
+	assert.Nil(t, err)
+	_, _, err = other.ReadLogRecord(customOffset)
+	assert.Equal(t, ErrUnknownCompressor, err)
+	other.Compressors = NewCompressors()
+	_, _, err = other.ReadLogRecord(customOffset)
+	assert.Equal(t, ErrUnknownCompressor, err)
+	assert.Nil(t, other.Close())
+}
+
+func TestCompressedLogRecord_Passthrough(t *testing.T) {
+	oldKeys, err := NewKeyRing(1, map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32)})
+	assert.Nil(t, err)
+	newKeys, err := NewKeyRing(2, map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32), 2: bytes.Repeat([]byte("n"), 16)})
+	assert.Nil(t, err)
+
+	record := &LogRecord{Key: []byte("custom"), Value: bytes.Repeat([]byte("abcd"), 64), Type: LogRecordNormal, Expire: 100}
+	buf, _, err := EncodeLogRecordWithKeys(record, &reverseCompressor{}, 0, oldKeys)
+	assert.Nil(t, err)
+	_, _, err = DecodeLogRecordBufWithKeys(buf, oldKeys, nil)
+	assert.Equal(t, ErrUnknownCompressor, err)
+
+	// 没有对应的算法时保留压缩之后的value, 使用新的密钥重新加密
+	res, size, compressed, err := DecodeCompressedLogRecordBuf(buf, oldKeys)
+	assert.Nil(t, err)
+	assert.True(t, compressed)
+	assert.Equal(t, int64(len(buf)), size)
+	assert.Equal(t, record.Key, res.Key)
+	assert.Equal(t, (&reverseCompressor{}).Type(), res.Value[0])
+
+	buf, _, err = EncodeCompressedLogRecord(res, newKeys)
+	assert.Nil(t, err)
+	decoded, _, err := DecodeLogRecordBufWithKeys(buf, newKeys, NewCompressors(&reverseCompressor{}))
+	assert.Nil(t, err)
+	assert.Equal(t, record, decoded)
+
+	// 没有压缩的记录
+	buf, _ = EncodeLogRecord(record)
+	res, _, compressed, err = DecodeCompressedLogRecordBuf(buf, nil)
+	assert.Nil(t, err)
+	assert.False(t, compressed)
+	assert.Equal(t, record, res)
+}
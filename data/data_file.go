@@ -10,9 +10,12 @@ import (
 )
 
 type SegDataFile struct {
-	FileId    uint32
-	WriteOff  int64         // 文件写入到的位置
-	IoManager fio.IOManager // IO管理结构
+	FileId      uint32
+	WriteOff    int64         // 文件写入到的位置
+	IoManager   fio.IOManager // IO管理结构
+	Header      *FileHeader   // 文件头，没有文件头的旧文件为nil
+	Keys        *KeyRing      // 解密记录使用的密钥，没有加密时为nil
+	Compressors *Compressors  // 解压记录使用的压缩算法，为nil时只能读取内置算法压缩的记录
 }
 
 const (
@@ -22,16 +25,58 @@ const (
 	HintFileId            = 0
 	MergeFinishedFileName = "merge_finished"
 	MergeFinishedId       = 0
+	IndexSnapshotFileName = "index_snapshot"
+	IndexSnapshotId       = 0
+
+	// MergeDirSuffix merge目录为数据目录名加上该后缀，比如/tmp/bitcask的merge目录为/tmp/bitcask-merge
+	MergeDirSuffix = "-merge"
+
+	// MergeFinishedKey merge完成文件中第一条记录的key, value为最小的没有参与merge的文件id
+	MergeFinishedKey = "merge_finished"
+
+	// MergeFilesKey 只合并部分文件时，merge完成文件中额外记录参与merge的文件id, 以逗号分隔
+	MergeFilesKey = "merge_files"
 )
 
 var (
-	ErrInvalidCRC = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidCRC             = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidFileHeader      = errors.New("invalid file header, the file maybe corrupted or is not a bitcask file")
+	ErrUnsupportedFileVersion = errors.New("unsupported file format version")
+	ErrUnknownCompressor      = errors.New("the compressor of log record is not registered")
+	ErrEncryptionKeyNotFound  = errors.New("the encryption key of log record is not found")
+	ErrDecryptFailed          = errors.New("failed to decrypt log record, the encryption key maybe wrong")
+	ErrFileHeaderIncomplete   = errors.New("the file header is incomplete, the file maybe being created")
+	ErrInvalidMergeValue      = errors.New("invalid merge record value")
 )
 
 // OpenDataFile 打开新的日志文件
 func OpenDataFile(path string, fileId uint32, ioType fio.IOType) (*SegDataFile, error) {
 	fileName := GetDataFileName(path, fileId)
-	return newDataFile(fileName, fileId, ioType)
+	return newDataFile(fileName, fileId, FileTypeData, ioType)
+}
+
+// OpenDataFileReadOnly 打开已经存在的数据文件用于读取，不会创建文件或者写入文件头
+// ioType只能是ReadOnlyIO或者MemoryIO，文件刚被创建还没有写完文件头时返回ErrFileHeaderIncomplete
+func OpenDataFileReadOnly(path string, fileId uint32, ioType fio.IOType) (*SegDataFile, error) {
+	fileName := GetDataFileName(path, fileId)
+	header, err := readFileHeader(fileName, fileId, FileTypeData)
+	if err != nil {
+		return nil, err
+	}
+
+	ioManager, err := fio.NewIOManager(fileName, ioType)
+	if err != nil {
+		return nil, err
+	}
+
+	datafile := &SegDataFile{
+		FileId:    fileId,
+		IoManager: ioManager,
+		Header:    header,
+	}
+	datafile.WriteOff = datafile.DataOffset()
+
+	return datafile, nil
 }
 
 func GetDataFileName(path string, fileId uint32) string {
@@ -40,15 +85,26 @@ func GetDataFileName(path string, fileId uint32) string {
 
 func OpenHintFile(path string) (*SegDataFile, error) {
 	fileName := filepath.Join(path, HintFileName)
-	return newDataFile(fileName, HintFileId, fio.StandardIO)
+	return newDataFile(fileName, HintFileId, FileTypeHint, fio.StandardIO)
 }
 
 func OpenMergeFinishedFile(path string) (*SegDataFile, error) {
 	fileName := filepath.Join(path, MergeFinishedFileName)
-	return newDataFile(fileName, MergeFinishedId, fio.StandardIO)
+	return newDataFile(fileName, MergeFinishedId, FileTypeMergeFinished, fio.StandardIO)
 }
 
-func newDataFile(fileName string, fileId uint32, ioType fio.IOType) (*SegDataFile, error) {
+// OpenIndexSnapshotFile 打开索引快照文件，fileName为完整的路径，写入时先写到临时文件再重命名
+func OpenIndexSnapshotFile(fileName string) (*SegDataFile, error) {
+	return newDataFile(fileName, IndexSnapshotId, FileTypeIndexSnapshot, fio.StandardIO)
+}
+
+func newDataFile(fileName string, fileId uint32, fileType FileType, ioType fio.IOType) (*SegDataFile, error) {
+	// 新文件写入文件头，已经存在的文件校验文件头
+	header, err := prepareFileHeader(fileName, fileId, fileType)
+	if err != nil {
+		return nil, err
+	}
+
 	// 初始化IOManager管理接口
 	ioManager, err := fio.NewIOManager(fileName, ioType)
 	if err != nil {
@@ -57,13 +113,22 @@ func newDataFile(fileName string, fileId uint32, ioType fio.IOType) (*SegDataFil
 
 	datafile := &SegDataFile{
 		FileId:    fileId,
-		WriteOff:  0,
 		IoManager: ioManager,
+		Header:    header,
 	}
+	datafile.WriteOff = datafile.DataOffset()
 
 	return datafile, nil
 }
 
+// DataOffset 第一条记录的位置，即文件头的大小
+func (df *SegDataFile) DataOffset() int64 {
+	if df.Header == nil {
+		return 0
+	}
+	return FileHeaderSize
+}
+
 // ReadLogRecord 根据offset偏移读取文件
 func (df *SegDataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 这里需要特殊处理，比如到文件末尾不足 15B，但这其实是一条完整的记录，比如删除记录可能总大小不足15B
@@ -103,7 +168,12 @@ func (df *SegDataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headSize + keySize + valueSize
 
-	logRecord := &LogRecord{Type: header.recordType}
+	// 写入过程中崩溃会留下不完整的记录，头部损坏时解析出的长度也可能超出文件
+	if offset+recordSize > fileSize {
+		return nil, 0, io.EOF
+	}
+
+	logRecord := &LogRecord{Type: header.recordType, Expire: header.expire}
 
 	// 读取数据部分
 	// 这里没有交由DecodeLogRecord处理，因为整个logRecord占用的buf大小没办法一开始确定
@@ -136,9 +206,19 @@ func (df *SegDataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		return nil, 0, ErrInvalidCRC
 	}
 
+	// crc校验的是写入文件的数据，校验之后再解密、解压
+	if err := header.decodeValue(logRecord, df.Keys, df.Compressors); err != nil {
+		return nil, 0, err
+	}
+
 	return logRecord, recordSize, nil
 }
 
+// ReadRange 读取从offset开始的n个字节，用于一次读取多条相邻的记录
+func (df *SegDataFile) ReadRange(offset int64, n int64) ([]byte, error) {
+	return df.readNBytes(n, offset)
+}
+
 func (df *SegDataFile) readNBytes(n int64, offset int64) ([]byte, error) {
 	b := make([]byte, n)
 	_, err := df.IoManager.Read(b, offset)
@@ -58,7 +58,7 @@ func TestSegDataFile_ReadLogRecord(t *testing.T) {
 		Type:  LogRecordNormal,
 	}
 
-	var offset int64 = 0
+	var offset = dataFile.DataOffset()
 	buf, size1 := EncodeLogRecord(record1)
 	dataFile.Write(buf)
 
@@ -85,3 +85,39 @@ func TestSegDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, []byte("world"), record4.Value)
 	assert.Equal(t, LogRecordDeleted, record4.Type)
 }
+
+func TestSegDataFile_ReadLogRecordWithExpire(t *testing.T) {
+	dataFile, err := OpenDataFile(os.TempDir(), 222, fio.StandardIO)
+	defer destoryFile(os.TempDir(), 222)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+
+	// 带过期时间和不带过期时间的记录混合写入
+	record1 := &LogRecord{
+		Key:    []byte("bitcask"),
+		Value:  []byte("kvEngine"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	buf, size1 := EncodeLogRecord(record1)
+	err = dataFile.Write(buf)
+	assert.Nil(t, err)
+
+	record2 := &LogRecord{
+		Key:   []byte("hello"),
+		Value: []byte("world"),
+		Type:  LogRecordNormal,
+	}
+	buf, _ = EncodeLogRecord(record2)
+	err = dataFile.Write(buf)
+	assert.Nil(t, err)
+
+	res1, size, err := dataFile.ReadLogRecord(dataFile.DataOffset())
+	assert.Nil(t, err)
+	assert.Equal(t, size1, size)
+	assert.Equal(t, record1, res1)
+
+	res2, _, err := dataFile.ReadLogRecord(dataFile.DataOffset() + size)
+	assert.Nil(t, err)
+	assert.Equal(t, record2, res2)
+}
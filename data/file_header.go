@@ -0,0 +1,170 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go-bitcask-kv/fio"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// File Header Format
+// +------------+------------+------------+------------+----------------+------------+------------+
+// |   magic    |  version   |    type    |  reserved  |   createdAt    |   fileId   |    crc     |
+// +------------+------------+------------+------------+----------------+------------+------------+
+// |     4B     |     1B     |     1B     |     2B     |       8B       |     4B     |     4B     |
+// +------------+------------+------------+------------+----------------+------------+------------+
+//
+// 新创建的文件以header开头，记录从header之后开始写入
+// 之前版本创建的文件没有header, 不以magic开头的文件按照没有header的旧文件读取
+const (
+	FileHeaderSize = 24
+
+	// FileFormatVersion 当前的文件格式版本，打开更高版本的文件时返回ErrUnsupportedFileVersion
+	FileFormatVersion = 1
+)
+
+var fileHeaderMagic = []byte("BCKV")
+
+// FileType 文件类型，避免把hint文件等其他文件当作数据文件读取
+type FileType uint8
+
+const (
+	FileTypeData FileType = iota + 1
+	FileTypeHint
+	FileTypeMergeFinished
+	FileTypeIndexSnapshot
+)
+
+// FileHeader 文件头
+type FileHeader struct {
+	Version uint8
+	Type    FileType
+
+	// 文件创建的时间, UnixNano
+	CreatedAt int64
+
+	FileId uint32
+}
+
+// EncodeFileHeader 对文件头编码
+func EncodeFileHeader(header *FileHeader) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf[:4], fileHeaderMagic)
+	buf[4] = header.Version
+	buf[5] = byte(header.Type)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(header.CreatedAt))
+	binary.LittleEndian.PutUint32(buf[16:20], header.FileId)
+	binary.LittleEndian.PutUint32(buf[20:], crc32.ChecksumIEEE(buf[:20]))
+	return buf
+}
+
+// DecodeFileHeader 解析文件头，不以magic开头时说明是没有header的旧文件，返回nil
+func DecodeFileHeader(buf []byte) (*FileHeader, error) {
+	if !hasFileHeaderMagic(buf) {
+		return nil, nil
+	}
+	if len(buf) < FileHeaderSize {
+		return nil, ErrInvalidFileHeader
+	}
+
+	if crc32.ChecksumIEEE(buf[:20]) != binary.LittleEndian.Uint32(buf[20:FileHeaderSize]) {
+		return nil, ErrInvalidFileHeader
+	}
+
+	header := &FileHeader{
+		Version:   buf[4],
+		Type:      FileType(buf[5]),
+		CreatedAt: int64(binary.LittleEndian.Uint64(buf[8:16])),
+		FileId:    binary.LittleEndian.Uint32(buf[16:20]),
+	}
+	if header.Version > FileFormatVersion {
+		return nil, ErrUnsupportedFileVersion
+	}
+	return header, nil
+}
+
+func hasFileHeaderMagic(buf []byte) bool {
+	return len(buf) >= len(fileHeaderMagic) && bytes.Equal(buf[:len(fileHeaderMagic)], fileHeaderMagic)
+}
+
+// prepareFileHeader 新文件写入文件头，已经存在的文件读取并校验文件头，没有文件头的旧文件返回nil
+// 文件头在打开IOManager之前通过单独的句柄写入，MMap等只读的IO也可以打开新文件
+func prepareFileHeader(fileName string, fileId uint32, fileType FileType) (*FileHeader, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, fio.DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, FileHeaderSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	// 空文件是新创建的文件，写入文件头的过程中崩溃会留下不完整的文件头，文件中还没有任何记录，重新写入即可
+	if info.Size() < FileHeaderSize && (bytes.HasPrefix(buf, fileHeaderMagic) || bytes.HasPrefix(fileHeaderMagic, buf)) {
+		header := &FileHeader{
+			Version:   FileFormatVersion,
+			Type:      fileType,
+			CreatedAt: time.Now().UnixNano(),
+			FileId:    fileId,
+		}
+		if err := file.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := file.WriteAt(EncodeFileHeader(header), 0); err != nil {
+			return nil, err
+		}
+		return header, nil
+	}
+
+	return checkFileHeader(buf, fileId, fileType)
+}
+
+// readFileHeader 读取并校验已经存在的文件的文件头，不会创建文件或者写入文件头
+// 文件头不完整时返回ErrFileHeaderIncomplete，可能是其他进程刚刚创建了该文件，还没有写完文件头
+func readFileHeader(fileName string, fileId uint32, fileType FileType) (*FileHeader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	buf := make([]byte, FileHeaderSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	if n < FileHeaderSize && (bytes.HasPrefix(buf, fileHeaderMagic) || bytes.HasPrefix(fileHeaderMagic, buf)) {
+		return nil, ErrFileHeaderIncomplete
+	}
+	return checkFileHeader(buf, fileId, fileType)
+}
+
+// checkFileHeader 解析文件头并检查文件类型以及文件id
+func checkFileHeader(buf []byte, fileId uint32, fileType FileType) (*FileHeader, error) {
+	header, err := DecodeFileHeader(buf)
+	if err != nil || header == nil {
+		return nil, err
+	}
+	if header.Type != fileType || header.FileId != fileId {
+		return nil, ErrInvalidFileHeader
+	}
+	return header, nil
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/fio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeFileHeader(t *testing.T) {
+	header := &FileHeader{
+		Version:   FileFormatVersion,
+		Type:      FileTypeHint,
+		CreatedAt: 1700000000000000000,
+		FileId:    7,
+	}
+	buf := EncodeFileHeader(header)
+	assert.Equal(t, FileHeaderSize, len(buf))
+
+	res, err := DecodeFileHeader(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, header, res)
+
+	// 没有magic的旧文件
+	res, err = DecodeFileHeader([]byte{167, 57, 151, 56, 1, 7, 8})
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+
+	buf[10] ^= 0xff
+	_, err = DecodeFileHeader(buf)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+
+	header.Version = FileFormatVersion + 1
+	_, err = DecodeFileHeader(EncodeFileHeader(header))
+	assert.Equal(t, ErrUnsupportedFileVersion, err)
+}
+
+func TestOpenDataFile_Header(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-file-header")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	dataFile, err := OpenDataFile(dir, 3, fio.StandardIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile.Header)
+	assert.Equal(t, uint32(3), dataFile.Header.FileId)
+	assert.Equal(t, FileTypeData, dataFile.Header.Type)
+	assert.Equal(t, int64(FileHeaderSize), dataFile.WriteOff)
+
+	buf, _ := EncodeLogRecord(&LogRecord{Key: []byte("key"), Value: []byte("value"), Type: LogRecordNormal})
+	assert.Nil(t, dataFile.Write(buf))
+	assert.Nil(t, dataFile.Close())
+
+	// 重新打开时读取文件头，也可以使用MMap打开
+	dataFile, err = OpenDataFile(dir, 3, fio.MemoryIO)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), dataFile.Header.FileId)
+	record, _, err := dataFile.ReadLogRecord(dataFile.DataOffset())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), record.Value)
+	assert.Nil(t, dataFile.Close())
+
+	// 文件名和文件头中的id不一致
+	assert.Nil(t, os.Rename(GetDataFileName(dir, 3), GetDataFileName(dir, 4)))
+	_, err = OpenDataFile(dir, 4, fio.StandardIO)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+
+	// 文件类型不一致
+	assert.Nil(t, os.Rename(GetDataFileName(dir, 4), filepath.Join(dir, HintFileName)))
+	_, err = OpenHintFile(dir)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+}
+
+func TestOpenDataFile_LegacyAndTornHeader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-file-header-legacy")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 没有文件头的旧文件
+	buf, size := EncodeLogRecord(&LogRecord{Key: []byte("key"), Value: []byte("value"), Type: LogRecordNormal})
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 0), buf, fio.DataFilePerm))
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardIO)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Header)
+	assert.Equal(t, int64(0), dataFile.DataOffset())
+	record, recordSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, recordSize)
+	assert.Equal(t, []byte("value"), record.Value)
+	assert.Nil(t, dataFile.Close())
+
+	// 写入文件头的过程中崩溃，重新写入文件头
+	header := EncodeFileHeader(&FileHeader{Version: FileFormatVersion, Type: FileTypeData, FileId: 1})
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 1), header[:10], fio.DataFilePerm))
+	dataFile, err = OpenDataFile(dir, 1, fio.StandardIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile.Header)
+	fileSize, err := dataFile.IoManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(FileHeaderSize), fileSize)
+	assert.Nil(t, dataFile.Close())
+}
+
+func TestOpenDataFileReadOnly(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-file-header-readonly")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 不存在的文件不会被创建
+	_, err := OpenDataFileReadOnly(dir, 0, fio.ReadOnlyIO)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(GetDataFileName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardIO)
+	assert.Nil(t, err)
+	buf, _ := EncodeLogRecord(&LogRecord{Key: []byte("key"), Value: []byte("value"), Type: LogRecordNormal})
+	assert.Nil(t, dataFile.Write(buf))
+	assert.Nil(t, dataFile.Close())
+
+	for _, ioType := range []fio.IOType{fio.ReadOnlyIO, fio.MemoryIO} {
+		readOnly, err := OpenDataFileReadOnly(dir, 0, ioType)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(0), readOnly.Header.FileId)
+		record, _, err := readOnly.ReadLogRecord(readOnly.DataOffset())
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), record.Value)
+		assert.Nil(t, readOnly.Close())
+	}
+
+	// 文件头还没有写完时不会重新写入文件头
+	header := EncodeFileHeader(&FileHeader{Version: FileFormatVersion, Type: FileTypeData, FileId: 1})
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 1), header[:10], fio.DataFilePerm))
+	_, err = OpenDataFileReadOnly(dir, 1, fio.ReadOnlyIO)
+	assert.Equal(t, ErrFileHeaderIncomplete, err)
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 2), nil, fio.DataFilePerm))
+	_, err = OpenDataFileReadOnly(dir, 2, fio.ReadOnlyIO)
+	assert.Equal(t, ErrFileHeaderIncomplete, err)
+	info, err := os.Stat(GetDataFileName(dir, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), info.Size())
+
+	assert.Nil(t, os.Rename(GetDataFileName(dir, 0), GetDataFileName(dir, 3)))
+	_, err = OpenDataFileReadOnly(dir, 3, fio.ReadOnlyIO)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 )
 
 type LogRecordType int8
@@ -11,18 +12,31 @@ const (
 	LogRecordNormal LogRecordType = iota + 1
 	LogRecordDeleted
 	LogRecordTxnFinished
+
+	// 合并操作符写入的记录，value中保存操作数以及上一条记录的位置
+	LogRecordMerge
 )
 
 // Log Head Format
-// +------------+------------+----------------+-----------------+-----------+-------------+
-// |	crc		|    type	 |    keySize	  | 	valueSize  |    key    |    value    |
-// +------------+------------+----------------+-----------------+-----------+-------------+
-//		4B    		  1B   		variable 5B	      variable 5B
+// +------------+------------+----------------+-----------------+------------------+-----------+-------------+
+// |	crc		|    type	 |    keySize	  | 	valueSize  |  expire(可选)	   |    key    |    value    |
+// +------------+------------+----------------+-----------------+------------------+-----------+-------------+
+//		4B    		  1B   		variable 5B	      variable 5B		variable 10B
+//
+// type字节的低4位存储记录类型，高位作为标志位
+// 只有设置了过期标志位时header中才会有expire字段，因此不带过期时间的旧记录仍然可以正常读取
+// 设置了压缩标志位时value是压缩之后的数据，见compressor.go
+// 设置了加密标志位时key和value一起加密之后存放在value中，见cipher.go
 const (
-	maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+	maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5
 	minLogRecordHeaderSize = 4 + 1 + 1 + 1
 	logRecordTypeSize      = 1
-	LogRecordPosSize       = binary.MaxVarintLen32 + binary.MaxVarintLen64 + binary.MaxVarintLen32
+	LogRecordPosSize       = binary.MaxVarintLen32 + binary.MaxVarintLen64*2 + binary.MaxVarintLen32
+
+	logRecordTypeMask     = 0x0F
+	logRecordExpireFlag   = 0x10
+	logRecordCompressFlag = 0x20
+	logRecordEncryptFlag  = 0x40
 )
 
 // WAL日志记录的Header部分
@@ -31,17 +45,29 @@ type logRecordHeader struct {
 	recordType LogRecordType
 	keySize    uint32
 	valueSize  uint32
+	expire     int64
+	compressed bool
+	encrypted  bool
 }
 
 // EncodeRecordHeader 对logRecord头部进行编码
 func EncodeRecordHeader(logRecord *LogRecord) ([]byte, int64) {
+	return encodeRecordHeader(logRecord, 0)
+}
+
+// encodeRecordHeader flags为压缩、加密等需要额外设置的标志位
+func encodeRecordHeader(logRecord *LogRecord, flags byte) ([]byte, int64) {
 	headerBuf := make([]byte, maxLogRecordHeaderSize)
 
 	// 预留4B
 	offset := crc32.Size
 
-	// 写入type
-	headerBuf[offset] = byte(logRecord.Type)
+	// 写入type, 带过期时间、压缩以及加密的记录需要设置标志位
+	typ := byte(logRecord.Type) | flags
+	if logRecord.Expire > 0 {
+		typ |= logRecordExpireFlag
+	}
+	headerBuf[offset] = typ
 	offset += logRecordTypeSize
 
 	// 写入keySize valueSize
@@ -50,6 +76,11 @@ func EncodeRecordHeader(logRecord *LogRecord) ([]byte, int64) {
 	offset += binary.PutUvarint(headerBuf[offset:], uint64(len(logRecord.Key)))
 	offset += binary.PutUvarint(headerBuf[offset:], uint64(len(logRecord.Value)))
 
+	// 写入过期时间
+	if logRecord.Expire > 0 {
+		offset += binary.PutVarint(headerBuf[offset:], logRecord.Expire)
+	}
+
 	return headerBuf[:offset], int64(offset)
 }
 
@@ -60,17 +91,59 @@ func DecodeRecordHeader(headerBuf []byte) (*logRecordHeader, int64) {
 		return nil, 0
 	}
 
-	keySize, keyOffset := binary.Uvarint(headerBuf[crc32.Size+logRecordTypeSize:])
-	valueSize, valueOffset := binary.Uvarint(headerBuf[crc32.Size+logRecordTypeSize+keyOffset:])
+	typ := headerBuf[crc32.Size]
+	var index = crc32.Size + logRecordTypeSize
+
+	// 损坏的数据或者加密之后的随机数据可能无法解析出长度
+	keySize, n := binary.Uvarint(headerBuf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	index += n
+	valueSize, n := binary.Uvarint(headerBuf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	index += n
 
 	header := &logRecordHeader{
 		crc:        binary.LittleEndian.Uint32(headerBuf[:crc32.Size]),
-		recordType: LogRecordType(headerBuf[crc32.Size]),
+		recordType: LogRecordType(typ & logRecordTypeMask),
 		keySize:    uint32(keySize),
 		valueSize:  uint32(valueSize),
+		compressed: typ&logRecordCompressFlag != 0,
+		encrypted:  typ&logRecordEncryptFlag != 0,
+	}
+
+	// 设置了过期标志位才需要解析过期时间
+	if typ&logRecordExpireFlag != 0 {
+		expire, n := binary.Varint(headerBuf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.expire = expire
+		index += n
+	}
+
+	return header, int64(index)
+}
+
+// decodeValue 对crc校验通过的记录依次解密、解压
+func (h *logRecordHeader) decodeValue(logRecord *LogRecord, keys *KeyRing, compressors *Compressors) error {
+	if h.encrypted {
+		if err := openRecordWithKeys(keys, logRecord, h.compressed); err != nil {
+			return err
+		}
 	}
 
-	return header, int64(crc32.Size + logRecordTypeSize + keyOffset + valueOffset)
+	if h.compressed {
+		value, err := decompressValue(compressors, logRecord.Value)
+		if err != nil {
+			return err
+		}
+		logRecord.Value = value
+	}
+	return nil
 }
 
 // 计算头部和数据部分的一个CRC值
@@ -95,6 +168,14 @@ type LogRecordPos struct {
 
 	// 记录大小
 	Size uint32
+
+	// 过期时间, UnixNano, 0表示永不过期
+	Expire int64
+}
+
+// IsExpired 判断记录在now时刻是否已经过期
+func (pos *LogRecordPos) IsExpired(now int64) bool {
+	return pos.Expire > 0 && pos.Expire <= now
 }
 
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
@@ -103,6 +184,7 @@ func EncodeLogRecordPos(pos *LogRecordPos) []byte {
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	index += binary.PutVarint(buf[index:], pos.Expire)
 	return buf[:index]
 }
 
@@ -114,12 +196,20 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	offset, n := binary.Varint(buf[index:])
 	index += n
 
-	size, _ := binary.Varint(buf[index:])
+	size, n := binary.Varint(buf[index:])
+	index += n
+
+	// 旧版本编码的pos不包含过期时间
+	var expire int64
+	if index < len(buf) {
+		expire, _ = binary.Varint(buf[index:])
+	}
 
 	return &LogRecordPos{
 		Fid:    uint32(fid),
 		Offset: offset,
 		Size:   uint32(size),
+		Expire: expire,
 	}
 }
 
@@ -128,12 +218,59 @@ type LogRecord struct {
 	Key   []byte
 	Value []byte
 	Type  LogRecordType
+
+	// 过期时间, UnixNano, 0表示永不过期
+	Expire int64
 }
 
 // EncodeLogRecord 对logRecord编码
 func EncodeLogRecord(record *LogRecord) ([]byte, int64) {
+	return encodeLogRecord(record, 0)
+}
+
+// EncodeLogRecordWithCompressor 对logRecord编码，value达到minSize并且压缩之后变小时写入压缩之后的value
+// c为nil时和EncodeLogRecord相同
+func EncodeLogRecordWithCompressor(record *LogRecord, c Compressor, minSize int) ([]byte, int64, error) {
+	return EncodeLogRecordWithKeys(record, c, minSize, nil)
+}
+
+// EncodeLogRecordWithKeys 和EncodeLogRecordWithCompressor相同，keys不为nil时使用当前密钥加密记录
+func EncodeLogRecordWithKeys(record *LogRecord, c Compressor, minSize int, keys *KeyRing) ([]byte, int64, error) {
+	var flags byte
+	if c != nil && len(record.Value) > 0 && len(record.Value) >= minSize {
+		compressed, err := compressValue(c, record.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(compressed) < len(record.Value) {
+			compressedRecord := *record
+			compressedRecord.Value = compressed
+			record = &compressedRecord
+			flags |= logRecordCompressFlag
+		}
+	}
+
+	return sealLogRecord(record, flags, keys)
+}
+
+// sealLogRecord keys不为nil时使用当前密钥加密记录，然后对记录编码
+func sealLogRecord(record *LogRecord, flags byte, keys *KeyRing) ([]byte, int64, error) {
+	if keys != nil {
+		sealed, err := keys.sealRecord(record, flags&logRecordCompressFlag != 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		record = sealed
+		flags |= logRecordEncryptFlag
+	}
+
+	buf, size := encodeLogRecord(record, flags)
+	return buf, size, nil
+}
+
+func encodeLogRecord(record *LogRecord, flags byte) ([]byte, int64) {
 	// 对header部分编码
-	headerBuf, headerSize := EncodeRecordHeader(record)
+	headerBuf, headerSize := encodeRecordHeader(record, flags)
 
 	var totalSize = headerSize + int64(len(record.Key)) + int64(len(record.Value))
 	buf := make([]byte, totalSize)
@@ -163,6 +300,120 @@ func DecodeLogRecord(buf []byte) (record *LogRecord) {
 	return record
 }
 
+// DecodeLogRecordBuf 从一条完整记录的数据中解析出日志记录并进行crc校验，返回记录的长度
+func DecodeLogRecordBuf(buf []byte) (*LogRecord, int64, error) {
+	return DecodeLogRecordBufWithKeys(buf, nil, nil)
+}
+
+// DecodeLogRecordBufWithKeys 和DecodeLogRecordBuf相同，使用keys解密加密的记录，compressors解压压缩的记录
+func DecodeLogRecordBufWithKeys(buf []byte, keys *KeyRing, compressors *Compressors) (*LogRecord, int64, error) {
+	logRecord, header, recordSize, err := decodeLogRecordBuf(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := header.decodeValue(logRecord, keys, compressors); err != nil {
+		return nil, 0, err
+	}
+
+	return logRecord, recordSize, nil
+}
+
+// decodeLogRecordBuf 解析记录并进行crc校验，不对value解密、解压
+func decodeLogRecordBuf(buf []byte) (*LogRecord, *logRecordHeader, int64, error) {
+	header, headSize := DecodeRecordHeader(buf)
+	if header == nil {
+		return nil, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	recordSize := headSize + keySize + valueSize
+	if int64(len(buf)) < recordSize {
+		return nil, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	// 限制容量，避免对返回的key、value追加写入时覆盖后面的数据
+	logRecord := &LogRecord{Type: header.recordType, Expire: header.expire}
+	if keySize > 0 {
+		logRecord.Key = buf[headSize : headSize+keySize : headSize+keySize]
+	}
+	if valueSize > 0 {
+		logRecord.Value = buf[headSize+keySize : recordSize : recordSize]
+	}
+
+	if getLogRecordCRC(logRecord, buf[crc32.Size:headSize]) != header.crc {
+		return nil, nil, 0, ErrInvalidCRC
+	}
+
+	return logRecord, header, recordSize, nil
+}
+
+// FindNextLogRecord 跳过buf开头损坏的数据，返回之后第一条有效记录的位置，没有时返回-1
+// 损坏的数据中可能恰好有片段能通过crc校验，因此除了记录类型和标志位有效之外，
+// 还要求紧跟着的下一条记录同样可以解析，或者该记录正好结束在buf的末尾
+// 只检查记录的结构以及crc, 不需要解密、解压
+func FindNextLogRecord(buf []byte) int64 {
+	for offset := int64(0); offset < int64(len(buf)); offset++ {
+		size, ok := decodeValidLogRecord(buf[offset:])
+		if !ok {
+			continue
+		}
+		next := offset + size
+		if next == int64(len(buf)) {
+			return offset
+		}
+		if _, ok := decodeValidLogRecord(buf[next:]); ok {
+			return offset
+		}
+	}
+	return -1
+}
+
+// decodeValidLogRecord 判断buf开头是否是一条有效的记录，返回记录的长度
+// 先检查类型、标志位以及长度，避免对损坏数据中解析出的长度计算crc
+func decodeValidLogRecord(buf []byte) (int64, bool) {
+	if len(buf) < minLogRecordHeaderSize {
+		return 0, false
+	}
+	typ := buf[crc32.Size]
+	if typ&^(logRecordTypeMask|logRecordExpireFlag|logRecordCompressFlag|logRecordEncryptFlag) != 0 {
+		return 0, false
+	}
+	if recordType := LogRecordType(typ & logRecordTypeMask); recordType < LogRecordNormal || recordType > LogRecordMerge {
+		return 0, false
+	}
+
+	header, headSize := DecodeRecordHeader(buf)
+	if header == nil || headSize+int64(header.keySize)+int64(header.valueSize) > int64(len(buf)) {
+		return 0, false
+	}
+	_, _, size, err := decodeLogRecordBuf(buf)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// EncodeRecordKeyWithSeq 把事务序号编码进key中，非事务的记录序号为0
+func EncodeRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
+	seq := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(seq[:], seqNo)
+
+	encKey := make([]byte, n+len(key))
+	copy(encKey[:n], seq[:n])
+	copy(encKey[n:], key)
+	return encKey
+}
+
+// DecodeRecordKeyWithSeq 解析出key和事务序号，无法解析序号时返回原来的数据以及序号0
+func DecodeRecordKeyWithSeq(buf []byte) ([]byte, uint64) {
+	seqNo, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return buf, 0
+	}
+	return buf[n:], seqNo
+}
+
 // TransactionRecord 用于暂存事务记录
 type TransactionRecord struct {
 	Record *LogRecord
@@ -1,7 +1,9 @@
 package data
 
 import (
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"testing"
 )
 
@@ -73,3 +75,101 @@ func TestDecodeLogRecord(t *testing.T) {
 	dataBuf := make([]byte, 3)
 	DecodeLogRecord(dataBuf)
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	record := &LogRecord{
+		Key:    []byte("bitcask"),
+		Value:  []byte("kvEngine"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+
+	headBuf, size := EncodeRecordHeader(record)
+	// 设置了过期标志位，并且header中追加了过期时间
+	assert.Equal(t, byte(LogRecordNormal)|logRecordExpireFlag, headBuf[4])
+	assert.True(t, size > 7)
+
+	buf, _ := EncodeLogRecord(record)
+	header, headerSize := DecodeRecordHeader(buf)
+	assert.Equal(t, size, headerSize)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+	assert.Equal(t, record.Expire, header.expire)
+}
+
+func TestEncodeLogRecordPos(t *testing.T) {
+	pos := &LogRecordPos{Fid: 3, Offset: 1024, Size: 100, Expire: 1700000000000000000}
+	res := DecodeLogRecordPos(EncodeLogRecordPos(pos))
+	assert.Equal(t, pos, res)
+
+	// 兼容不带过期时间的旧编码
+	buf := make([]byte, LogRecordPosSize)
+	n := binary.PutVarint(buf, 3)
+	n += binary.PutVarint(buf[n:], 1024)
+	n += binary.PutVarint(buf[n:], 100)
+	res = DecodeLogRecordPos(buf[:n])
+	assert.Equal(t, &LogRecordPos{Fid: 3, Offset: 1024, Size: 100}, res)
+
+	assert.False(t, res.IsExpired(1))
+	assert.True(t, pos.IsExpired(pos.Expire))
+}
+
+func TestDecodeLogRecordBuf(t *testing.T) {
+	record := &LogRecord{
+		Key:    []byte("bitcask"),
+		Value:  []byte("kvEngine"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	buf, size := EncodeLogRecord(record)
+
+	res, n, err := DecodeLogRecordBuf(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, size, n)
+	assert.Equal(t, record, res)
+
+	// 数据不完整
+	_, _, err = DecodeLogRecordBuf(buf[:size-1])
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// 数据损坏
+	buf[size-1] ^= 0xff
+	_, _, err = DecodeLogRecordBuf(buf)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
+
+func TestFindNextLogRecord(t *testing.T) {
+	encode := func(key string) []byte {
+		buf, _ := EncodeLogRecord(&LogRecord{Key: []byte(key), Value: []byte("value-" + key), Type: LogRecordNormal})
+		return buf
+	}
+	record1, record2 := encode("key-1"), encode("key-2")
+	garbage := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02}
+
+	// 跳过损坏的数据，找到之后连续的有效记录
+	var buf []byte
+	buf = append(buf, garbage...)
+	buf = append(buf, record1...)
+	buf = append(buf, record2...)
+	assert.Equal(t, int64(len(garbage)), FindNextLogRecord(buf))
+
+	// 结束在末尾的最后一条记录
+	assert.Equal(t, int64(len(garbage)), FindNextLogRecord(append(append([]byte{}, garbage...), record1...)))
+
+	// 之后紧跟着损坏数据的孤立记录不作为有效记录
+	buf = append(append(append([]byte{}, garbage...), record1...), garbage...)
+	assert.Equal(t, int64(-1), FindNextLogRecord(buf))
+
+	// 只写入了一部分的记录
+	assert.Equal(t, int64(-1), FindNextLogRecord(record1[:len(record1)-1]))
+	assert.Equal(t, int64(-1), FindNextLogRecord(nil))
+}
+
+func TestEncodeRecordKeyWithSeq(t *testing.T) {
+	key, seqNo := DecodeRecordKeyWithSeq(EncodeRecordKeyWithSeq([]byte("bitcask"), 1000))
+	assert.Equal(t, []byte("bitcask"), key)
+	assert.Equal(t, uint64(1000), seqNo)
+
+	key, seqNo = DecodeRecordKeyWithSeq(EncodeRecordKeyWithSeq([]byte("bitcask"), 0))
+	assert.Equal(t, []byte("bitcask"), key)
+	assert.Equal(t, uint64(0), seqNo)
+}
@@ -0,0 +1,70 @@
+package data
+
+import "encoding/binary"
+
+// MergeValue 合并记录的value部分
+type MergeValue struct {
+	// 当前记录在链表中的深度，上一条记录是完整的值时为1
+	Depth uint64
+
+	// 上一条记录的位置，为nil表示key之前不存在
+	Prev *LogRecordPos
+
+	Operator string
+	Operand  []byte
+}
+
+// EncodeMergeValue 对合并记录的value编码
+// +-------------+---------------+----------+---------------+------------+-----------+
+// |    depth    |   prevSize    |   prev   |  operatorSize |  operator  |  operand  |
+// +-------------+---------------+----------+---------------+------------+-----------+
+//
+//	uvarint        uvarint                    uvarint
+func EncodeMergeValue(mv *MergeValue) []byte {
+	var prevBuf []byte
+	if mv.Prev != nil {
+		prevBuf = EncodeLogRecordPos(mv.Prev)
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64*3+len(prevBuf)+len(mv.Operator)+len(mv.Operand))
+	var index = 0
+	index += binary.PutUvarint(buf[index:], mv.Depth)
+	index += binary.PutUvarint(buf[index:], uint64(len(prevBuf)))
+	index += copy(buf[index:], prevBuf)
+	index += binary.PutUvarint(buf[index:], uint64(len(mv.Operator)))
+	index += copy(buf[index:], mv.Operator)
+	index += copy(buf[index:], mv.Operand)
+	return buf[:index]
+}
+
+// DecodeMergeValue 解析合并记录的value
+func DecodeMergeValue(buf []byte) (*MergeValue, error) {
+	mv := &MergeValue{}
+
+	depth, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrInvalidMergeValue
+	}
+	mv.Depth = depth
+	buf = buf[n:]
+
+	prevSize, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < prevSize {
+		return nil, ErrInvalidMergeValue
+	}
+	buf = buf[n:]
+	if prevSize > 0 {
+		mv.Prev = DecodeLogRecordPos(buf[:prevSize])
+	}
+	buf = buf[prevSize:]
+
+	opSize, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < opSize {
+		return nil, ErrInvalidMergeValue
+	}
+	buf = buf[n:]
+	mv.Operator = string(buf[:opSize])
+	mv.Operand = buf[opSize:]
+
+	return mv, nil
+}
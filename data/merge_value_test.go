@@ -0,0 +1,30 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodeMergeValue(t *testing.T) {
+	mv := &MergeValue{
+		Depth:    3,
+		Prev:     &LogRecordPos{Fid: 2, Offset: 1024, Size: 64, Expire: 1700000000000000000},
+		Operator: "counter",
+		Operand:  []byte("10"),
+	}
+	res, err := DecodeMergeValue(EncodeMergeValue(mv))
+	assert.Nil(t, err)
+	assert.Equal(t, mv, res)
+
+	// key之前不存在
+	mv = &MergeValue{Depth: 1, Operator: "append", Operand: []byte("value")}
+	res, err = DecodeMergeValue(EncodeMergeValue(mv))
+	assert.Nil(t, err)
+	assert.Equal(t, mv, res)
+
+	buf := EncodeMergeValue(mv)
+	_, err = DecodeMergeValue(buf[:2])
+	assert.Equal(t, ErrInvalidMergeValue, err)
+	_, err = DecodeMergeValue(nil)
+	assert.Equal(t, ErrInvalidMergeValue, err)
+}
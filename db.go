@@ -1,6 +1,7 @@
 package bitcaskKV
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gofrs/flock"
@@ -8,13 +9,13 @@ import (
 	"go-bitcask-kv/fio"
 	"go-bitcask-kv/index"
 	"go-bitcask-kv/utils"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // DB bitcask storage engine instance
@@ -44,6 +45,9 @@ type DB struct {
 	// when ture, the DB is successfully started
 	isInitial bool
 
+	// when true, the DB has been closed
+	isClosed bool
+
 	// file lock ensure one DB instance processing
 	fileLock *flock.Flock
 
@@ -52,6 +56,56 @@ type DB struct {
 
 	// invalid data size, need to be merged
 	recycleSize uint32
+
+	// invalid data size of each data file, keyed by file id
+	deadBytes map[uint32]int64
+
+	// number of merge records of each data file, keyed by file id
+	mergeRecordNum map[uint32]int
+
+	// snapshots that have not been released
+	snapshots map[*Snapshot]struct{}
+
+	// registered merge operators, keyed by name
+	mergeOperators map[string]MergeOperator
+
+	// files below this id are being (or have been) rewritten by Merge,
+	// merge records must not reference records in them
+	mergeBoundary uint32
+
+	// cancels the running merge and is closed when it returns,
+	// both are nil when no merge is running
+	mergeCancel context.CancelFunc
+	mergeDone   chan struct{}
+
+	// rate limiters of merge and backup I/O
+	mergeLimiter  *utils.RateLimiter
+	backupLimiter *utils.RateLimiter
+
+	// background merge loop, nil when auto merge is disabled
+	mergeScheduler *mergeScheduler
+
+	// statistics of the last finished merge
+	mergeStat mergeStat
+
+	// corrupted tails of data files found by Open
+	tailRecoveries []TailRecovery
+
+	// keys to seal and open records, nil when encryption is disabled
+	keyRing *data.KeyRing
+
+	// compressors to decompress records, only used by this DB
+	compressors *data.Compressors
+
+	// background index snapshot loop, nil when periodic snapshot is disabled
+	snapshotScheduler *indexSnapshotScheduler
+
+	// records of transactions that have not been finished yet, only kept in read only mode,
+	// the writer process may be committing them
+	pendingTxnRecords map[uint64][]*data.TransactionRecord
+
+	// background refresh loop of read only mode, nil when periodic refresh is disabled
+	refreshScheduler *refreshScheduler
 }
 
 type Stat struct {
@@ -66,6 +120,18 @@ type Stat struct {
 
 	// 占用磁盘空间大小
 	DiskSize uint64
+
+	// 最近一次merge完成的时间，没有执行过merge时为零值
+	LastMergeTime time.Time
+
+	// 最近一次merge的耗时
+	LastMergeDuration time.Duration
+
+	// 最近一次merge回收的空间大小，merge之后的文件在下次启动时才会替换旧文件
+	LastMergeReclaimed int64
+
+	// 已经完成的merge等待下次启动时替换旧文件，在此之前不能再次merge, RecycleSize仍然包含旧文件中的无效数据
+	MergePending bool
 }
 
 // Open creates and opens a DB instance with specified option
@@ -75,39 +141,80 @@ func Open(option Option) (*DB, error) {
 		return nil, err
 	}
 
+	keyRing, err := newKeyRing(option)
+	if err != nil {
+		return nil, err
+	}
+
 	// check directory if exists.
 	// if not exists, create it.
 	if _, err := os.Stat(option.DirPath); os.IsNotExist(err) {
+		// 只读模式不会创建目录
+		if option.ReadOnly {
+			return nil, err
+		}
 		if err := os.MkdirAll(option.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
+	// B+树索引文件默认和数据文件存放在同一个目录中
+	if option.IndexType == index.BPlusTreeIndex && option.indexPath == "" {
+		option.indexPath = option.DirPath
+	}
+
 	// try to get file lock
-	fileLock := flock.New(filepath.Join(option.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
+	// 只读实例获取共享锁，可以和写入进程以及其他只读实例同时打开
+	var fileLock *flock.Flock
+	var hold bool
+	if option.ReadOnly {
+		fileLock = flock.New(filepath.Join(option.DirPath, readerLockName))
+		hold, err = fileLock.TryRLock()
+	} else {
+		fileLock = flock.New(filepath.Join(option.DirPath, fileLockName))
+		hold, err = fileLock.TryLock()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// 如果获取不到说明已经有其他的DB实例占用了该目录
+	// 如果获取不到说明已经有其他的DB实例占用了该目录，只读实例获取不到时写入进程正在替换merge之后的文件
 	if !hold {
 		return nil, ErrDatabaseIsUsing
 	}
 
 	// Initialize DB
 	db := &DB{
-		option:      option,
-		mu:          new(sync.RWMutex),
-		olderFiles:  make(map[uint32]*data.SegDataFile),
-		index:       index.NewIndexer(option.IndexType, option.indexPath),
-		fileLock:    fileLock,
-		recycleSize: 0,
-	}
+		option:         option,
+		mu:             new(sync.RWMutex),
+		olderFiles:     make(map[uint32]*data.SegDataFile),
+		snapshots:      make(map[*Snapshot]struct{}),
+		index:          index.NewIndexer(option.IndexType, option.indexPath),
+		fileLock:       fileLock,
+		recycleSize:    0,
+		deadBytes:      make(map[uint32]int64),
+		mergeRecordNum: make(map[uint32]int),
+		mergeOperators: newMergeOperators(option.MergeOperators),
+		mergeLimiter:   utils.NewRateLimiter(option.MergeRateLimit),
+		backupLimiter:  utils.NewRateLimiter(option.BackupRateLimit),
+		keyRing:        keyRing,
+		compressors:    data.NewCompressors(option.Compressor),
+	}
+
+	// 打开失败时关闭已经打开的文件并释放文件锁，修复之后可以再次打开
+	opened := false
+	defer func() {
+		if !opened {
+			_ = db.Close()
+		}
+	}()
 
 	// load MergeFiles
-	if err := db.loadMergeFiles(); err != nil {
-		return nil, err
+	// 只读模式不会替换数据文件，merge之后的文件由写入进程在启动时加载
+	if !option.ReadOnly {
+		if err := db.loadMergeFiles(); err != nil {
+			return nil, err
+		}
 	}
 
 	// load DataFiles and open the data file pointer
@@ -120,27 +227,55 @@ func Open(option Option) (*DB, error) {
 	// the B+Tree index is persistent, maintain the persistent index by itself
 	// If choose B+Tree persistent index, need to get the seqNo(transaction serial number)
 	if db.option.IndexType != index.BPlusTreeIndex {
-		// Firstly, load index from hintFile
-		if err := db.loadIndexFromHintFile(); err != nil {
+		// load index from hintFile and DateFiles, merged files are loaded from hintFile
+		if err := db.loadIndexFromDataFiles(); err != nil {
 			return nil, err
 		}
-
-		// Secondly, load index from DateFiles(never be merged)
-		if err := db.loadIndexFromDataFiles(); err != nil {
+	} else {
+		// the B+Tree index does not load DataFiles, but the write offset of active file is needed
+		if err := db.recoverBPlusTreeTail(); err != nil {
+			return nil, err
+		}
+		// the dead bytes of each file are counted from the live records in the index
+		if err := db.loadBPlusTreeFileStats(); err != nil {
 			return nil, err
 		}
 	}
 
+	// the active file keeps its corrupted tail when TailRecoverySkip, new writes go to a new file
+	if err := db.sealTornActiveFile(); err != nil {
+		return nil, err
+	}
+
 	// 如果使用MMap加载数据文件
 	// 读取完之后重置为标准IO, MMap仅仅用于数据加载
 	if db.option.MMapAtStartup {
-		if err := db.resetIOType(fio.StandardIO); err != nil {
+		if err := db.resetIOType(db.fileIOType()); err != nil {
 			return nil, err
 		}
 	}
 
 	db.isInitial = true
 
+	// 开启后台自动merge
+	if option.AutoMergeInterval > 0 {
+		db.mergeScheduler = newMergeScheduler(db)
+		db.mergeScheduler.start()
+	}
+
+	// 开启后台定期写入索引快照
+	if db.indexSnapshotEnabled() && option.IndexSnapshotInterval > 0 {
+		db.snapshotScheduler = newIndexSnapshotScheduler(db)
+		db.snapshotScheduler.start()
+	}
+
+	// 只读模式下开启后台定期刷新
+	if option.ReadOnly && option.RefreshInterval > 0 {
+		db.refreshScheduler = newRefreshScheduler(db)
+		db.refreshScheduler.start()
+	}
+
+	opened = true
 	return db, nil
 }
 
@@ -159,35 +294,57 @@ func (db *DB) Stat() *Stat {
 	}
 
 	return &Stat{
-		DataFilNum:  uint32(dataFileNum),
-		KeyNum:      uint32(db.index.Size()),
-		RecycleSize: db.recycleSize,
-		DiskSize:    uint64(totalSize),
+		DataFilNum:         uint32(dataFileNum),
+		KeyNum:             uint32(db.index.Size()),
+		RecycleSize:        db.recycleSize,
+		DiskSize:           uint64(totalSize),
+		LastMergeTime:      db.mergeStat.lastTime,
+		LastMergeDuration:  db.mergeStat.lastDuration,
+		LastMergeReclaimed: db.mergeStat.lastReclaimed,
+		MergePending:       mergeFinishedExists(db.getMergePath()),
 	}
 }
 
-// Backup 数据备份到指定目录
-func (db *DB) Backup(dir string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	return utils.CopyDir(db.option.DirPath, dir, []string{fileLockName})
+// SetCompactionRateLimit 调整merge以及备份每秒最多读写的字节数，0表示不限速
+// 对正在执行的merge和备份同样生效
+func (db *DB) SetCompactionRateLimit(mergeBytesPerSec, backupBytesPerSec int64) {
+	db.mergeLimiter.SetRate(mergeBytesPerSec)
+	db.backupLimiter.SetRate(backupBytesPerSec)
 }
 
 // Put 写入key-value，key不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.put(key, value, 0)
+}
+
+// put 写入key-value, expire为过期时间, 0表示永不过期
+func (db *DB) put(key []byte, value []byte, expire int64) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if db.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// 写日志和更新索引需要在同一把锁中，保证recycleSize的统计正确
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.putRecord(key, value, expire)
+}
 
+// putRecord 追加写入一条记录并更新内存索引
+// 访问该方法前必须持有db互斥锁
+func (db *DB) putRecord(key []byte, value []byte, expire int64) error {
 	// 单条日志记录
 	logRecord := &data.LogRecord{
-		Key:   encodeRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
+		Key:    data.EncodeRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:  value,
+		Type:   data.LogRecordNormal,
+		Expire: expire,
 	}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
@@ -195,7 +352,7 @@ func (db *DB) Put(key []byte, value []byte) error {
 	// 更新内存索引
 	// 如果已经原来已经有该key了，说明之前的数据就无效了，递增无效值
 	if oldValue, _ := db.index.Put(key, pos); oldValue != nil {
-		db.recycleSize += oldValue.Size
+		db.markGarbage(oldValue)
 	}
 
 	return nil
@@ -212,47 +369,53 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 		return nil, ErrKeyNotFound
 	}
 
-	// 根据索引信息找到对应记录
+	// 已经过期的key惰性删除
+	if recordPos.IsExpired(time.Now().UnixNano()) {
+		db.removeExpiredKey(key, recordPos)
+		return nil, ErrKeyNotFound
+	}
+
+	// 根据索引信息找到对应记录，读取文件时加读锁，避免和切换active文件以及刷新并发执行
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.getValueByPosition(recordPos)
 }
 
-func (db *DB) getValueByPosition(recordPos *data.LogRecordPos) ([]byte, error) {
-	// 根据文件id找到文件，先尝试从active文件中找，再在旧文件中找
-	var dataFile *data.SegDataFile
-	if db.activeFile.FileId == recordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[recordPos.Fid]
-	}
-
-	if dataFile == nil {
-		return nil, ErrDataFileNotFound
+// getValidPosition 获取key对应的位置信息，不存在或者已经过期时返回nil
+func (db *DB) getValidPosition(key []byte) *data.LogRecordPos {
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		return nil
 	}
+	return pos
+}
 
-	// 根据偏移量读取数据
-	logRecord, _, err := dataFile.ReadLogRecord(recordPos.Offset)
-	if err != nil {
-		return nil, err
-	}
+func (db *DB) getValueByPosition(recordPos *data.LogRecordPos) ([]byte, error) {
+	value, _, err := db.readValue(db.getDataFile, recordPos)
+	return value, err
+}
 
-	// 需要再判断类型
-	if logRecord.Type == data.LogRecordDeleted {
-		return nil, ErrKeyNotFound
+// getDataFile 根据文件id找到文件，先尝试从active文件中找，再在旧文件中找
+func (db *DB) getDataFile(fid uint32) *data.SegDataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
 	}
-
-	return logRecord.Value, nil
+	return db.olderFiles[fid]
 }
 
-// ListKeys 获取存储引擎中
+// ListKeys 获取存储引擎中所有未过期的key
 func (db *DB) ListKeys() [][]byte {
-	keys := make([][]byte, db.index.Size())
+	keys := make([][]byte, 0, db.index.Size())
 	it := db.index.Iterator(false)
+	defer it.Close()
 
 	// 通过迭代器获取keys
-	idx := 0
+	now := time.Now().UnixNano()
 	for it.Rewind(); it.Valid(); it.Next() {
-		keys[idx] = it.Key()
-		idx++
+		if it.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, it.Key())
 	}
 
 	return keys
@@ -266,7 +429,15 @@ func (db *DB) Fold(hd handleFunc) error {
 	defer db.mu.RUnlock()
 
 	it := db.index.Iterator(false)
+	defer it.Close()
+
+	now := time.Now().UnixNano()
 	for it.Rewind(); it.Valid(); it.Next() {
+		// 跳过已经过期的key
+		if it.Value().IsExpired(now) {
+			continue
+		}
+
 		val, err := db.getValueByPosition(it.Value())
 		if err != nil {
 			return err
@@ -284,7 +455,19 @@ func (db *DB) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if db.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.deleteRecord(key)
+}
 
+// deleteRecord 追加写入一条删除记录并更新内存索引
+// 访问该方法前必须持有db互斥锁
+func (db *DB) deleteRecord(key []byte) error {
 	// 先查找key是否存在
 	if recordPos := db.index.Get(key); recordPos == nil {
 		// 不存在的话应该返回nil ，毕竟也是正确删除，并非发生错误
@@ -293,18 +476,18 @@ func (db *DB) Delete(key []byte) error {
 
 	// 构造墓碑追加写入到日志文件中
 	logRecord := &data.LogRecord{
-		Key:   encodeRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Key:   data.EncodeRecordKeyWithSeq(key, nonTransactionSeqNo),
 		Value: nil,
 		Type:  data.LogRecordDeleted,
 	}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
 
 	// 该条删除记录也是可以回收的
-	db.recycleSize += pos.Size
+	db.markGarbage(pos)
 
 	// 写入成功后从内存索引中删除
 	oldValue, ok := db.index.Delete(key)
@@ -314,12 +497,51 @@ func (db *DB) Delete(key []byte) error {
 
 	// 将之前的记录删除，叠加回收值
 	if oldValue != nil {
-		db.recycleSize += oldValue.Size
+		db.markGarbage(oldValue)
 	}
 	return nil
 }
 
 func (db *DB) Close() error {
+	db.mu.Lock()
+	// 重复关闭直接返回
+	if db.isClosed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.isClosed = true
+	cancelMerge, mergeDone := db.mergeCancel, db.mergeDone
+	db.mu.Unlock()
+
+	// 中止正在执行的merge并等待其退出，merge过程中需要获取db锁，因此不能持有锁等待
+	// 之后db已经标记为关闭，不会再开始新的merge
+	if cancelMerge != nil {
+		cancelMerge()
+		<-mergeDone
+	}
+
+	// 停止后台merge
+	if db.mergeScheduler != nil {
+		db.mergeScheduler.stop()
+	}
+
+	// 停止后台刷新
+	if db.refreshScheduler != nil {
+		db.refreshScheduler.stop()
+	}
+
+	// 停止后台写入索引快照，之后写入最终的快照，快照写入失败不影响关闭文件
+	if db.snapshotScheduler != nil {
+		db.snapshotScheduler.stop()
+	}
+	var snapshotErr error
+	if db.isInitial && db.indexSnapshotEnabled() {
+		snapshotErr = db.saveIndexSnapshot()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	// 在最后释放文件锁
 	defer func() {
 		if err := db.fileLock.Unlock(); err != nil {
@@ -327,19 +549,24 @@ func (db *DB) Close() error {
 		}
 	}()
 
-	if db.activeFile == nil {
-		// 说明都没启动
-		return nil
+	// 数据文件即将关闭，释放所有未释放的快照
+	for snap := range db.snapshots {
+		snap.mu.Lock()
+		snap.released = true
+		snap.mu.Unlock()
 	}
-
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	db.snapshots = nil
 
 	// 索引close 目前只针对B+树
 	if err := db.index.Close(); err != nil {
 		return err
 	}
 
+	if db.activeFile == nil {
+		// 说明都没启动
+		return nil
+	}
+
 	// 关闭活跃文件
 	if err := db.activeFile.Close(); err != nil {
 		return err
@@ -352,7 +579,7 @@ func (db *DB) Close() error {
 		}
 	}
 
-	return nil
+	return snapshotErr
 }
 
 // Sync 刷盘 持久化数据文件
@@ -381,17 +608,103 @@ func checkOptions(option Option) error {
 		return errors.New("merge threshold option is invalid")
 	}
 
+	if option.MergeRateLimit < 0 || option.BackupRateLimit < 0 {
+		return errors.New("rate limit option is invalid")
+	}
+
+	if option.MergeFileGarbageRatio < 0 || option.MergeFileGarbageRatio > 1 {
+		return errors.New("merge file garbage ratio option is invalid")
+	}
+
+	if option.CompressMinSize < 0 || (option.Compressor != nil && option.Compressor.Type() == 0) {
+		return errors.New("compress option is invalid")
+	}
+
+	if !validEncryptionKey(option.EncryptionKey, true) || (option.EncryptionKey == nil && len(option.OldEncryptionKeys) > 0) {
+		return errors.New("encryption option is invalid")
+	}
+	for _, key := range option.OldEncryptionKeys {
+		if !validEncryptionKey(key, false) {
+			return errors.New("encryption option is invalid")
+		}
+	}
+
+	if option.IndexLoadParallelism < 0 {
+		return errors.New("index load parallelism option is invalid")
+	}
+
+	if option.ReadOnly && (option.IndexType == index.BPlusTreeIndex || option.AutoMergeInterval > 0) {
+		return errors.New("read only option is invalid")
+	}
+
+	if option.RefreshInterval < 0 || (option.RefreshInterval > 0 && !option.ReadOnly) {
+		return errors.New("refresh interval option is invalid")
+	}
+
+	if option.IndexSnapshotInterval < 0 {
+		return errors.New("index snapshot interval option is invalid")
+	}
+
+	if option.TailRecovery < TailRecoveryTruncate || option.TailRecovery > TailRecoverySkip {
+		return errors.New("tail recovery option is invalid")
+	}
+
+	if option.AutoMergeInterval < 0 || option.AutoMergeWindowStart < 0 || option.AutoMergeWindowStart >= 24*time.Hour ||
+		option.AutoMergeWindowEnd < 0 || option.AutoMergeWindowEnd >= 24*time.Hour {
+		return errors.New("auto merge option is invalid")
+	}
+
 	return nil
 }
 
 // 从磁盘中加载数据文件对应指针
 func (db *DB) loadDataFiles() error {
 	// 读取目录中的所有文件
-	dirEntries, err := os.ReadDir(db.option.DirPath)
+	fileIds, err := listDataFileIds(db.option.DirPath)
 	if err != nil {
 		return err
 	}
+	db.fileIds = fileIds
+
+	ioType := db.fileIOType()
+	if db.option.MMapAtStartup {
+		ioType = fio.MemoryIO
+	}
+
+	// 遍历文件id，打开所有的数据文件
+	for i, fid := range db.fileIds {
+		datafile, err := db.openDataFile(uint32(fid), ioType)
+		if err == data.ErrFileHeaderIncomplete {
+			// 只读模式下遇到写入进程刚刚创建的文件，该文件以及之后的文件在刷新时再加载
+			db.fileIds = db.fileIds[:i]
+			break
+		}
+		if err != nil {
+			return err
+		}
+		datafile.Keys = db.keyRing
+		datafile.Compressors = db.compressors
+		db.olderFiles[uint32(fid)] = datafile
+	}
+
+	// 最后一个文件为活跃文件，其他文件是older文件
+	if len(db.fileIds) > 0 {
+		lastFid := uint32(db.fileIds[len(db.fileIds)-1])
+		db.activeFile = db.olderFiles[lastFid]
+		delete(db.olderFiles, lastFid)
+	}
+
+	return nil
+}
+
+// listDataFileIds 读取目录中所有数据文件的id，从小到大排序
+func listDataFileIds(dirPath string) ([]int, error) {
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
 
+	var fileIds []int
 	for _, entry := range dirEntries {
 		if strings.HasPrefix(entry.Name(), data.SegDataFileNamePrefix) && strings.HasSuffix(entry.Name(), data.SegDataFileNameSuffix) {
 			// 文件名 bitcask_001.data
@@ -399,38 +712,24 @@ func (db *DB) loadDataFiles() error {
 			spNo := strings.Split(spName[0], "_")
 			fileId, err := strconv.Atoi(spNo[1])
 			if err != nil {
-				return ErrDataDirNameIncorrect
+				return nil, ErrDataDirNameIncorrect
 			}
 
-			db.fileIds = append(db.fileIds, fileId)
+			fileIds = append(fileIds, fileId)
 		}
 	}
 
 	// 对文件id排序，依次加载
-	sort.Ints(db.fileIds)
-
-	ioType := fio.StandardIO
-	if db.option.MMapAtStartup {
-		ioType = fio.MemoryIO
-	}
-
-	// 遍历文件id，打开所有的数据文件
-	for i, fid := range db.fileIds {
-		datafile, err := data.OpenDataFile(db.option.DirPath, uint32(fid), ioType)
-		if err != nil {
-			return nil
-		}
+	sort.Ints(fileIds)
+	return fileIds, nil
+}
 
-		// 当遍历到最后一个文件，指定该文件为活跃文件
-		if i == len(db.fileIds)-1 {
-			db.activeFile = datafile
-		} else {
-			// 其他文件是older文件
-			db.olderFiles[uint32(fid)] = datafile
-		}
+// openDataFile 打开已经存在的数据文件，只读模式下不会创建文件或者写入文件头
+func (db *DB) openDataFile(fid uint32, ioType fio.IOType) (*data.SegDataFile, error) {
+	if db.option.ReadOnly {
+		return data.OpenDataFileReadOnly(db.option.DirPath, fid, ioType)
 	}
-
-	return nil
+	return data.OpenDataFile(db.option.DirPath, fid, ioType)
 }
 
 // 更新内存索引
@@ -442,48 +741,47 @@ func (db *DB) loadIndexFromDataFiles() error {
 		return nil
 	}
 
-	// 判断是否发生过merge
-	hasMerge, nonMergeFileId := false, uint32(0)
-	mergeFinishedFileName := filepath.Join(db.option.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFinishedFileName); err == nil {
-		// 如果存在则置为true
-		fid, err := db.getNonMergeFileId(db.option.DirPath)
-		if err != nil {
+	now := time.Now().UnixNano()
+
+	// 有可用的索引快照时只需要加载快照之后写入的数据
+	snapMeta, err := db.loadIndexSnapshot(now)
+	if err != nil {
+		return err
+	}
+
+	// merge之后的文件从hint文件中加载索引，不需要再遍历文件
+	// merge之后的文件都在快照的范围内，加载了快照时不需要hint文件
+	var hint *hintReader
+	if snapMeta == nil {
+		if hint, err = openHintReader(db.option.DirPath, db.keyRing); err != nil {
 			return err
 		}
-		hasMerge = true
-		nonMergeFileId = fid
+	}
+	if hint != nil {
+		defer func() {
+			_ = hint.close()
+		}()
 	}
 
-	// 更新内存索引辅助函数
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldValue *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldValue, _ = db.index.Delete(key)
-			// 删除数据这条记录本身也可以回收
-			db.recycleSize += pos.Size
-		} else if typ == data.LogRecordNormal {
-			oldValue, _ = db.index.Put(key, pos)
-		}
+	// 按照文件id的顺序更新内存索引
+	var seqNo uint64 = nonTransactionSeqNo
+	if snapMeta != nil {
+		seqNo = snapMeta.seqNo
+	}
+	loader := newIndexLoader(db, now, nil, seqNo)
 
-		// 更新可以回收的空间大小
-		if oldValue != nil {
-			db.recycleSize += oldValue.Size
+	// 找出需要扫描的文件，hint文件中有索引的文件是merge之后的文件，不需要扫描
+	var hintFileIds map[uint32]bool
+	if hint != nil {
+		if hintFileIds, err = readHintFileIds(db.option.DirPath, db.keyRing); err != nil {
+			return err
 		}
 	}
-
-	// 暂存事务数据
-	transactionRecord := make(map[uint64][]*data.TransactionRecord)
-
-	// 记录最大的序列号
-	var currentSeqNo uint64 = nonTransactionSeqNo
-
-	// 遍历所有的文件id，处理文件中的记录
+	var jobs []fileScanJob
 	for _, fid := range db.fileIds {
 		var fileId = uint32(fid)
-
-		// 如果加载过hint文件，则跳过已经merge过的文件
-		if hasMerge && fileId < nonMergeFileId {
+		// 快照之前的数据已经加载
+		if (snapMeta != nil && fileId < snapMeta.fid) || hintFileIds[fileId] {
 			continue
 		}
 
@@ -494,80 +792,82 @@ func (db *DB) loadIndexFromDataFiles() error {
 			dataFile = db.olderFiles[fileId]
 		}
 
-		var offset int64 = 0
-		for {
-			// 读取dataFile中的内容
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
+		// 跳过文件头，快照所在的文件从快照记录的位置开始加载
+		var offset = dataFile.DataOffset()
+		if snapMeta != nil && fileId == snapMeta.fid {
+			offset = snapMeta.writeOff
+		}
+		jobs = append(jobs, fileScanJob{file: dataFile, offset: offset})
+	}
+
+	// 并发扫描数据文件，按照文件id从小到大的顺序处理扫描结果
+	scanner := startFileScanner(jobs, db.option.IndexLoadParallelism)
+	defer scanner.stop()
+
+	// 遍历所有的文件id，处理文件中的记录
+	var next = 0
+	for _, fid := range db.fileIds {
+		var fileId = uint32(fid)
+		if snapMeta != nil && fileId < snapMeta.fid {
+			continue
+		}
+
+		// hint文件中有该文件的索引，说明是merge之后的文件
+		if hintFileIds[fileId] {
+			_, err := hint.load(fileId, func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+				// 在merge之后才过期的key, 不再加入索引，计入可回收空间
+				// 删除标记覆盖之前没有参与merge的文件中的旧值
+				loader.update(key, typ, pos)
+			})
 			if err != nil {
-				// 判断是否是读完了
-				if err == io.EOF {
-					break
-				}
 				return err
 			}
+			continue
+		}
 
-			// 构造内存索引
-			logRecordPos := &data.LogRecordPos{
-				Fid:    fileId,
-				Offset: offset,
-				Size:   uint32(size),
-			}
-
-			// 解析key，判断是否是事务
-			realKey, seqNo := decodeRecordKeyWithSeq(logRecord.Key)
-			if seqNo == nonTransactionSeqNo {
-				// 非事务操作，直接更新
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 针对事务，先将其缓存起来，直到读取到事务结束标志
-				if logRecord.Type == data.LogRecordTxnFinished {
-					// 更新对应的索引
-					for _, rec := range transactionRecord[seqNo] {
-						updateIndex(rec.Record.Key, rec.Record.Type, rec.Pos)
-					}
-
-					// 删除缓存
-					delete(transactionRecord, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecord[seqNo] = append(transactionRecord[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
-			}
+		dataFile := jobs[next].file
+		scan := scanner.result(next)
+		next++
+		if scan.err != nil {
+			return scan.err
+		}
 
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
+		loader.apply(fileId, scan.records)
 
-			// offset加上记录长度
-			offset += size
+		// 文件末尾有不完整或者损坏的记录，之前缓存的未提交的事务数据直接丢弃
+		if err := db.recoverTail(dataFile, scan.validEnd); err != nil {
+			return err
 		}
 
 		// 如果是活跃文件，要记录最后一个记录的最后位置
 		// 因为追加写入的偏移需要记录
 		if fileId == db.activeFile.FileId {
-			db.activeFile.WriteOff = offset
+			db.activeFile.WriteOff = scan.validEnd
 		}
 	}
 
 	// 更新事务序列号
-	db.seqNo = currentSeqNo
+	db.seqNo = loader.seqNo
+
+	// 只读模式下写入进程可能正在提交事务，没有完成标识的事务数据保留到之后刷新时再处理
+	if db.option.ReadOnly {
+		db.pendingTxnRecords = loader.txnRecords
+	}
 
 	return nil
 }
 
-// 正常put delete需要加锁
-func (db *DB) appendLogRecordWithLock(record *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	return db.appendLogRecord(record)
+// encodeLogRecord 按照配置的压缩算法以及密钥对记录编码
+func (db *DB) encodeLogRecord(record *data.LogRecord) ([]byte, int64, error) {
+	return data.EncodeLogRecordWithKeys(record, db.option.Compressor, db.option.CompressMinSize, db.keyRing)
 }
 
-// 追加写入日志文件中，方便writeBatch时不加锁
+// 追加写入日志文件中，调用方需要持有db互斥锁
 func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error) {
+	if db.option.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
 	// 确保活跃文件存在
 	if db.activeFile == nil {
 		if err := db.setNewActiveDataFile(); err != nil {
@@ -576,7 +876,10 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	}
 
 	// 将数据进行编码
-	encRecord, size := data.EncodeLogRecord(record)
+	encRecord, size, err := db.encodeLogRecord(record)
+	if err != nil {
+		return nil, err
+	}
 
 	// 如果超过了文件阈值，active文件转为older文件，新建一个active文件
 	if db.activeFile.WriteOff+size > db.option.DataFileSize {
@@ -627,6 +930,7 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 		Fid:    db.activeFile.FileId,
 		Offset: writeOff,
 		Size:   uint32(size),
+		Expire: record.Expire,
 	}
 
 	return pos, nil
@@ -646,6 +950,8 @@ func (db *DB) setNewActiveDataFile() error {
 	if err != nil {
 		return err
 	}
+	dataFile.Keys = db.keyRing
+	dataFile.Compressors = db.compressors
 
 	db.activeFile = dataFile
 	return nil
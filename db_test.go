@@ -1,7 +1,11 @@
 package bitcaskKV
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
 	"go-bitcask-kv/utils"
 	"os"
 	"path/filepath"
@@ -386,6 +390,218 @@ func TestDB_LoadDataFilesByMMap(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestOpen_LegacyDataFiles(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-legacy")
+	opts.DirPath = dir
+
+	// 之前版本写入的没有文件头的数据文件
+	for fid := uint32(0); fid < 2; fid++ {
+		var buf []byte
+		for i := 0; i < 10; i++ {
+			encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+				Key:   data.EncodeRecordKeyWithSeq(utils.GetTestKey(int(fid)*10+i), nonTransactionSeqNo),
+				Value: []byte("legacy"),
+				Type:  data.LogRecordNormal,
+			})
+			buf = append(buf, encRecord...)
+		}
+		assert.Nil(t, os.WriteFile(data.GetDataFileName(dir, fid), buf, 0644))
+	}
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Nil(t, db.activeFile.Header)
+	assert.Equal(t, 20, db.index.Size())
+
+	// 旧文件继续写入，merge之后的文件带有文件头
+	assert.Nil(t, db.Put(utils.GetTestKey(20), []byte("new")))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	opts.mergeMinSizeThr = 0
+	db.option.mergeMinSizeThr = 0
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, 11, db2.index.Size())
+	for fid, file := range db2.olderFiles {
+		assert.NotNil(t, file.Header, fid)
+	}
+	for i := 10; i < 20; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("legacy"), val)
+	}
+	val, err := db2.Get(utils.GetTestKey(20))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+}
+
+func TestOpen_InvalidFileHeader(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-invalid-header")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("value")))
+	assert.Nil(t, db.Close())
+
+	// 其他数据文件被重命名为该文件
+	assert.Nil(t, os.Rename(data.GetDataFileName(dir, 0), data.GetDataFileName(dir, 5)))
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidFileHeader, err)
+
+	// 打开失败之后文件锁已经释放，恢复文件名之后可以正常打开
+	assert.Nil(t, os.Rename(data.GetDataFileName(dir, 5), data.GetDataFileName(dir, 0)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-compression")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.Compressor = &data.FlateCompressor{Level: 6}
+	opts.CompressMinSize = 64
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 500; i++ {
+		values[i] = []byte(fmt.Sprintf(`{"id":%d,"name":"bitcask-kv","tags":["storage","log-structured","kv"]}`, i))
+		if i%2 == 0 {
+			values[i] = append(values[i], values[i]...)
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	// 小于CompressMinSize的value不压缩
+	assert.Nil(t, db.Put([]byte("small"), []byte("v")))
+	values[-1] = []byte("v")
+
+	var rawSize int
+	for _, value := range values {
+		rawSize += len(value)
+	}
+	stat := db.Stat()
+	assert.True(t, stat.DiskSize < uint64(rawSize))
+
+	keys := [][]byte{utils.GetTestKey(1), utils.GetTestKey(2), []byte("small")}
+	res, errs := db.MultiGet(keys)
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, [][]byte{values[1], values[2], values[-1]}, res)
+
+	// merge之后仍然是压缩的
+	for i := 0; i < 250; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// 关闭压缩之后之前的记录仍然可以读取
+	opts.Compressor = nil
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.True(t, db2.Stat().DiskSize < stat.DiskSize)
+	assert.Equal(t, len(values), db2.index.Size())
+
+	iter := db2.NewIterator(DefaultIteratorOption)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		if string(iter.Key()) == "small" {
+			assert.Equal(t, values[-1], val)
+			continue
+		}
+		var i int
+		_, _ = fmt.Sscanf(string(iter.Key()), "bitcask-key-%09d", &i)
+		assert.Equal(t, values[i], val)
+	}
+}
+
+// xorCompressor 使用flate压缩之后把每个字节和mask异或，用于测试自定义算法
+type xorCompressor struct {
+	mask byte
+}
+
+func (c *xorCompressor) Type() uint8 {
+	return 100
+}
+
+func (c *xorCompressor) xor(src []byte) []byte {
+	dst := make([]byte, len(src))
+	for i := range src {
+		dst[i] = src[i] ^ c.mask
+	}
+	return dst
+}
+
+func (c *xorCompressor) Compress(src []byte) ([]byte, error) {
+	compressed, err := (&data.FlateCompressor{Level: 6}).Compress(src)
+	if err != nil {
+		return nil, err
+	}
+	return c.xor(compressed), nil
+}
+
+func (c *xorCompressor) Decompress(src []byte) ([]byte, error) {
+	return (&data.FlateCompressor{Level: 6}).Decompress(c.xor(src))
+}
+
+func TestDB_Compression_CustomPerDB(t *testing.T) {
+	// 两个DB使用编号相同但是实现不同的自定义算法，各自只使用自己配置的算法读取
+	var dbs []*DB
+	defer func() {
+		for _, db := range dbs {
+			destroyDB(db)
+		}
+	}()
+	for _, mask := range []byte{0x0f, 0xf0} {
+		opts := DefaultOption
+		dir, _ := os.MkdirTemp("", "bitcask-compression-custom")
+		opts.DirPath = dir
+		opts.Compressor = &xorCompressor{mask: mask}
+		opts.CompressMinSize = 1
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		dbs = append(dbs, db)
+	}
+
+	for i, db := range dbs {
+		assert.Nil(t, db.Put(utils.GetTestKey(1), bytes.Repeat([]byte(fmt.Sprintf("value-%d", i)), 16)))
+	}
+	for i, db := range dbs {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte(fmt.Sprintf("value-%d", i)), 16), val)
+	}
+
+	// 没有配置自定义算法时无法加载使用该算法压缩的记录
+	opts := dbs[0].option
+	assert.Nil(t, dbs[0].Close())
+	dbs = dbs[1:]
+	defer func() {
+		_ = os.RemoveAll(opts.DirPath)
+	}()
+	opts.Compressor = nil
+	_, err := Open(opts)
+	assert.Equal(t, data.ErrUnknownCompressor, err)
+}
+
 func TestDB_Stat(t *testing.T) {
 	opts := DefaultOption
 	dir, _ := os.MkdirTemp("", "bitcask-stat")
@@ -451,3 +667,90 @@ func TestDB_Backup(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db2)
 }
+
+func TestDB_SetCompactionRateLimit(t *testing.T) {
+	db, _ := openMergeTestDB(t, "bitcask-go-rate-limit")
+	defer destroyDB(db)
+
+	// 桶中初始有一秒的令牌，之后按照限速补充
+	db.SetCompactionRateLimit(256*1024, 128*1024)
+
+	start := time.Now()
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-rate-limit-backup")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+
+	var totalBytes int64
+	start = time.Now()
+	err := db.MergeWithContext(context.Background(), func(p MergeProgress) {
+		totalBytes = p.TotalBytes
+	})
+	assert.Nil(t, err)
+	assert.True(t, totalBytes > 256*1024)
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+
+	// 取消限速
+	db.SetCompactionRateLimit(0, 0)
+	assert.Equal(t, int64(0), db.mergeLimiter.Rate())
+	assert.Equal(t, int64(0), db.backupLimiter.Rate())
+}
+
+// 等待限速时取消merge、备份以及关闭DB都不会被阻塞
+func TestDB_SetCompactionRateLimit_Cancel(t *testing.T) {
+	db, opts := openMergeTestDB(t, "bitcask-go-rate-limit-cancel")
+	defer func() {
+		_ = os.RemoveAll(opts.DirPath)
+	}()
+
+	// 按照这个速度merge和备份都需要几分钟
+	db.SetCompactionRateLimit(1024, 1024)
+
+	waitErr := func(errCh chan error) error {
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("rate limited operation is not interrupted")
+			return nil
+		}
+	}
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-rate-limit-cancel-backup")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- db.BackupWithContext(ctx, backupDir)
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, waitErr(errCh))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		errCh <- db.MergeWithContext(ctx, nil)
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, waitErr(errCh))
+
+	started := make(chan struct{})
+	go func() {
+		errCh <- db.MergeWithContext(context.Background(), func(p MergeProgress) {
+			if p.FilesProcessed == 0 && p.BytesProcessed == 0 {
+				close(started)
+			}
+		})
+	}()
+	<-started
+
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	assert.Nil(t, waitErr(closed))
+	assert.Equal(t, context.Canceled, waitErr(errCh))
+}
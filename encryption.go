@@ -0,0 +1,82 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+)
+
+// 配置了EncryptionKey之后写入数据文件、hint文件以及merge完成文件的记录都使用AES-GCM加密，
+// 每条记录带有加密使用的密钥编号，读取时根据编号选择密钥，
+// 轮换密钥时配置新的EncryptionKey和EncryptionKeyId, 旧的密钥放到OldEncryptionKeys中，
+// 之后的merge会挑选出还在使用旧密钥的文件，使用新的密钥重新写入
+
+// validEncryptionKey 判断是否为合法的AES密钥长度
+func validEncryptionKey(key []byte, allowEmpty bool) bool {
+	switch len(key) {
+	case 0:
+		return allowEmpty && key == nil
+	case 16, 24, 32:
+		return true
+	default:
+		return false
+	}
+}
+
+// newKeyRing 根据配置创建KeyRing, 没有配置密钥时返回nil
+func newKeyRing(option Option) (*data.KeyRing, error) {
+	if option.EncryptionKey == nil {
+		return nil, nil
+	}
+
+	keys := make(map[uint32][]byte, len(option.OldEncryptionKeys)+1)
+	for id, key := range option.OldEncryptionKeys {
+		keys[id] = key
+	}
+	keys[option.EncryptionKeyId] = option.EncryptionKey
+	return data.NewKeyRing(option.EncryptionKeyId, keys)
+}
+
+// isStaleKeyFile 判断文件中是否有没有使用当前密钥加密的记录，这样的文件需要参与merge重新加密
+// 密钥只会在打开数据库时变更，文件中的记录按照写入的先后顺序排列，因此只需要检查第一条记录
+// 访问该方法前必须持有db互斥锁
+func (db *DB) isStaleKeyFile(file *data.SegDataFile) (bool, error) {
+	if db.keyRing == nil {
+		return false, nil
+	}
+
+	size, err := file.IoManager.Size()
+	if err != nil {
+		return false, err
+	}
+	if size <= file.DataOffset() {
+		return false, nil
+	}
+
+	keyId, encrypted, err := file.RecordKeyId(file.DataOffset())
+	if err != nil {
+		return false, err
+	}
+	return !encrypted || keyId != db.keyRing.CurrentId(), nil
+}
+
+// hasStaleKeyFiles 判断是否有文件需要merge重新加密
+// 访问该方法前必须持有db互斥锁
+func (db *DB) hasStaleKeyFiles() (bool, error) {
+	if db.keyRing == nil {
+		return false, nil
+	}
+
+	files := make([]*data.SegDataFile, 0, len(db.olderFiles)+1)
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+	for _, file := range files {
+		stale, err := db.isStaleKeyFile(file)
+		if err != nil || stale {
+			return stale, err
+		}
+	}
+	return false, nil
+}
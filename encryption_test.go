@@ -0,0 +1,175 @@
+package bitcaskKV
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testEncryptionKey1 = bytes.Repeat([]byte{0x11}, 32)
+	testEncryptionKey2 = bytes.Repeat([]byte{0x22}, 16)
+)
+
+// containsInDir 判断目录下是否有文件包含sub
+func containsInDir(t *testing.T, dir string, sub []byte) bool {
+	found := false
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		found = found || bytes.Contains(buf, sub)
+		return nil
+	})
+	assert.Nil(t, err)
+	return found
+}
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-encryption")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.EncryptionKey = testEncryptionKey1
+	opts.EncryptionKeyId = 1
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("plain-secret-value")))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBachOption)
+	assert.Nil(t, wb.Put([]byte("txn-secret-key"), []byte("plain-secret-value")))
+	assert.Nil(t, wb.Commit())
+
+	res, errs := db.MultiGet([][]byte{utils.GetTestKey(600), []byte("txn-secret-key")})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, [][]byte{[]byte("plain-secret-value"), []byte("plain-secret-value")}, res)
+
+	// hint文件以及merge完成文件中同样没有明文
+	assert.Nil(t, db.Merge())
+	_, err = os.Stat(filepath.Join(db.getMergePath(), data.HintFileName))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	for _, d := range []string{dir, dir + data.MergeDirSuffix} {
+		assert.False(t, containsInDir(t, d, []byte("plain-secret-value")))
+		assert.False(t, containsInDir(t, d, []byte("bitcask-key")))
+		assert.False(t, containsInDir(t, d, []byte(data.MergeFinishedKey)))
+	}
+
+	// 没有密钥或者密钥错误时无法打开
+	opts.EncryptionKey = nil
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrEncryptionKeyNotFound, err)
+	opts.EncryptionKey = testEncryptionKey2
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrDecryptFailed, err)
+
+	opts.EncryptionKey = testEncryptionKey1
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, 501, db2.index.Size())
+	val, err := db2.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plain-secret-value"), val)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db2.Get([]byte("txn-secret-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plain-secret-value"), val)
+}
+
+func TestDB_EncryptionKeyRotation(t *testing.T) {
+	for _, ratio := range []float32{0, 0.9} {
+		opts := DefaultOption
+		dir, _ := os.MkdirTemp("", "bitcask-encryption-rotation")
+		opts.DirPath = dir
+		opts.DataFileSize = 32 * 1024
+		opts.MergeFileGarbageRatio = ratio
+
+		// 没有加密的旧数据
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+		}
+		assert.Nil(t, db.Close())
+
+		opts.EncryptionKey = testEncryptionKey1
+		opts.EncryptionKeyId = 1
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		for i := 500; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+		}
+		assert.Nil(t, db.Close())
+
+		// 轮换密钥，旧的密钥只用于读取
+		opts.EncryptionKey = testEncryptionKey2
+		opts.EncryptionKeyId = 2
+		opts.OldEncryptionKeys = map[uint32][]byte{1: testEncryptionKey1}
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		values := make(map[int][]byte)
+		for i := 0; i < 1000; i += 100 {
+			values[i], err = db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(1000), []byte("new")))
+		values[1000] = []byte("new")
+
+		// 没有达到merge阈值，但是有需要重新加密的文件
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+
+		// merge之后不再需要旧的密钥
+		opts.OldEncryptionKeys = nil
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 1001, db.index.Size())
+		for i, value := range values {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		assert.Equal(t, ErrMergeCondUnreached, db.Merge())
+		destroyDB(db)
+	}
+}
+
+func TestOpen_InvalidEncryptionOption(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-encryption-option")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = dir
+
+	opts.EncryptionKey = []byte("short")
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+
+	opts.EncryptionKey = testEncryptionKey1
+	opts.OldEncryptionKeys = map[uint32][]byte{1: []byte("short")}
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	// 只有旧的密钥
+	opts.EncryptionKey = nil
+	opts.OldEncryptionKeys = map[uint32][]byte{1: testEncryptionKey1}
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
@@ -3,13 +3,31 @@ package bitcaskKV
 import "errors"
 
 var (
-	ErrKeyIsEmpty           = errors.New("the key is empty")
-	ErrIndexUpdateFailed    = errors.New("failed to update index")
-	ErrKeyNotFound          = errors.New("key not found in database")
-	ErrDataFileNotFound     = errors.New("datafile is not found")
-	ErrDataDirNameIncorrect = errors.New("data directory name is incorrect")
-	ErrExceedMaxBatchNum    = errors.New("exceed max batch num")
-	ErrMergeIsRunning       = errors.New("merge is running")
-	ErrDatabaseIsUsing      = errors.New("the database directory is using by another process")
-	ErrMergeCondUnreached   = errors.New("the database merge condition is unreached")
+	ErrKeyIsEmpty             = errors.New("the key is empty")
+	ErrIndexUpdateFailed      = errors.New("failed to update index")
+	ErrKeyNotFound            = errors.New("key not found in database")
+	ErrDataFileNotFound       = errors.New("datafile is not found")
+	ErrDataDirNameIncorrect   = errors.New("data directory name is incorrect")
+	ErrExceedMaxBatchNum      = errors.New("exceed max batch num")
+	ErrMergeIsRunning         = errors.New("merge is running")
+	ErrDatabaseIsUsing        = errors.New("the database directory is using by another process")
+	ErrMergeCondUnreached     = errors.New("the database merge condition is unreached")
+	ErrInvalidTTL             = errors.New("the ttl must be greater than 0")
+	ErrSnapshotReleased       = errors.New("the snapshot has been released")
+	ErrTxnConflict            = errors.New("transaction conflict, the keys read by the transaction have been modified")
+	ErrTxnFinished            = errors.New("the transaction has been committed or rolled back")
+	ErrMergeOperatorNotFound  = errors.New("the merge operator is not registered")
+	ErrInvalidMergeOperand    = errors.New("invalid merge operand or value")
+	ErrIteratorKeysOnly       = errors.New("the iterator only iterates keys")
+	ErrMergeFinishedCorrupted = errors.New("the merge finished file is corrupted")
+	ErrMergeNotApplied        = errors.New("the previous merge has not been applied, reopen the database to apply it")
+	ErrDatabaseIsClosed       = errors.New("the database is closed")
+	ErrBackupManifestNotFound = errors.New("the backup manifest is not found")
+	ErrBackupCorrupted        = errors.New("the backup is corrupted, file size or checksum mismatch")
+	ErrRestoreTargetNotEmpty  = errors.New("the restore target directory is not empty")
+	ErrCheckpointDirNotEmpty  = errors.New("the checkpoint directory is not empty")
+	ErrDataFileTailCorrupted  = errors.New("the tail of the data file is corrupted")
+	ErrDataFileCorrupted      = errors.New("the data file is corrupted before its end, use bitcask-fsck to repair it")
+	ErrIndexSnapshotCorrupted = errors.New("the index snapshot is corrupted or does not match the data files")
+	ErrReadOnly               = errors.New("the database is opened in read only mode")
 )
@@ -17,6 +17,16 @@ func NewFileIOManager(fileName string) (*FileIO, error) {
 	return &FileIO{file}, nil
 }
 
+// NewReadOnlyFileIOManager 以只读方式打开已经存在的文件，写入时返回错误
+func NewReadOnlyFileIOManager(fileName string) (*FileIO, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileIO{file}, nil
+}
+
 // Read 从文件的指定位置中读取数据
 func (fio *FileIO) Read(b []byte, offset int64) (int, error) {
 	return fio.fd.ReadAt(b, offset)
@@ -91,3 +91,36 @@ func TestFileIO_Close(t *testing.T) {
 	err = fio.Close()
 	assert.Nil(t, err)
 }
+
+func TestNewReadOnlyFileIOManager(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "tes-readonly.data")
+
+	// 只读方式不会创建文件
+	_, err := NewReadOnlyFileIOManager(path)
+	assert.True(t, os.IsNotExist(err))
+
+	fio, err := NewFileIOManager(path)
+	defer destroyFile(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	readOnly, err := NewIOManager(path, ReadOnlyIO)
+	assert.Nil(t, err)
+	defer readOnly.Close()
+
+	// 可以读取其他句柄追加写入的数据
+	_, err = fio.Write([]byte(" world"))
+	assert.Nil(t, err)
+	size, err := readOnly.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), size)
+	b := make([]byte, 11)
+	_, err = readOnly.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), b)
+
+	_, err = readOnly.Write([]byte("!"))
+	assert.NotNil(t, err)
+	assert.Nil(t, fio.Close())
+}
@@ -7,6 +7,9 @@ type IOType = int8
 const (
 	StandardIO IOType = iota + 1
 	MemoryIO
+
+	// ReadOnlyIO 只读方式打开的标准IO，不会创建文件，用于只读模式打开的数据库
+	ReadOnlyIO
 )
 
 // IOManager 抽象IO管理接口，方便接入不同的IO，目前项目实现使用标准IO
@@ -34,6 +37,8 @@ func NewIOManager(fileName string, typ IOType) (IOManager, error) {
 		return NewFileIOManager(fileName)
 	case MemoryIO:
 		return NewMMapIoManager(fileName)
+	case ReadOnlyIO:
+		return NewReadOnlyFileIOManager(fileName)
 	default:
 		panic("unsupported IO type")
 	}
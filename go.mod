@@ -5,7 +5,6 @@ go 1.17
 require (
 	github.com/gofrs/flock v0.8.1
 	github.com/google/btree v1.1.2
-	github.com/plar/go-adaptive-radix-tree v1.0.5
 	github.com/stretchr/testify v1.8.4
 	github.com/tidwall/redcon v1.6.2
 	go.etcd.io/bbolt v1.3.7
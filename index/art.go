@@ -2,21 +2,18 @@ package index
 
 import (
 	"bytes"
-	goart "github.com/plar/go-adaptive-radix-tree"
 	"go-bitcask-kv/data"
-	"sort"
 	"sync"
 )
 
 type AdaptiveRadixTree struct {
-	// 这里不用取地址 因为Tree是一个接口
-	tree goart.Tree
+	tree *artTree
 	lock *sync.RWMutex
 }
 
 func NewART() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: goart.New(),
+		tree: newARTTree(),
 		lock: new(sync.RWMutex),
 	}
 }
@@ -24,41 +21,52 @@ func NewART() *AdaptiveRadixTree {
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
 	defer art.lock.Unlock()
-	oldValue, updated := art.tree.Insert(key, pos)
+	oldValue := art.tree.put(key, pos)
 	if oldValue == nil {
 		return nil, false
 	}
-	return oldValue.(*data.LogRecordPos), updated
+	return oldValue, true
 }
 
 func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	value, found := art.tree.Search(key)
-	if !found {
-		return nil
-	}
-	return value.(*data.LogRecordPos)
+	return art.tree.search(key)
 }
 
 func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
 	defer art.lock.Unlock()
-	oldValue, deleted := art.tree.Delete(key)
+	oldValue := art.tree.remove(key)
 	if oldValue == nil {
 		return nil, false
 	}
-	return oldValue.(*data.LogRecordPos), deleted
+	return oldValue, true
 }
 
+// Iterator 在树的克隆上迭代，克隆的代价很小，并且之后的写入不会影响迭代器
 func (art *AdaptiveRadixTree) Iterator(reverse bool) IndexerIterator {
-	return NewARTIterator(art.tree, reverse)
+	// 克隆会修改原树的写时复制标记，需要加写锁
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	return NewARTIterator(art.tree.clone(), reverse)
 }
 
 func (art *AdaptiveRadixTree) Size() int {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	return art.Size()
+	return art.tree.size
+}
+
+// Clone 利用写时复制，克隆的代价很小
+func (art *AdaptiveRadixTree) Clone() Indexer {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+
+	return &AdaptiveRadixTree{
+		tree: art.tree.clone(),
+		lock: new(sync.RWMutex),
+	}
 }
 
 func (art *AdaptiveRadixTree) Close() error {
@@ -66,83 +74,167 @@ func (art *AdaptiveRadixTree) Close() error {
 }
 
 // ARTIterator ART索引迭代器
+// 使用栈记录从根节点到当前叶子节点的路径，按需遍历，不需要拷贝所有的数据
 type ARTIterator struct {
-	// 当前下标
-	curIndex int
+	tree *artTree
 
 	// 是否反向遍历
 	reverse bool
 
-	// 存放Item指针数组
-	values []*BTreeItem
+	// 栈顶为当前的叶子节点，为空表示迭代结束
+	stack []artFrame
 }
 
-// NewARTIterator 返回ART索引
-func NewARTIterator(tree goart.Tree, reverse bool) *ARTIterator {
-	var idx int
-	if reverse {
-		idx = tree.Size() - 1
-	}
-
-	values := make([]*BTreeItem, tree.Size())
-
-	saveFunc := func(node goart.Node) bool {
-		item := &BTreeItem{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-
-		values[idx] = item
-		if reverse {
-			idx--
-		} else {
-			idx++
-		}
-		return true
-	}
-
-	// 通过回调函数存储所有的kv
-	tree.ForEach(saveFunc)
+// artFrame 路径上的一个节点以及当前所在的槽位
+type artFrame struct {
+	node *artNode
+	slot int
+}
 
-	return &ARTIterator{
-		curIndex: 0,
-		reverse:  reverse,
-		values:   values,
+// NewARTIterator 返回ART索引迭代器，tree在迭代期间不能被修改
+func NewARTIterator(tree *artTree, reverse bool) *ARTIterator {
+	it := &ARTIterator{
+		tree:    tree,
+		reverse: reverse,
 	}
+	it.Rewind()
+	return it
 }
 
 func (art *ARTIterator) Rewind() {
-	art.curIndex = 0
+	art.stack = art.stack[:0]
+	if art.tree.root != nil {
+		art.descend(art.tree.root)
+	}
 }
 
+// Seek 正向时定位到第一个大于等于key的位置，反向时定位到第一个小于等于key的位置
+// 只需要从根节点向下查找一次，时间复杂度和key的长度相关
 func (art *ARTIterator) Seek(key []byte) {
-	if art.reverse {
-		art.curIndex = sort.Search(len(art.values), func(i int) bool {
-			return bytes.Compare(art.values[i].key, key) <= 0
-		})
-	} else {
-		art.curIndex = sort.Search(len(art.values), func(i int) bool {
-			return bytes.Compare(art.values[i].key, key) >= 0
-		})
+	art.stack = art.stack[:0]
+
+	n, depth := art.tree.root, 0
+	for n != nil {
+		if n.kind == artLeaf {
+			art.push(n, 0)
+			cmp := bytes.Compare(n.key, key)
+			if (!art.reverse && cmp < 0) || (art.reverse && cmp > 0) {
+				art.advance()
+			}
+			return
+		}
+
+		// 比较压缩路径和key的对应部分，key更短时整棵子树都大于key
+		seg := key[depth:]
+		cmp := bytes.Compare(n.prefix, seg[:minInt(len(n.prefix), len(seg))])
+		if cmp == 0 && len(seg) < len(n.prefix) {
+			cmp = 1
+		}
+		if cmp != 0 {
+			if (cmp > 0) != art.reverse {
+				// 整棵子树都在key之后
+				art.descend(n)
+			} else {
+				// 整棵子树都在key之前，跳过
+				art.advance()
+			}
+			return
+		}
+		depth += len(n.prefix)
+
+		// term等于key, 子节点都大于key
+		if depth == len(key) {
+			if !art.reverse {
+				art.descend(n)
+			} else if n.term != nil {
+				art.push(n, 0)
+				art.push(n.term, 0)
+			} else {
+				art.advance()
+			}
+			return
+		}
+
+		slot, found := n.childSlot(key[depth])
+		if found {
+			art.push(n, slot)
+			n = n.slot(slot)
+			depth++
+			continue
+		}
+
+		// 从应该插入的位置开始沿着迭代方向查找
+		if art.reverse {
+			art.push(n, slot)
+		} else {
+			art.push(n, slot-1)
+		}
+		art.advance()
+		return
 	}
 }
 
 func (art *ARTIterator) Next() {
-	art.curIndex++
+	art.advance()
 }
 
 func (art *ARTIterator) Valid() bool {
-	return art.curIndex < len(art.values)
+	return len(art.stack) > 0
 }
 
 func (art *ARTIterator) Key() []byte {
-	return art.values[art.curIndex].key
+	return art.stack[len(art.stack)-1].node.key
 }
 
 func (art *ARTIterator) Value() *data.LogRecordPos {
-	return art.values[art.curIndex].pos
+	return art.stack[len(art.stack)-1].node.pos
 }
 
 func (art *ARTIterator) Close() {
-	art.values = nil
+	art.stack = nil
+	art.tree = nil
+}
+
+func (art *ARTIterator) push(n *artNode, slot int) {
+	art.stack = append(art.stack, artFrame{node: n, slot: slot})
+}
+
+// descend 从n开始沿着迭代方向找到第一个叶子节点
+func (art *ARTIterator) descend(n *artNode) {
+	for n.kind != artLeaf {
+		start := -1
+		if art.reverse {
+			start = n.numSlots()
+		}
+		slot, child := n.nextSlot(start, art.reverse)
+		art.push(n, slot)
+		n = child
+	}
+	art.push(n, 0)
+}
+
+// advance 从栈顶节点的当前槽位移动到下一个叶子节点
+func (art *ARTIterator) advance() {
+	for len(art.stack) > 0 {
+		top := &art.stack[len(art.stack)-1]
+		if top.node.kind == artLeaf {
+			art.stack = art.stack[:len(art.stack)-1]
+			continue
+		}
+
+		slot, child := top.node.nextSlot(top.slot, art.reverse)
+		if child != nil {
+			top.slot = slot
+			art.descend(child)
+			return
+		}
+		art.stack = art.stack[:len(art.stack)-1]
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
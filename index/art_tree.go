@@ -0,0 +1,474 @@
+package index
+
+import (
+	"bytes"
+	"go-bitcask-kv/data"
+	"sort"
+)
+
+// 自适应基数树的实现
+// 内部节点根据子节点数量在node4、node16、node48、node256之间切换，前三种使用有序数组存储子节点，
+// node256直接使用下标访问。内部节点保存完整的压缩路径prefix, 叶子节点保存完整的key。
+//
+// 和google/btree一样使用写时复制支持O(1)的克隆：每个节点记录创建它的cow标记，
+// 树只会原地修改属于自己的节点，修改其他节点之前先复制一份。
+// 克隆之后两棵树都会使用新的cow标记，因此原来的节点都不会再被修改，克隆出来的树可以无锁地读取。
+
+type artNodeKind uint8
+
+const (
+	artLeaf artNodeKind = iota
+	artNode4
+	artNode16
+	artNode48
+	artNode256
+)
+
+// 有序数组类型节点的容量
+var artNodeCapacity = [...]int{artNode4: 4, artNode16: 16, artNode48: 48}
+
+// artCow 写时复制的标记，需要有大小，保证每次分配的地址不同
+type artCow struct {
+	_ byte
+}
+
+type artNode struct {
+	kind artNodeKind
+	cow  *artCow
+
+	// 叶子节点
+	key []byte
+	pos *data.LogRecordPos
+
+	// 内部节点压缩的公共路径
+	prefix []byte
+
+	// key恰好在当前节点结束的叶子节点
+	term *artNode
+
+	// node4/16/48时keys和children一一对应，并且按照keys有序
+	// node256时children长度为256, 使用字节下标访问
+	keys     []byte
+	children []*artNode
+
+	// node256的子节点数量
+	numChildren int
+}
+
+type artTree struct {
+	root *artNode
+	size int
+	cow  *artCow
+}
+
+func newARTTree() *artTree {
+	return &artTree{cow: new(artCow)}
+}
+
+// clone 克隆一棵树，之后两棵树都不会修改当前已有的节点
+func (t *artTree) clone() *artTree {
+	t.cow = new(artCow)
+	return &artTree{
+		root: t.root,
+		size: t.size,
+		cow:  new(artCow),
+	}
+}
+
+func (t *artTree) search(key []byte) *data.LogRecordPos {
+	n, depth := t.root, 0
+	for n != nil {
+		if n.kind == artLeaf {
+			if bytes.Equal(n.key, key) {
+				return n.pos
+			}
+			return nil
+		}
+
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+
+		if depth == len(key) {
+			n = n.term
+			continue
+		}
+		n = n.findChild(key[depth])
+		depth++
+	}
+	return nil
+}
+
+// put 插入或者更新key, 返回旧值
+func (t *artTree) put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	root, old := t.insert(t.root, key, 0, pos)
+	t.root = root
+	if old == nil {
+		t.size++
+	}
+	return old
+}
+
+// remove 删除key, 返回旧值
+func (t *artTree) remove(key []byte) *data.LogRecordPos {
+	root, old := t.delete(t.root, key, 0)
+	t.root = root
+	if old != nil {
+		t.size--
+	}
+	return old
+}
+
+func (t *artTree) insert(n *artNode, key []byte, depth int, pos *data.LogRecordPos) (*artNode, *data.LogRecordPos) {
+	if n == nil {
+		return t.newLeaf(key, pos), nil
+	}
+
+	if n.kind == artLeaf {
+		if bytes.Equal(n.key, key) {
+			leaf := t.mutable(n)
+			old := leaf.pos
+			leaf.pos = pos
+			return leaf, old
+		}
+
+		// 两个key在depth之前都是相同的，使用剩余部分的公共前缀创建新的内部节点
+		p := commonPrefixLen(n.key[depth:], key[depth:])
+		inner := t.newInner(key[depth : depth+p])
+		t.attach(inner, n, depth+p)
+		t.attach(inner, t.newLeaf(key, pos), depth+p)
+		return inner, nil
+	}
+
+	// 压缩路径不匹配，需要分裂
+	p := commonPrefixLen(n.prefix, key[depth:])
+	if p < len(n.prefix) {
+		parent := t.newInner(n.prefix[:p])
+		b, rest := n.prefix[p], cloneBytes(n.prefix[p+1:])
+		child := t.mutable(n)
+		child.prefix = rest
+		t.addChild(parent, b, child)
+		t.attach(parent, t.newLeaf(key, pos), depth+p)
+		return parent, nil
+	}
+	depth += len(n.prefix)
+
+	m := t.mutable(n)
+	if depth == len(key) {
+		term, old := t.insert(m.term, key, depth, pos)
+		m.term = term
+		return m, old
+	}
+
+	b := key[depth]
+	child := m.findChild(b)
+	newChild, old := t.insert(child, key, depth+1, pos)
+	if child == nil {
+		t.addChild(m, b, newChild)
+	} else {
+		m.setChild(b, newChild)
+	}
+	return m, old
+}
+
+func (t *artTree) delete(n *artNode, key []byte, depth int) (*artNode, *data.LogRecordPos) {
+	if n == nil {
+		return nil, nil
+	}
+
+	if n.kind == artLeaf {
+		if bytes.Equal(n.key, key) {
+			return nil, n.pos
+		}
+		return n, nil
+	}
+
+	if !bytes.HasPrefix(key[depth:], n.prefix) {
+		return n, nil
+	}
+	depth += len(n.prefix)
+
+	if depth == len(key) {
+		if n.term == nil {
+			return n, nil
+		}
+		m := t.mutable(n)
+		old := m.term.pos
+		m.term = nil
+		return t.shrink(m), old
+	}
+
+	b := key[depth]
+	child := n.findChild(b)
+	newChild, old := t.delete(child, key, depth+1)
+	if old == nil {
+		return n, nil
+	}
+
+	m := t.mutable(n)
+	if newChild == nil {
+		t.removeChild(m, b)
+	} else {
+		m.setChild(b, newChild)
+	}
+	return t.shrink(m), old
+}
+
+// attach 将叶子节点挂到内部节点上，depth为内部节点之后的深度
+func (t *artTree) attach(inner *artNode, leaf *artNode, depth int) {
+	if len(leaf.key) == depth {
+		inner.term = leaf
+		return
+	}
+	t.addChild(inner, leaf.key[depth], leaf)
+}
+
+// shrink 删除之后收缩节点
+func (t *artTree) shrink(n *artNode) *artNode {
+	count := n.childCount()
+
+	// 只剩下key恰好结束在当前节点的叶子
+	if count == 0 {
+		return n.term
+	}
+
+	// 只剩下一个子节点，和子节点合并压缩路径
+	if count == 1 && n.term == nil {
+		b, child := n.firstChild()
+		if child.kind == artLeaf {
+			return child
+		}
+		c := t.mutable(child)
+		c.prefix = concatBytes(n.prefix, []byte{b}, child.prefix)
+		return c
+	}
+
+	// 子节点数量较少时切换为更小的节点类型
+	if n.kind > artNode4 && count <= artNodeCapacity[n.kind-1]*3/4 {
+		t.resize(n, n.kind-1)
+	}
+	return n
+}
+
+func (t *artTree) newLeaf(key []byte, pos *data.LogRecordPos) *artNode {
+	return &artNode{kind: artLeaf, cow: t.cow, key: key, pos: pos}
+}
+
+func (t *artTree) newInner(prefix []byte) *artNode {
+	return &artNode{
+		kind:     artNode4,
+		cow:      t.cow,
+		prefix:   cloneBytes(prefix),
+		keys:     make([]byte, 0, artNodeCapacity[artNode4]),
+		children: make([]*artNode, 0, artNodeCapacity[artNode4]),
+	}
+}
+
+// mutable 返回可以原地修改的节点，不属于当前树的节点需要先复制
+func (t *artTree) mutable(n *artNode) *artNode {
+	if n.cow == t.cow {
+		return n
+	}
+
+	c := *n
+	c.cow = t.cow
+	if n.keys != nil {
+		c.keys = make([]byte, len(n.keys), cap(n.keys))
+		copy(c.keys, n.keys)
+	}
+	if n.children != nil {
+		c.children = make([]*artNode, len(n.children), cap(n.children))
+		copy(c.children, n.children)
+	}
+	return &c
+}
+
+// addChild 添加一个新的子节点，容量不够时切换为更大的节点类型
+func (t *artTree) addChild(n *artNode, b byte, child *artNode) {
+	if n.kind == artNode256 {
+		n.children[b] = child
+		n.numChildren++
+		return
+	}
+
+	if len(n.keys) == artNodeCapacity[n.kind] {
+		t.resize(n, n.kind+1)
+		if n.kind == artNode256 {
+			n.children[b] = child
+			n.numChildren++
+			return
+		}
+	}
+
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= b })
+	n.keys = append(n.keys, 0)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = b
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (t *artTree) removeChild(n *artNode, b byte) {
+	if n.kind == artNode256 {
+		n.children[b] = nil
+		n.numChildren--
+		return
+	}
+
+	i, found := n.searchKey(b)
+	if !found {
+		return
+	}
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
+
+// resize 切换节点类型，n必须属于当前树
+func (t *artTree) resize(n *artNode, kind artNodeKind) {
+	if kind == artNode256 {
+		children := make([]*artNode, 256)
+		for i, b := range n.keys {
+			children[b] = n.children[i]
+		}
+		n.numChildren = len(n.keys)
+		n.keys = nil
+		n.children = children
+		n.kind = kind
+		return
+	}
+
+	keys := make([]byte, 0, artNodeCapacity[kind])
+	children := make([]*artNode, 0, artNodeCapacity[kind])
+	if n.kind == artNode256 {
+		for b, child := range n.children {
+			if child != nil {
+				keys = append(keys, byte(b))
+				children = append(children, child)
+			}
+		}
+	} else {
+		keys = append(keys, n.keys...)
+		children = append(children, n.children...)
+	}
+	n.keys = keys
+	n.children = children
+	n.numChildren = 0
+	n.kind = kind
+}
+
+// searchKey 在有序数组中查找b, 返回下标以及是否找到，没有找到时下标为应该插入的位置
+func (n *artNode) searchKey(b byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= b })
+	return i, i < len(n.keys) && n.keys[i] == b
+}
+
+func (n *artNode) findChild(b byte) *artNode {
+	if n.kind == artNode256 {
+		return n.children[b]
+	}
+	if i, found := n.searchKey(b); found {
+		return n.children[i]
+	}
+	return nil
+}
+
+func (n *artNode) setChild(b byte, child *artNode) {
+	if n.kind == artNode256 {
+		n.children[b] = child
+		return
+	}
+	if i, found := n.searchKey(b); found {
+		n.children[i] = child
+	}
+}
+
+func (n *artNode) childCount() int {
+	if n.kind == artNode256 {
+		return n.numChildren
+	}
+	return len(n.keys)
+}
+
+func (n *artNode) firstChild() (byte, *artNode) {
+	if n.kind == artNode256 {
+		for b, child := range n.children {
+			if child != nil {
+				return byte(b), child
+			}
+		}
+		return 0, nil
+	}
+	return n.keys[0], n.children[0]
+}
+
+// 迭代时把内部节点的子节点看作一组槽位：
+// 槽位0为term, 之后依次为按照字节顺序排列的子节点，node256的槽位中间可能为空
+
+func (n *artNode) numSlots() int {
+	return len(n.children) + 1
+}
+
+func (n *artNode) slot(s int) *artNode {
+	if s == 0 {
+		return n.term
+	}
+	return n.children[s-1]
+}
+
+// childSlot 返回字节b对应的槽位以及是否存在，不存在时返回第一个大于b的子节点应该在的槽位
+func (n *artNode) childSlot(b byte) (int, bool) {
+	if n.kind == artNode256 {
+		return int(b) + 1, n.children[b] != nil
+	}
+	i, found := n.searchKey(b)
+	return i + 1, found
+}
+
+// nextSlot 沿着迭代方向查找下一个不为空的槽位
+func (n *artNode) nextSlot(s int, reverse bool) (int, *artNode) {
+	if reverse {
+		for s--; s >= 0; s-- {
+			if child := n.slot(s); child != nil {
+				return s, child
+			}
+		}
+		return -1, nil
+	}
+
+	for s++; s < n.numSlots(); s++ {
+		if child := n.slot(s); child != nil {
+			return s, child
+		}
+	}
+	return n.numSlots(), nil
+}
+
+func commonPrefixLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func cloneBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+	buf := make([]byte, 0, size)
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	return buf
+}
@@ -1,8 +1,10 @@
 package index
 
 import (
+	"bytes"
 	"go-bitcask-kv/data"
 	"go.etcd.io/bbolt"
+	"io"
 	"path/filepath"
 )
 
@@ -94,6 +96,76 @@ func (bp *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	return data.DecodeLogRecordPos(oldValue), true
 }
 
+// ReplaceMerged 在一个写事务中将merge之前的位置替换为merge之后的位置
+// next依次返回merge之后的key和位置，key为nil表示结束; isMerged判断文件是否参与了merge
+// 只有当前位置所在的文件参与了merge时才会替换，merge之后写入或者删除的key不受影响,
+// 位置在参与merge的文件中并且已经过期的key会被删除。重复执行的结果相同
+func (bp *BPlusTree) ReplaceMerged(isMerged func(fid uint32) bool, now int64,
+	next func() ([]byte, *data.LogRecordPos, error)) error {
+	return bp.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for {
+			key, pos, err := next()
+			if err != nil {
+				return err
+			}
+			if key == nil {
+				break
+			}
+
+			oldValue := bucket.Get(key)
+			if len(oldValue) == 0 || !isMerged(data.DecodeLogRecordPos(oldValue).Fid) {
+				continue
+			}
+			if err := bucket.Put(key, data.EncodeLogRecordPos(pos)); err != nil {
+				return err
+			}
+		}
+
+		// 游标遍历过程中删除会跳过元素，先记录下需要删除的key
+		var expiredKeys [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			pos := data.DecodeLogRecordPos(v)
+			if isMerged(pos.Fid) && pos.IsExpired(now) {
+				key := make([]byte, len(k))
+				copy(key, k)
+				expiredKeys = append(expiredKeys, key)
+			}
+		}
+		for _, key := range expiredKeys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BPlusTreeSnapshot B+树索引在某一时刻的只读视图，用于在线备份
+type BPlusTreeSnapshot struct {
+	tx *bbolt.Tx
+}
+
+// Snapshot 开启一个只读事务，使用完之后需要调用Release
+func (bp *BPlusTree) Snapshot() (*BPlusTreeSnapshot, error) {
+	tx, err := bp.tree.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &BPlusTreeSnapshot{tx: tx}, nil
+}
+
+// WriteTo 将快照写出为一个完整的索引文件
+func (s *BPlusTreeSnapshot) WriteTo(w io.Writer) (int64, error) {
+	return s.tx.WriteTo(w)
+}
+
+// Release 结束只读事务
+func (s *BPlusTreeSnapshot) Release() error {
+	return s.tx.Rollback()
+}
+
 func (bp *BPlusTree) Size() int {
 	// 返回bucket中key的数量
 	var size int
@@ -108,6 +180,24 @@ func (bp *BPlusTree) Size() int {
 	return size
 }
 
+// Clone 将B+树中的索引拷贝到内存Btree中
+// 长时间持有bbolt的读事务会阻塞写事务的重新映射，因此不直接使用读事务作为副本
+func (bp *BPlusTree) Clone() Indexer {
+	bt := NewBtreeIndexer()
+	if err := bp.tree.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+			// bbolt返回的key只在事务内有效，需要拷贝
+			key := make([]byte, len(k))
+			copy(key, k)
+			bt.Put(key, data.DecodeLogRecordPos(v))
+			return nil
+		})
+	}); err != nil {
+		panic("failed to clone BPlusTree")
+	}
+	return bt
+}
+
 func (bp *BPlusTree) Close() error {
 	return bp.tree.Close()
 }
@@ -156,6 +246,16 @@ func (bpi *BPlusTreeIterator) Rewind() {
 
 func (bpi *BPlusTreeIterator) Seek(key []byte) {
 	bpi.currKey, bpi.currValue = bpi.cursor.Seek(key)
+	if !bpi.reverse {
+		return
+	}
+
+	// 游标只能定位到第一个大于等于key的位置，反向时需要回退到第一个小于等于key的位置
+	if bpi.currKey == nil {
+		bpi.currKey, bpi.currValue = bpi.cursor.Last()
+	} else if bytes.Compare(bpi.currKey, key) > 0 {
+		bpi.currKey, bpi.currValue = bpi.cursor.Prev()
+	}
 }
 
 func (bpi *BPlusTreeIterator) Next() {
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"go-bitcask-kv/data"
-	"sort"
 	"sync"
 )
 
@@ -37,7 +36,9 @@ func (bt *Btree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, bo
 
 func (bt *Btree) Get(key []byte) *data.LogRecordPos {
 	it := &BTreeItem{key: key}
+	bt.lock.RLock()
 	btItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btItem == nil {
 		return nil
 	}
@@ -56,19 +57,34 @@ func (bt *Btree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	return oldItem.(*BTreeItem).pos, true
 }
 
+// Iterator 在树的克隆上迭代，克隆的代价很小，并且之后的写入不会影响迭代器
 func (bt *Btree) Iterator(reverse bool) IndexerIterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return NewBtreeIterator(bt.tree, reverse)
+	// Clone会修改原树的写时复制标记，需要加写锁
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return NewBtreeIterator(bt.tree.Clone(), reverse)
 }
 
 func (bt *Btree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
+// Clone 利用btree的写时复制，克隆的代价很小
+func (bt *Btree) Clone() Indexer {
+	// Clone会修改原树的写时复制标记，需要加写锁
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &Btree{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
+
 func (bt *Btree) Close() error {
 	return nil
 }
@@ -86,66 +102,49 @@ func (item *BTreeItem) Less(bi btree.Item) bool {
 }
 
 // BtreeIterator Btree索引迭代器
+// 在树的克隆上按批次读取数据，不需要一次性拷贝所有的数据
+// btree的克隆使用写时复制，之后对原树的写入不会影响迭代器
 type BtreeIterator struct {
-	// 当前下标
-	curIndex int
+	tree *btree.BTree
 
 	// 是否反向遍历
 	reverse bool
 
-	// 存放Item指针数组
-	values []*BTreeItem
+	// 当前批次的数据以及下标
+	values   []*BTreeItem
+	curIndex int
 }
 
-func NewBtreeIterator(tree *btree.BTree, reverse bool) *BtreeIterator {
-	var idx = 0
-	values := make([]*BTreeItem, tree.Len())
-
-	//这个回调函数参数需要是 Btree中的接口类型
-	saveValues := func(it btree.Item) bool {
-		// 判断是当前自定义的Item类型
-		values[idx] = it.(*BTreeItem)
-		idx++
+// 每个批次读取的数据量
+const btreeIteratorBatchSize = 128
 
-		// 返回false则会终止遍历
-		return true
-	}
-
-	if reverse {
-		// 反向进行
-		tree.Descend(saveValues)
-	} else {
-		// Ascend会针对BTree中的每个结点执行指定函数
-		tree.Ascend(saveValues)
-	}
-
-	// reverse决定数据反向或者正向存储，因此curIndex为0
-	return &BtreeIterator{
-		curIndex: 0,
-		reverse:  reverse,
-		values:   values,
+// NewBtreeIterator 返回Btree索引迭代器，tree在迭代期间不能被修改
+func NewBtreeIterator(tree *btree.BTree, reverse bool) *BtreeIterator {
+	bti := &BtreeIterator{
+		tree:    tree,
+		reverse: reverse,
+		values:  make([]*BTreeItem, 0, btreeIteratorBatchSize),
 	}
-
+	bti.Rewind()
+	return bti
 }
 
 func (bti *BtreeIterator) Rewind() {
-	bti.curIndex = 0
+	bti.fill(nil, true)
 }
 
+// Seek 正向时定位到第一个大于等于key的位置，反向时定位到第一个小于等于key的位置
 func (bti *BtreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.curIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
-	} else {
-		bti.curIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
-	}
+	bti.fill(&BTreeItem{key: key}, true)
 }
 
 func (bti *BtreeIterator) Next() {
 	bti.curIndex++
+
+	// 当前批次读取完之后从最后一个元素之后继续读取
+	if bti.curIndex == len(bti.values) && len(bti.values) == btreeIteratorBatchSize {
+		bti.fill(bti.values[len(bti.values)-1], false)
+	}
 }
 
 func (bti *BtreeIterator) Valid() bool {
@@ -161,6 +160,34 @@ func (bti *BtreeIterator) Value() *data.LogRecordPos {
 }
 
 func (bti *BtreeIterator) Close() {
-	// 清空数组
 	bti.values = nil
+	bti.tree = nil
+}
+
+// fill 从pivot开始沿着迭代方向读取一个批次，pivot为nil表示从头开始，inclusive表示是否包含pivot
+func (bti *BtreeIterator) fill(pivot *BTreeItem, inclusive bool) {
+	bti.values = bti.values[:0]
+	bti.curIndex = 0
+
+	saveValues := func(it btree.Item) bool {
+		item := it.(*BTreeItem)
+		if !inclusive && bytes.Equal(item.key, pivot.key) {
+			return true
+		}
+		bti.values = append(bti.values, item)
+
+		// 返回false则会终止遍历
+		return len(bti.values) < btreeIteratorBatchSize
+	}
+
+	switch {
+	case pivot == nil && bti.reverse:
+		bti.tree.Descend(saveValues)
+	case pivot == nil:
+		bti.tree.Ascend(saveValues)
+	case bti.reverse:
+		bti.tree.DescendLessOrEqual(pivot, saveValues)
+	default:
+		bti.tree.AscendGreaterOrEqual(pivot, saveValues)
+	}
 }
@@ -34,6 +34,9 @@ type Indexer interface {
 
 	Size() int
 
+	// Clone 返回当前索引的一个副本，之后对原索引的修改不会影响副本，用于快照读
+	Clone() Indexer
+
 	// Close 只是对于B+树才需要， 因为这里B+树借用了一个DB的实现
 	Close() error
 }
@@ -56,10 +59,7 @@ type IndexerIterator interface {
 	Rewind()
 
 	// Seek 根据传入的key, 需要第一个大于（小于）等于key的迭代器
-	// B树和ART实现Seek都需要将位置信息全量拷贝出来做法性能上不可取
-	// B树可以不通过迭代器，而是对外提供Ascend+回调函数的方式对外提供范围查询
-	// 如果不需要Seek，完全可以通过B树或者ART自带的迭代器来支持
-	// 要支持范围查询，似乎需要Seek，使用B+树或者是更好的选择？
+	// B树和ART的迭代器都在写时复制的克隆上按需遍历，不需要拷贝全部的位置信息
 	Seek(key []byte)
 
 	// Next 跳转到下一个key
@@ -1,10 +1,11 @@
 package index
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"go-bitcask-kv/data"
-	"os"
-	"path/filepath"
+	"math/rand"
+	"sort"
 	"testing"
 )
 
@@ -30,7 +31,7 @@ func TestIndex(t *testing.T) {
 
 	// 测试BPlusTree
 	indexType = BPlusTreeIndex
-	indexPath := initBPlusTree()
+	indexPath := t.TempDir()
 	index = NewIndexer(indexType, indexPath)
 	TestIndex_Put(t)
 	TestIndex_Get(t)
@@ -39,18 +40,10 @@ func TestIndex(t *testing.T) {
 	clearBPlusTree()
 }
 
-func initBPlusTree() string {
-	path := filepath.Join(os.TempDir(), "BPlusTree")
-	_ = os.MkdirAll(path, os.ModePerm)
-	return path
-}
-
+// clearBPlusTree 关闭B+树索引文件，测试目录由t.TempDir清理
 func clearBPlusTree() {
 	bp := index.(*BPlusTree)
-	bp.tree.Close()
-	if err := os.RemoveAll(filepath.Join(os.TempDir(), "BPlusTree")); err != nil {
-		panic("clear BPlusTree failed")
-	}
+	_ = bp.tree.Close()
 }
 
 func TestIndex_Put(t *testing.T) {
@@ -200,4 +193,284 @@ func TestIndex_Iterator(t *testing.T) {
 	}
 	assert.Equal(t, 3, cnt)
 	it5.Close()
+
+	// 测试反向seek, key不存在时定位到第一个小于key的元素
+	it6 := index.Iterator(true)
+	it6.Seek([]byte("abcAbcAbcA"))
+	assert.True(t, it6.Valid())
+	assert.Equal(t, []byte("abcAbcAbc"), it6.Key())
+	it6.Seek([]byte("zzz"))
+	assert.True(t, it6.Valid())
+	assert.Equal(t, []byte("abcAbcAbcAbc"), it6.Key())
+	it6.Seek([]byte("a"))
+	assert.False(t, it6.Valid())
+	it6.Close()
+}
+
+func TestIndexer_Clone(t *testing.T) {
+	path := t.TempDir()
+
+	for _, typ := range []IndexerType{BtreeIndex, ARTIndex, BPlusTreeIndex} {
+		idx := NewIndexer(typ, path)
+		idx.Put([]byte("key1"), &data.LogRecordPos{Fid: 1, Offset: 10})
+		idx.Put([]byte("key2"), &data.LogRecordPos{Fid: 1, Offset: 20})
+
+		clone := idx.Clone()
+
+		// 克隆之后对原索引的修改不影响副本
+		idx.Put([]byte("key1"), &data.LogRecordPos{Fid: 2, Offset: 30})
+		idx.Delete([]byte("key2"))
+		idx.Put([]byte("key3"), &data.LogRecordPos{Fid: 2, Offset: 40})
+
+		assert.Equal(t, int64(10), clone.Get([]byte("key1")).Offset)
+		assert.Equal(t, int64(20), clone.Get([]byte("key2")).Offset)
+		assert.Nil(t, clone.Get([]byte("key3")))
+		assert.Equal(t, 2, clone.Size())
+
+		assert.Equal(t, int64(30), idx.Get([]byte("key1")).Offset)
+		assert.Nil(t, idx.Get([]byte("key2")))
+
+		_ = clone.Close()
+		_ = idx.Close()
+	}
+}
+
+// 随机写入和删除，和有序数组比较迭代以及Seek的结果
+func TestIndexIterator_Random(t *testing.T) {
+	for _, typ := range []IndexerType{BtreeIndex, ARTIndex} {
+		idx := NewIndexer(typ, "")
+		rnd := rand.New(rand.NewSource(1))
+		expected := make(map[string]int64)
+
+		// 短key和相同前缀的key都会比较多，覆盖路径压缩以及节点类型的切换
+		randKey := func() []byte {
+			key := make([]byte, rnd.Intn(4)+1)
+			for i := range key {
+				key[i] = byte(rnd.Intn(300) % 256)
+			}
+			return key
+		}
+
+		for i := 0; i < 20000; i++ {
+			key := randKey()
+			if rnd.Intn(3) == 0 {
+				old, ok := idx.Delete(key)
+				_, exist := expected[string(key)]
+				assert.Equal(t, exist, ok)
+				assert.Equal(t, exist, old != nil)
+				delete(expected, string(key))
+				continue
+			}
+			old, ok := idx.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			_, exist := expected[string(key)]
+			assert.Equal(t, exist, ok)
+			assert.Equal(t, exist, old != nil)
+			expected[string(key)] = int64(i)
+		}
+		assert.Equal(t, len(expected), idx.Size())
+
+		keys := make([]string, 0, len(expected))
+		for key := range expected {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, reverse := range []bool{false, true} {
+			want := make([]string, len(keys))
+			copy(want, keys)
+			if reverse {
+				sort.Sort(sort.Reverse(sort.StringSlice(want)))
+			}
+
+			it := idx.Iterator(reverse)
+			var got []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				got = append(got, string(it.Key()))
+				assert.Equal(t, expected[string(it.Key())], it.Value().Offset)
+			}
+			assert.Equal(t, want, got)
+
+			for i := 0; i < 500; i++ {
+				target := randKey()
+				it.Seek(target)
+
+				// 正向为第一个大于等于target的key, 反向为第一个小于等于target的key
+				j := sort.Search(len(want), func(j int) bool {
+					if reverse {
+						return want[j] <= string(target)
+					}
+					return want[j] >= string(target)
+				})
+				if j == len(want) {
+					assert.False(t, it.Valid())
+					continue
+				}
+				assert.True(t, it.Valid())
+				assert.Equal(t, want[j], string(it.Key()))
+			}
+			it.Close()
+		}
+
+		for key := range expected {
+			assert.Equal(t, expected[key], idx.Get([]byte(key)).Offset)
+		}
+	}
+}
+
+// 迭代期间并发写入，迭代器只能看到创建时的数据
+func TestIndexIterator_ConcurrentWrite(t *testing.T) {
+	for _, typ := range []IndexerType{BtreeIndex, ARTIndex} {
+		idx := NewIndexer(typ, "")
+		for i := 0; i < 1000; i++ {
+			idx.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+
+		it := idx.Iterator(false)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				idx.Delete([]byte(fmt.Sprintf("key-%04d", i)))
+				idx.Put([]byte(fmt.Sprintf("new-%04d", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+			}
+		}()
+
+		var count int
+		for it.Rewind(); it.Valid(); it.Next() {
+			assert.Equal(t, uint32(1), it.Value().Fid)
+			count++
+		}
+		it.Close()
+		<-done
+
+		assert.Equal(t, 1000, count)
+		assert.Equal(t, 1000, idx.Size())
+		assert.Nil(t, idx.Get([]byte("key-0001")))
+	}
+}
+
+// assertSameIndex 比较两个索引的全部内容以及正反向迭代和Seek的结果
+func assertSameIndex(t *testing.T, want, got Indexer, rnd *rand.Rand, randKey func() []byte) {
+	assert.Equal(t, want.Size(), got.Size())
+	for _, reverse := range []bool{false, true} {
+		wantIt, gotIt := want.Iterator(reverse), got.Iterator(reverse)
+		gotIt.Rewind()
+		for wantIt.Rewind(); wantIt.Valid(); wantIt.Next() {
+			if !assert.True(t, gotIt.Valid()) {
+				break
+			}
+			assert.Equal(t, wantIt.Key(), gotIt.Key())
+			assert.Equal(t, wantIt.Value(), gotIt.Value())
+			assert.Equal(t, wantIt.Value(), got.Get(wantIt.Key()))
+			gotIt.Next()
+		}
+		assert.False(t, gotIt.Valid())
+
+		for i := 0; i < 50; i++ {
+			key := randKey()
+			wantIt.Seek(key)
+			gotIt.Seek(key)
+			// Seek之后继续走几步
+			for j := rnd.Intn(4); j >= 0 && wantIt.Valid(); j-- {
+				if !assert.True(t, gotIt.Valid()) {
+					break
+				}
+				assert.Equal(t, wantIt.Key(), gotIt.Key())
+				wantIt.Next()
+				gotIt.Next()
+			}
+			assert.Equal(t, wantIt.Valid(), gotIt.Valid())
+		}
+		wantIt.Close()
+		gotIt.Close()
+	}
+}
+
+// 随机的写入、删除、克隆以及和写入交替进行的迭代，ART和BTree的结果必须完全一致
+func TestART_DifferentialBtree(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		btree, art := NewIndexer(BtreeIndex, ""), NewIndexer(ARTIndex, "")
+
+		var known [][]byte
+		randKey := func() []byte {
+			switch n := rnd.Intn(10); {
+			case n < 4 || len(known) == 0:
+				// 短key, 包含0x00和0xff, 同一个节点下会有很多子节点
+				key := make([]byte, rnd.Intn(3)+1)
+				for i := range key {
+					key[i] = byte(rnd.Intn(256))
+				}
+				return key
+			case n < 6:
+				// 已有key的前缀
+				key := known[rnd.Intn(len(known))]
+				return append([]byte(nil), key[:rnd.Intn(len(key)+1)]...)
+			case n < 8:
+				// 在已有key后追加，形成互为前缀的key
+				key := append([]byte(nil), known[rnd.Intn(len(known))]...)
+				return append(key, byte(rnd.Intn(256)))
+			default:
+				// 较长的公共前缀，覆盖路径压缩的分裂和合并
+				return []byte(fmt.Sprintf("tenant-%02d/user-%04d", rnd.Intn(4), rnd.Intn(300)))
+			}
+		}
+
+		type snapshot struct {
+			btree, art Indexer
+		}
+		var snapshots []snapshot
+		var wantIt, gotIt IndexerIterator
+
+		for i := 0; i < 20000; i++ {
+			switch op := rnd.Intn(100); {
+			case op < 50:
+				key := randKey()
+				pos := &data.LogRecordPos{Fid: uint32(seed), Offset: int64(i)}
+				wantOld, wantOk := btree.Put(key, pos)
+				gotOld, gotOk := art.Put(key, pos)
+				assert.Equal(t, wantOld, gotOld)
+				assert.Equal(t, wantOk, gotOk)
+				known = append(known, key)
+			case op < 80:
+				key := randKey()
+				wantOld, wantOk := btree.Delete(key)
+				gotOld, gotOk := art.Delete(key)
+				assert.Equal(t, wantOld, gotOld)
+				assert.Equal(t, wantOk, gotOk)
+			case op < 90:
+				key := randKey()
+				assert.Equal(t, btree.Get(key), art.Get(key))
+			case op < 91:
+				// 克隆之后原索引继续修改，最后检查克隆没有受到影响
+				if len(snapshots) < 10 {
+					snapshots = append(snapshots, snapshot{btree: btree.Clone(), art: art.Clone()})
+				}
+			case op < 92:
+				reverse := rnd.Intn(2) == 0
+				wantIt, gotIt = btree.Iterator(reverse), art.Iterator(reverse)
+				key := randKey()
+				wantIt.Seek(key)
+				gotIt.Seek(key)
+			default:
+				// 迭代器和写入交替进行，迭代器只能看到创建时的数据
+				if wantIt == nil {
+					continue
+				}
+				assert.Equal(t, wantIt.Valid(), gotIt.Valid())
+				if wantIt.Valid() && gotIt.Valid() {
+					assert.Equal(t, wantIt.Key(), gotIt.Key())
+					assert.Equal(t, wantIt.Value(), gotIt.Value())
+					wantIt.Next()
+					gotIt.Next()
+				}
+			}
+		}
+
+		assertSameIndex(t, btree, art, rnd, randKey)
+		for _, s := range snapshots {
+			assertSameIndex(t, s.btree, s.art, rnd, randKey)
+		}
+	}
 }
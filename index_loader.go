@@ -0,0 +1,201 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"runtime"
+	"sync"
+)
+
+// 启动时多个协程并发扫描数据文件，每个文件得到按顺序排列的记录列表，
+// 之后在加载索引的协程中按照文件id从小到大依次处理，和依次扫描每个文件的结果完全一致
+// 扫描完成但还没有处理的文件最多只有IndexLoadParallelism个，避免一次性把所有文件的记录都放在内存中
+
+// loadedRecord 扫描文件得到的一条记录，不保存value
+type loadedRecord struct {
+	realKey []byte
+	seqNo   uint64
+	typ     data.LogRecordType
+	pos     *data.LogRecordPos
+}
+
+// fileScan 一个文件的扫描结果
+type fileScan struct {
+	records []loadedRecord
+
+	// 最后一条完整记录的结束位置，之后是不完整或者损坏的记录
+	validEnd int64
+
+	err error
+}
+
+// fileScanJob 需要扫描的文件以及开始扫描的位置
+type fileScanJob struct {
+	file   *data.SegDataFile
+	offset int64
+}
+
+// scanDataFile 从offset开始读取文件中的所有记录，遇到不完整或者损坏的记录时停止
+func scanDataFile(dataFile *data.SegDataFile, offset int64) *fileScan {
+	scan := &fileScan{}
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			// 判断是否是读完了，不完整或者损坏的记录交给recoverTail处理
+			if isTornRecordErr(err) {
+				break
+			}
+			scan.err = err
+			return scan
+		}
+
+		realKey, seqNo := data.DecodeRecordKeyWithSeq(logRecord.Key)
+		scan.records = append(scan.records, loadedRecord{
+			realKey: realKey,
+			seqNo:   seqNo,
+			typ:     logRecord.Type,
+			pos: &data.LogRecordPos{
+				Fid:    dataFile.FileId,
+				Offset: offset,
+				Size:   uint32(size),
+				Expire: logRecord.Expire,
+			},
+		})
+		offset += size
+	}
+
+	scan.validEnd = offset
+	return scan
+}
+
+// fileScanner 按照任务的顺序启动扫描协程，同时执行的以及已经完成但还没有被取走的任务不超过parallelism个
+type fileScanner struct {
+	results []chan *fileScan
+	slots   chan struct{}
+	done    chan struct{}
+	wg      *sync.WaitGroup
+}
+
+func startFileScanner(jobs []fileScanJob, parallelism int) *fileScanner {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	s := &fileScanner{
+		results: make([]chan *fileScan, len(jobs)),
+		slots:   make(chan struct{}, parallelism),
+		done:    make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+	}
+	for i := range s.results {
+		// 带缓冲，没有被取走的结果不会阻塞扫描协程退出
+		s.results[i] = make(chan *fileScan, 1)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for i, job := range jobs {
+			select {
+			case s.slots <- struct{}{}:
+			case <-s.done:
+				return
+			}
+
+			s.wg.Add(1)
+			go func(i int, job fileScanJob) {
+				defer s.wg.Done()
+				s.results[i] <- scanDataFile(job.file, job.offset)
+			}(i, job)
+		}
+	}()
+	return s
+}
+
+// result 等待第i个任务完成，取走结果之后可以开始新的任务
+func (s *fileScanner) result(i int) *fileScan {
+	scan := <-s.results[i]
+	<-s.slots
+	return scan
+}
+
+// stop 不再开始新的任务，并等待已经开始的任务结束
+func (s *fileScanner) stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// indexLoader 按照文件id从小到大的顺序把扫描得到的记录更新到内存索引中
+// 事务数据先缓存起来，直到读取到事务完成标识时才更新索引
+type indexLoader struct {
+	db  *DB
+	now int64
+
+	// 暂存事务数据，key为事务序列号
+	txnRecords map[uint64][]*data.TransactionRecord
+
+	// 记录最大的序列号
+	seqNo uint64
+}
+
+func newIndexLoader(db *DB, now int64, txnRecords map[uint64][]*data.TransactionRecord, seqNo uint64) *indexLoader {
+	if txnRecords == nil {
+		txnRecords = make(map[uint64][]*data.TransactionRecord)
+	}
+	return &indexLoader{db: db, now: now, txnRecords: txnRecords, seqNo: seqNo}
+}
+
+// update 更新一条记录的内存索引，并统计可以回收的空间大小
+func (l *indexLoader) update(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	var oldValue *data.LogRecordPos
+	if typ == data.LogRecordDeleted || (typ != data.LogRecordTxnFinished && pos.IsExpired(l.now)) {
+		// 已经过期的记录和删除记录一样处理, 会覆盖掉之前的旧值
+		oldValue, _ = l.db.index.Delete(key)
+		// 删除数据这条记录本身也可以回收
+		l.db.markGarbage(pos)
+	} else if typ == data.LogRecordNormal || typ == data.LogRecordMerge {
+		oldValue, _ = l.db.index.Put(key, pos)
+	}
+
+	// 更新可以回收的空间大小
+	if oldValue != nil {
+		l.db.markGarbage(oldValue)
+	}
+}
+
+// apply 处理一个文件中按顺序排列的记录
+func (l *indexLoader) apply(fileId uint32, records []loadedRecord) {
+	for _, rec := range records {
+		if rec.typ == data.LogRecordMerge {
+			l.db.mergeRecordNum[fileId]++
+		}
+
+		// 判断是否是事务
+		if rec.seqNo == nonTransactionSeqNo {
+			// 非事务操作，直接更新
+			l.update(rec.realKey, rec.typ, rec.pos)
+		} else {
+			// 针对事务，先将其缓存起来，直到读取到事务结束标志
+			if rec.typ == data.LogRecordTxnFinished {
+				// 事务完成标识本身也可以回收
+				l.db.markGarbage(rec.pos)
+
+				// 更新对应的索引
+				for _, txnRec := range l.txnRecords[rec.seqNo] {
+					l.update(txnRec.Record.Key, txnRec.Record.Type, txnRec.Pos)
+				}
+
+				// 删除缓存
+				delete(l.txnRecords, rec.seqNo)
+			} else {
+				l.txnRecords[rec.seqNo] = append(l.txnRecords[rec.seqNo], &data.TransactionRecord{
+					Record: &data.LogRecord{Key: rec.realKey, Type: rec.typ},
+					Pos:    rec.pos,
+				})
+			}
+		}
+
+		if rec.seqNo > l.seqNo {
+			l.seqNo = rec.seqNo
+		}
+	}
+}
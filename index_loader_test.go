@@ -0,0 +1,108 @@
+package bitcaskKV
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/fio"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+)
+
+func TestOpen_ParallelIndexLoad(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-parallel-load")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.IndexSnapshot = false
+	opts.IndexLoadParallelism = 1
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 覆盖写入、删除以及跨越多个文件的事务
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 300; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d-%d", round, i))))
+		}
+		for i := round; i < 300; i += 7 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBachOption)
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(i*3), []byte(fmt.Sprintf("txn-%d-%d", round, i))))
+		}
+		assert.Nil(t, wb.Delete(utils.GetTestKey(1)))
+		assert.Nil(t, wb.Commit())
+		_, err := db.Apply([]byte("counter"), Int64AddOperatorName, []byte("1"))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 10)
+	assert.Nil(t, db.Close())
+
+	load := func(parallelism int) (map[string]string, *Stat, []FileStat, uint64) {
+		opts.IndexLoadParallelism = parallelism
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		defer func() {
+			assert.Nil(t, db.Close())
+		}()
+
+		values := make(map[string]string)
+		assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+			values[string(key)] = string(value)
+			return true
+		}))
+		fileStats, err := db.FileStats()
+		assert.Nil(t, err)
+		return values, db.Stat(), fileStats, db.seqNo
+	}
+
+	values, stat, fileStats, seqNo := load(1)
+	assert.Equal(t, "3", values["counter"])
+	for _, parallelism := range []int{0, 4, 64} {
+		pValues, pStat, pFileStats, pSeqNo := load(parallelism)
+		assert.Equal(t, values, pValues)
+		assert.Equal(t, stat, pStat)
+		assert.Equal(t, fileStats, pFileStats)
+		assert.Equal(t, seqNo, pSeqNo)
+	}
+	_ = os.RemoveAll(dir)
+}
+
+func TestFileScanner(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-file-scanner")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	var jobs []fileScanJob
+	for fid := uint32(0); fid < 10; fid++ {
+		dataFile, err := data.OpenDataFile(dir, fid, fio.StandardIO)
+		assert.Nil(t, err)
+		defer func() {
+			_ = dataFile.Close()
+		}()
+		for i := 0; i <= int(fid); i++ {
+			buf, _ := data.EncodeLogRecord(&data.LogRecord{Key: utils.GetTestKey(i), Value: []byte("value"), Type: data.LogRecordNormal})
+			assert.Nil(t, dataFile.Write(buf))
+		}
+		jobs = append(jobs, fileScanJob{file: dataFile, offset: dataFile.DataOffset()})
+	}
+
+	// 按照任务的顺序取得结果
+	scanner := startFileScanner(jobs, 3)
+	for i := range jobs {
+		scan := scanner.result(i)
+		assert.Nil(t, scan.err)
+		assert.Equal(t, i+1, len(scan.records))
+		assert.Equal(t, uint32(i), scan.records[0].pos.Fid)
+		assert.Equal(t, jobs[i].file.WriteOff, scan.validEnd)
+	}
+	scanner.stop()
+
+	// 没有取完结果时也可以停止
+	scanner = startFileScanner(jobs, 2)
+	assert.Nil(t, scanner.result(0).err)
+	scanner.stop()
+}
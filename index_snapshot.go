@@ -0,0 +1,397 @@
+package bitcaskKV
+
+import (
+	"encoding/binary"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/index"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 关闭数据库以及定期将BTree、ART内存索引写入快照文件，启动时先加载快照，再从快照记录的位置开始加载之后写入的数据
+// 快照文件和数据文件使用相同的记录格式，配置了密钥时同样会被加密
+//
+//	元信息记录 | 索引记录 ... | 校验记录
+//
+// 元信息记录中保存快照对应的位置(文件id, 写入偏移)、事务序列号、每个文件的无效数据大小以及之前所有的文件id
+// 索引记录的key为realKey, value为编码之后的位置，校验记录保存所有索引记录的crc
+// 快照损坏、和数据文件不一致或者数据文件被merge替换之后，快照都会被丢弃，从头加载所有的数据文件
+
+const (
+	indexSnapshotMetaKey = "index_snapshot_meta"
+	indexSnapshotCRCKey  = "index_snapshot_crc"
+
+	// 写入过程中使用的临时文件后缀，写入完成之后重命名
+	indexSnapshotTempSuffix = ".tmp"
+)
+
+// indexSnapshotFile 快照中每个数据文件的统计信息
+type indexSnapshotFile struct {
+	fid          uint32
+	deadBytes    int64
+	mergeRecords int
+}
+
+// indexSnapshotMeta 快照的元信息
+type indexSnapshotMeta struct {
+	// 快照包含了文件fid中writeOff之前的所有数据，以及之前的所有文件
+	fid      uint32
+	writeOff int64
+
+	seqNo       uint64
+	recycleSize uint32
+
+	// 索引记录的数量
+	count uint64
+
+	// fid以及之前的所有文件，按照文件id从小到大排列
+	files []indexSnapshotFile
+}
+
+func (meta *indexSnapshotMeta) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen64*6+len(meta.files)*binary.MaxVarintLen64*3)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(meta.fid))
+	index += binary.PutVarint(buf[index:], meta.writeOff)
+	index += binary.PutUvarint(buf[index:], meta.seqNo)
+	index += binary.PutUvarint(buf[index:], uint64(meta.recycleSize))
+	index += binary.PutUvarint(buf[index:], meta.count)
+	index += binary.PutUvarint(buf[index:], uint64(len(meta.files)))
+	for _, file := range meta.files {
+		index += binary.PutUvarint(buf[index:], uint64(file.fid))
+		index += binary.PutVarint(buf[index:], file.deadBytes)
+		index += binary.PutUvarint(buf[index:], uint64(file.mergeRecords))
+	}
+	return buf[:index]
+}
+
+func decodeIndexSnapshotMeta(buf []byte) (*indexSnapshotMeta, error) {
+	var index = 0
+	var failed bool
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		index += n
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		index += n
+		return v
+	}
+
+	meta := &indexSnapshotMeta{
+		fid:         uint32(uvarint()),
+		writeOff:    varint(),
+		seqNo:       uvarint(),
+		recycleSize: uint32(uvarint()),
+		count:       uvarint(),
+	}
+	fileNum := uvarint()
+	for i := uint64(0); i < fileNum && !failed; i++ {
+		meta.files = append(meta.files, indexSnapshotFile{
+			fid:          uint32(uvarint()),
+			deadBytes:    varint(),
+			mergeRecords: int(uvarint()),
+		})
+	}
+	if failed {
+		return nil, ErrIndexSnapshotCorrupted
+	}
+	return meta, nil
+}
+
+// indexSnapshotEnabled 是否需要写入索引快照
+func (db *DB) indexSnapshotEnabled() bool {
+	return db.option.IndexSnapshot && !db.option.ReadOnly && db.option.IndexType != index.BPlusTreeIndex
+}
+
+// saveIndexSnapshot 将当前的内存索引写入快照文件
+// 只在持有读锁期间克隆索引以及复制统计信息，写入文件时不会阻塞写操作
+func (db *DB) saveIndexSnapshot() error {
+	db.mu.RLock()
+	if db.activeFile == nil {
+		db.mu.RUnlock()
+		return nil
+	}
+
+	// 快照之前的数据必须已经持久化，否则崩溃之后快照中的位置可能指向没有写入磁盘的数据
+	if err := db.activeFile.Sync(); err != nil {
+		db.mu.RUnlock()
+		return err
+	}
+
+	meta := &indexSnapshotMeta{
+		fid:         db.activeFile.FileId,
+		writeOff:    db.activeFile.WriteOff,
+		seqNo:       db.seqNo,
+		recycleSize: db.recycleSize,
+	}
+	fids := make([]uint32, 0, len(db.olderFiles)+1)
+	for fid := range db.olderFiles {
+		fids = append(fids, fid)
+	}
+	fids = append(fids, db.activeFile.FileId)
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	for _, fid := range fids {
+		meta.files = append(meta.files, indexSnapshotFile{
+			fid:          fid,
+			deadBytes:    db.deadBytes[fid],
+			mergeRecords: db.mergeRecordNum[fid],
+		})
+	}
+	idx := db.index.Clone()
+	db.mu.RUnlock()
+	meta.count = uint64(idx.Size())
+
+	fileName := filepath.Join(db.option.DirPath, data.IndexSnapshotFileName)
+	tempName := fileName + indexSnapshotTempSuffix
+	// 之前写入失败留下的临时文件
+	if err := os.Remove(tempName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := db.writeIndexSnapshotFile(tempName, meta, idx); err != nil {
+		_ = os.Remove(tempName)
+		return err
+	}
+	return os.Rename(tempName, fileName)
+}
+
+func (db *DB) writeIndexSnapshotFile(fileName string, meta *indexSnapshotMeta, idx index.Indexer) (err error) {
+	file, err := data.OpenIndexSnapshotFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	write := func(key, value []byte) error {
+		enc, _, err := data.EncodeLogRecordWithKeys(&data.LogRecord{Key: key, Value: value}, nil, 0, db.keyRing)
+		if err != nil {
+			return err
+		}
+		return file.Write(enc)
+	}
+
+	if err := write([]byte(indexSnapshotMetaKey), meta.encode()); err != nil {
+		return err
+	}
+
+	var crc uint32
+	iter := idx.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key, value := iter.Key(), data.EncodeLogRecordPos(iter.Value())
+		crc = crc32.Update(crc, crc32.IEEETable, key)
+		crc = crc32.Update(crc, crc32.IEEETable, value)
+		if err := write(key, value); err != nil {
+			return err
+		}
+	}
+
+	crcBuf := make([]byte, crc32.Size)
+	binary.LittleEndian.PutUint32(crcBuf, crc)
+	if err := write([]byte(indexSnapshotCRCKey), crcBuf); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// loadIndexSnapshot 加载索引快照，替换当前的索引以及统计信息，返回快照的元信息
+// 快照不存在或者无法使用时返回nil, 需要从头加载所有的数据文件
+// 快照之后已经过期的key不再加入索引，计入可回收空间
+func (db *DB) loadIndexSnapshot(now int64) (*indexSnapshotMeta, error) {
+	fileName := filepath.Join(db.option.DirPath, data.IndexSnapshotFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	meta, idx, err := db.readIndexSnapshot(fileName)
+	if err != nil {
+		// 快照只是用于加快启动，无法使用时从数据文件中重新加载
+		return nil, nil
+	}
+
+	db.index = idx
+	db.recycleSize = meta.recycleSize
+	for _, file := range meta.files {
+		db.deadBytes[file.fid] = file.deadBytes
+		if file.mergeRecords > 0 {
+			db.mergeRecordNum[file.fid] = file.mergeRecords
+		}
+	}
+
+	db.sweepExpiredKeys(now)
+
+	return meta, nil
+}
+
+// readIndexSnapshot 读取快照文件，校验crc并且检查快照是否和当前的数据文件一致
+func (db *DB) readIndexSnapshot(fileName string) (*indexSnapshotMeta, index.Indexer, error) {
+	file, err := data.OpenIndexSnapshotFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	file.Keys = db.keyRing
+
+	offset := file.DataOffset()
+	read := func(key string) (*data.LogRecord, error) {
+		record, size, err := file.ReadLogRecord(offset)
+		if err == io.EOF {
+			return nil, ErrIndexSnapshotCorrupted
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key != "" && string(record.Key) != key {
+			return nil, ErrIndexSnapshotCorrupted
+		}
+		offset += size
+		return record, nil
+	}
+
+	record, err := read(indexSnapshotMetaKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := decodeIndexSnapshotMeta(record.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.checkIndexSnapshotMeta(meta); err != nil {
+		return nil, nil, err
+	}
+
+	idx := index.NewIndexer(db.option.IndexType, db.option.indexPath)
+	var crc uint32
+	for i := uint64(0); i < meta.count; i++ {
+		record, err := read("")
+		if err != nil {
+			return nil, nil, err
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, record.Key)
+		crc = crc32.Update(crc, crc32.IEEETable, record.Value)
+		idx.Put(record.Key, data.DecodeLogRecordPos(record.Value))
+	}
+
+	record, err = read(indexSnapshotCRCKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(record.Value) != crc32.Size || binary.LittleEndian.Uint32(record.Value) != crc {
+		return nil, nil, ErrIndexSnapshotCorrupted
+	}
+	return meta, idx, nil
+}
+
+// checkIndexSnapshotMeta 快照之前的文件必须和当前的文件完全一致，快照所在的文件不能比快照记录的位置更短
+func (db *DB) checkIndexSnapshotMeta(meta *indexSnapshotMeta) error {
+	var fids []uint32
+	for _, fid := range db.fileIds {
+		if uint32(fid) <= meta.fid {
+			fids = append(fids, uint32(fid))
+		}
+	}
+	if len(fids) != len(meta.files) {
+		return ErrIndexSnapshotCorrupted
+	}
+	for i, fid := range fids {
+		if meta.files[i].fid != fid {
+			return ErrIndexSnapshotCorrupted
+		}
+	}
+
+	dataFile := db.olderFiles[meta.fid]
+	if db.activeFile != nil && db.activeFile.FileId == meta.fid {
+		dataFile = db.activeFile
+	}
+	if dataFile == nil {
+		return ErrIndexSnapshotCorrupted
+	}
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if meta.writeOff < dataFile.DataOffset() || meta.writeOff > size {
+		return ErrIndexSnapshotCorrupted
+	}
+	return nil
+}
+
+// removeIndexSnapshot 删除目录下的索引快照
+func removeIndexSnapshot(dirPath string) error {
+	err := os.Remove(filepath.Join(dirPath, data.IndexSnapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// indexSnapshotScheduler 后台定期写入索引快照
+type indexSnapshotScheduler struct {
+	db *DB
+
+	closeCh chan struct{}
+	wg      *sync.WaitGroup
+	once    *sync.Once
+}
+
+func newIndexSnapshotScheduler(db *DB) *indexSnapshotScheduler {
+	return &indexSnapshotScheduler{
+		db:      db,
+		closeCh: make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+		once:    new(sync.Once),
+	}
+}
+
+func (s *indexSnapshotScheduler) start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// stop 通知后台协程退出，并等待正在写入的快照完成
+func (s *indexSnapshotScheduler) stop() {
+	s.once.Do(func() {
+		close(s.closeCh)
+	})
+	s.wg.Wait()
+}
+
+func (s *indexSnapshotScheduler) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.db.option.IndexSnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			// 写入失败时等待下一个周期，关闭时还会再写入一次
+			_ = s.db.saveIndexSnapshot()
+		}
+	}
+}
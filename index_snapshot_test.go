@@ -0,0 +1,171 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-index-snapshot")
+	opts.DirPath = dir
+	opts.IndexSnapshot = true
+	opts.DataFileSize = 32 * 1024
+	opts.TailRecovery = TailRecoveryFail
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBachOption)
+	assert.Nil(t, wb.Put([]byte("txn-key"), []byte("txn-value")))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.PutWithTTL([]byte("ttl-key"), []byte("value"), time.Millisecond*50))
+	assert.Nil(t, db.Put([]byte("counter"), []byte("1")))
+	_, err = db.Apply([]byte("counter"), Int64AddOperatorName, []byte("2"))
+	assert.Nil(t, err)
+
+	seqNo := db.seqNo
+	assert.Nil(t, db.Close())
+
+	snapshotFile := filepath.Join(dir, data.IndexSnapshotFileName)
+	_, err = os.Stat(snapshotFile)
+	assert.Nil(t, err)
+
+	// 在快照之后写入的数据从数据文件中加载
+	time.Sleep(time.Millisecond * 50)
+	opts.IndexSnapshot = false
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("after-snapshot")))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(100)))
+	stat := db.Stat()
+	fileStats, err := db.FileStats()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// 和从头加载所有数据文件的结果一致
+	opts.IndexSnapshot = true
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, db.index.Size())
+	assert.Equal(t, seqNo, db.seqNo)
+	assert.Equal(t, stat, db.Stat())
+	for i := 101; i < 1100; i += 50 {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("ttl-key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("3"), val)
+	val, err = db.Get([]byte("txn-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn-value"), val)
+
+	newFileStats, err := db.FileStats()
+	assert.Nil(t, err)
+	assert.Equal(t, fileStats, newFileStats)
+	destroyDB(db)
+}
+
+func TestOpen_IndexSnapshotSkipsCoveredFiles(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-index-snapshot-covered")
+	opts.DirPath = dir
+	opts.IndexSnapshot = true
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 破坏第一个文件中的一条记录，快照之前的文件不会再被读取
+	firstFile := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(firstFile)
+	assert.Nil(t, err)
+	buf[data.FileHeaderSize+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(firstFile, buf, 0644))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, db.index.Size())
+	assert.Nil(t, db.Close())
+
+	// 快照损坏时从头加载所有的数据文件，发现损坏的记录
+	snapshotFile := filepath.Join(dir, data.IndexSnapshotFileName)
+	snapshot, err := os.ReadFile(snapshotFile)
+	assert.Nil(t, err)
+	snapshot[len(snapshot)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(snapshotFile, snapshot, 0644))
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataFileCorrupted, err)
+
+	// 数据文件被删除时快照同样不能使用
+	buf[data.FileHeaderSize+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(firstFile, buf, 0644))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(firstFile))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.True(t, db.index.Size() < 1000)
+}
+
+func TestDB_IndexSnapshotMerge(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-index-snapshot-merge")
+	opts.DirPath = dir
+	opts.IndexSnapshot = true
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.IndexSnapshotInterval = time.Millisecond * 20
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+
+	// 后台定期写入快照
+	snapshotFile := filepath.Join(dir, data.IndexSnapshotFileName)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(snapshotFile)
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	_, err = os.Stat(filepath.Join(db.getMergePath(), data.IndexSnapshotFileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Close())
+
+	// merge替换文件之后快照中的位置失效，从hint文件以及数据文件加载
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, 500, db.index.Size())
+	for i := 500; i < 1000; i += 50 {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
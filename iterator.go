@@ -2,6 +2,7 @@ package bitcaskKV
 
 import (
 	"bytes"
+	"time"
 
 	"go-bitcask-kv/index"
 )
@@ -11,34 +12,63 @@ type Iterator struct {
 	db        *DB
 	indexIter index.IndexerIterator
 	option    IteratorOption
+
+	// 不为空时表示快照上的迭代器，从快照中读取数据
+	snap *Snapshot
+
+	// 前缀对应的上界(不包含)，为nil表示没有上界
+	prefixEnd []byte
+
+	// 已经越过了迭代范围
+	exhausted bool
+
+	// 本次Rewind或者Seek之后已经遍历的key数量
+	count int
 }
 
 // NewIterator 初始化迭代器
 func (db *DB) NewIterator(opt IteratorOption) *Iterator {
-	indexIter := db.index.Iterator(opt.reverse)
+	return newIterator(db, nil, db.index.Iterator(opt.Reverse), opt)
+}
+
+func newIterator(db *DB, snap *Snapshot, indexIter index.IndexerIterator, opt IteratorOption) *Iterator {
+	var prefixEnd []byte
+	if len(opt.Prefix) > 0 {
+		prefixEnd = prefixSuccessor(opt.Prefix)
+	}
+
 	return &Iterator{
 		db:        db,
+		snap:      snap,
 		indexIter: indexIter,
 		option:    opt,
+		prefixEnd: prefixEnd,
 	}
 }
 
+// Rewind 回到迭代范围的起点，反向迭代时为范围内最大的key
 func (it *Iterator) Rewind() {
-	it.indexIter.Rewind()
+	it.seek(nil)
 }
 
+// Seek 正向迭代时定位到第一个大于等于key的位置，反向迭代时定位到第一个小于等于key的位置
+// key在迭代范围的起点之前时定位到范围的起点，在范围的终点之后时迭代器无效
+// 即正向迭代时key超过UpperBound, 或者反向迭代时key小于LowerBound, Valid返回false
 func (it *Iterator) Seek(key []byte) {
-	it.indexIter.Seek(key)
-	it.skipToNext()
+	it.seek(key)
 }
 
 func (it *Iterator) Next() {
 	it.indexIter.Next()
+	it.count++
 	it.skipToNext()
 }
 
 func (it *Iterator) Valid() bool {
-	return it.indexIter.Valid()
+	if it.exhausted || !it.indexIter.Valid() {
+		return false
+	}
+	return it.option.Limit <= 0 || it.count < it.option.Limit
 }
 
 func (it *Iterator) Key() []byte {
@@ -47,7 +77,15 @@ func (it *Iterator) Key() []byte {
 
 // Value 注意这里是返回value的具体值，而索引迭代器是返回pos信息
 func (it *Iterator) Value() ([]byte, error) {
+	if it.option.KeysOnly {
+		return nil, ErrIteratorKeysOnly
+	}
+
 	pos := it.indexIter.Value()
+	if it.snap != nil {
+		return it.snap.getValueByPosition(pos)
+	}
+
 	it.db.mu.RLock()
 	defer it.db.mu.RUnlock()
 	return it.db.getValueByPosition(pos)
@@ -57,18 +95,104 @@ func (it *Iterator) Close() {
 	it.indexIter.Close()
 }
 
+// seek 根据上下界以及前缀把key收紧到迭代范围内，key为nil表示从范围的起点开始
+func (it *Iterator) seek(key []byte) {
+	it.exhausted = false
+	it.count = 0
+
+	var target []byte
+	if it.option.Reverse {
+		target = minBound(minBound(key, it.option.UpperBound), it.prefixEnd)
+	} else {
+		target = maxBound(maxBound(key, it.option.LowerBound), it.option.Prefix)
+	}
+
+	if target == nil {
+		it.indexIter.Rewind()
+	} else {
+		it.indexIter.Seek(target)
+	}
+	it.skipToNext()
+}
+
+// skipToNext 跳过不在迭代范围内以及已经过期的key
+// 沿着迭代方向越过范围之后不再继续遍历
 func (it *Iterator) skipToNext() {
-	prefixLen := len(it.option.prefix)
-	if prefixLen == 0 {
-		// prefix默认为空，表示不进行前缀匹配
+	now := time.Now().UnixNano()
+
+	for ; it.indexIter.Valid(); it.indexIter.Next() {
+		switch cmp := it.compareRange(it.indexIter.Key()); {
+		case (cmp > 0 && !it.option.Reverse) || (cmp < 0 && it.option.Reverse):
+			it.exhausted = true
+			return
+		case cmp != 0:
+			continue
+		}
+
+		if it.indexIter.Value().IsExpired(now) {
+			continue
+		}
+
+		// 找到第一个匹配的元素，结束循环
 		return
 	}
+}
 
-	for ; it.indexIter.Valid(); it.indexIter.Next() {
-		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.option.prefix, key[:prefixLen]) == 0 {
-			// 找到第一个匹配的元素，结束循环
-			break
+// compareRange 判断key和迭代范围的关系
+// 按照key从小到大的顺序，-1表示在范围之前，0表示在范围内，1表示在范围之后
+func (it *Iterator) compareRange(key []byte) int {
+	opt := it.option
+
+	if opt.LowerBound != nil {
+		c := bytes.Compare(key, opt.LowerBound)
+		if c < 0 || (c == 0 && opt.LowerBoundExclusive) {
+			return -1
+		}
+	}
+
+	if opt.UpperBound != nil {
+		c := bytes.Compare(key, opt.UpperBound)
+		if c > 0 || (c == 0 && !opt.UpperBoundInclusive) {
+			return 1
+		}
+	}
+
+	// prefix默认为空，表示不进行前缀匹配
+	if len(opt.Prefix) > 0 && !bytes.HasPrefix(key, opt.Prefix) {
+		if bytes.Compare(key, opt.Prefix) < 0 {
+			return -1
 		}
+		return 1
+	}
+
+	return 0
+}
+
+// prefixSuccessor 返回大于所有以prefix为前缀的key的最小值，不存在时返回nil
+func prefixSuccessor(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// maxBound 返回两个下界中较大的一个，nil表示没有限制
+func maxBound(a, b []byte) []byte {
+	if a == nil || (b != nil && bytes.Compare(b, a) > 0) {
+		return b
+	}
+	return a
+}
+
+// minBound 返回两个上界中较小的一个，nil表示没有限制
+func minBound(a, b []byte) []byte {
+	if a == nil || (b != nil && bytes.Compare(b, a) < 0) {
+		return b
 	}
+	return a
 }
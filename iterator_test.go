@@ -2,6 +2,7 @@ package bitcaskKV
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/index"
 	"go-bitcask-kv/utils"
 	"os"
 	"testing"
@@ -40,7 +41,7 @@ func TestDB_NewIterator(t *testing.T) {
 
 	// 反向迭代
 	iterOpts1 := DefaultIteratorOption
-	iterOpts1.reverse = true
+	iterOpts1.Reverse = true
 	iter2 := db.NewIterator(iterOpts1)
 	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
 		assert.NotNil(t, iter2.Key())
@@ -53,10 +54,85 @@ func TestDB_NewIterator(t *testing.T) {
 
 	// 指定了 prefix
 	iterOpts2 := DefaultIteratorOption
-	iterOpts2.prefix = []byte("hel")
+	iterOpts2.Prefix = []byte("hel")
 	iter3 := db.NewIterator(iterOpts2)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.NotNil(t, iter3.Key())
 	}
 	iter3.Close()
 }
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	for _, indexType := range []index.IndexerType{index.BtreeIndex, index.ARTIndex, index.BPlusTreeIndex} {
+		opts := DefaultOption
+		dir, _ := os.MkdirTemp("", "bitcask-iterator-bounds")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.indexPath = dir
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for _, key := range []string{"a", "b1", "b2", "b3", "c", "d"} {
+			err := db.Put([]byte(key), utils.GetTestRandomValue(10))
+			assert.Nil(t, err)
+		}
+
+		collect := func(opt IteratorOption, seek []byte) []string {
+			iter := db.NewIterator(opt)
+			defer iter.Close()
+
+			if seek == nil {
+				iter.Rewind()
+			} else {
+				iter.Seek(seek)
+			}
+
+			var keys []string
+			for ; iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			return keys
+		}
+
+		// [b2, d)
+		opt := IteratorOption{LowerBound: []byte("b2"), UpperBound: []byte("d")}
+		assert.Equal(t, []string{"b2", "b3", "c"}, collect(opt, nil))
+		assert.Equal(t, []string{"b2", "b3", "c"}, collect(opt, []byte("a")))
+		assert.Equal(t, []string{"c"}, collect(opt, []byte("b4")))
+		assert.Nil(t, collect(opt, []byte("e")))
+
+		// (b2, d]
+		opt = IteratorOption{LowerBound: []byte("b2"), LowerBoundExclusive: true, UpperBound: []byte("d"), UpperBoundInclusive: true}
+		assert.Equal(t, []string{"b3", "c", "d"}, collect(opt, nil))
+
+		// 反向
+		opt = IteratorOption{Reverse: true, LowerBound: []byte("b2"), UpperBound: []byte("d")}
+		assert.Equal(t, []string{"c", "b3", "b2"}, collect(opt, nil))
+		assert.Equal(t, []string{"b3", "b2"}, collect(opt, []byte("b4")))
+		assert.Equal(t, []string{"c", "b3", "b2"}, collect(opt, []byte("z")))
+		assert.Nil(t, collect(opt, []byte("b1")))
+
+		// 前缀
+		opt = IteratorOption{Prefix: []byte("b")}
+		assert.Equal(t, []string{"b1", "b2", "b3"}, collect(opt, nil))
+		opt.Reverse = true
+		assert.Equal(t, []string{"b3", "b2", "b1"}, collect(opt, nil))
+		assert.Equal(t, []string{"b2", "b1"}, collect(opt, []byte("b2")))
+
+		// 数量限制
+		opt = IteratorOption{Limit: 2}
+		assert.Equal(t, []string{"a", "b1"}, collect(opt, nil))
+		assert.Equal(t, []string{"c", "d"}, collect(opt, []byte("c")))
+
+		// 只遍历key
+		iter := db.NewIterator(IteratorOption{KeysOnly: true})
+		iter.Rewind()
+		assert.True(t, iter.Valid())
+		_, err = iter.Value()
+		assert.Equal(t, ErrIteratorKeysOnly, err)
+		iter.Close()
+
+		destroyDB(db)
+	}
+}
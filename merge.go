@@ -1,26 +1,44 @@
 package bitcaskKV
 
 import (
+	"context"
+	"github.com/gofrs/flock"
 	"go-bitcask-kv/data"
+	"go-bitcask-kv/index"
 	"go-bitcask-kv/utils"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
-const (
-	mergeDirName     = "-merge"
-	mergeFinishedKey = "merge_finished"
-)
-
+// Merge 清理无效数据，merge之后的文件在下次启动时替换旧文件
 func (db *DB) Merge() error {
+	return db.MergeWithContext(context.Background(), nil)
+}
+
+// MergeWithContext 和Merge相同，ctx被取消时中止merge并清理merge目录，返回ctx.Err()
+// progress不为nil时在merge过程中汇报进度，在执行merge的协程中调用，不能在其中调用DB的写操作
+func (db *DB) MergeWithContext(ctx context.Context, progress func(MergeProgress)) (err error) {
+	db.mu.Lock()
+	if db.isClosed {
+		db.mu.Unlock()
+		return ErrDatabaseIsClosed
+	}
+
+	if db.option.ReadOnly {
+		db.mu.Unlock()
+		return ErrReadOnly
+	}
+
 	if db.activeFile == nil {
+		db.mu.Unlock()
 		return nil
 	}
 
-	db.mu.Lock()
 	// 判断DB是否正在merge
 	// 不需要使用defer来释放锁，因为merge并不是全过程都需要锁
 	if db.isMerging {
@@ -28,6 +46,15 @@ func (db *DB) Merge() error {
 		return ErrMergeIsRunning
 	}
 
+	// 之前完成的merge在下次启动时才会替换文件，再次merge会删除该目录，之前回收的空间也随之丢失
+	if mergeFinishedExists(db.getMergePath()) {
+		db.mu.Unlock()
+		return ErrMergeNotApplied
+	}
+
+	// 没有被访问过的过期key同样是可以回收的空间
+	db.sweepExpiredKeys(time.Now().UnixNano())
+
 	// 判断当前系统是否达到可以merge的阈值
 	need, err := db.needMerge()
 	if err != nil {
@@ -36,17 +63,51 @@ func (db *DB) Merge() error {
 		return err
 	}
 
+	// 还有使用旧密钥加密的文件时，即使没有达到阈值也需要merge重新加密
+	if !need {
+		if need, err = db.hasStaleKeyFiles(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+
 	if !need {
 		db.mu.Unlock()
 		return ErrMergeCondUnreached
 	}
 
+	// 取出所有需要Merge的文件，当前的active文件也会参与merge
+	mergeFiles, err := db.pickMergeFiles()
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	if len(mergeFiles) == 0 {
+		db.mu.Unlock()
+		return ErrMergeCondUnreached
+	}
+
+	// 没有参与merge的文件中最小的文件id，之后被压缩的文件需要保留删除标记
+	minUncompactedId := db.minUncompactedFileId(mergeFiles)
+
 	//fmt.Println("merge is begin")
 
+	mergeStart := time.Now()
+
+	// Close时通过mergeCancel中止merge, 并等待mergeDone
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
 	db.isMerging = true
+	db.mergeCancel, db.mergeDone = cancel, done
 	defer func() {
 		// 在最后改为false
+		db.mu.Lock()
 		db.isMerging = false
+		db.mergeCancel, db.mergeDone = nil, nil
+		db.mu.Unlock()
+
+		cancel()
+		close(done)
 	}()
 
 	// 持久化当前文件，并且重新开启一个新的active文件
@@ -63,12 +124,19 @@ func (db *DB) Merge() error {
 	// 记录最新的active文件id, 表示之前的都已经参与merge操作了
 	nonMergeFileId := db.activeFile.FileId
 
-	// 取出所有需要Merge的文件，之后就能释放锁了
-	// DB可以继续接收用户新的写入请求
-	var mergeFiles []*data.SegDataFile
-	for _, file := range db.olderFiles {
-		mergeFiles = append(mergeFiles, file)
+	// 之前的文件会被重写，之后的合并记录不能再引用其中的记录
+	db.mergeBoundary = nonMergeFileId
+
+	// 合并记录引用的记录可能在任意一个旧文件中，包括没有参与merge的文件
+	olderFileMap := make(map[uint32]*data.SegDataFile, len(db.olderFiles))
+	for fid, file := range db.olderFiles {
+		olderFileMap[fid] = file
+	}
+	getMergeFile := func(fid uint32) *data.SegDataFile {
+		return olderFileMap[fid]
 	}
+
+	// 之后就能释放锁了，DB可以继续接收用户新的写入请求
 	db.mu.Unlock()
 
 	// 对需要merge的文件进行排序，因为map是无序的
@@ -79,7 +147,7 @@ func (db *DB) Merge() error {
 
 	mergePath := db.getMergePath()
 
-	// 如果存在目录，说明之前可能已经merge过，进行删除
+	// 如果存在目录，说明之前的merge没有完成，进行删除
 	if _, err := os.Stat(mergePath); err == nil {
 		if err := os.RemoveAll(mergePath); err != nil {
 			return err
@@ -91,61 +159,40 @@ func (db *DB) Merge() error {
 		return err
 	}
 
-	// 重新打开一个bitcask实例去merge
-	mergeOption := db.option
-	mergeOption.DirPath = mergePath
-	mergeOption.SyncWrites = false
-	mergeDB, err := Open(mergeOption)
+	// merge失败或者被取消时删除merge目录，未完成的merge目录不能被加载
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(mergePath)
+		}
+	}()
+
+	task, err := newMergeTask(ctx, mergeFiles, progress, db.mergeLimiter)
 	if err != nil {
 		return err
 	}
 
 	// 打开一个hint文件存储索引
 	hintFile, err := data.OpenHintFile(mergePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
 
-	// 遍历处理每个数据文件
-	for _, dataFile := range mergeFiles {
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-
+	// 全量merge时将有效数据重新写入到新的文件中，否则原地压缩挑选出来的文件
+	var mergedFileIds []uint32
+	if db.option.MergeFileGarbageRatio > 0 {
+		for _, dataFile := range mergeFiles {
+			keepTombstones := dataFile.FileId > minUncompactedId
+			if err := db.compactFile(task, mergePath, dataFile, hintFile, getMergeFile, keepTombstones); err != nil {
 				return err
 			}
-
-			realKey, _ := decodeRecordKeyWithSeq(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
-
-			// 将读取出的数据和内存中的数据比较，如果一致则说明该数据是有效的
-			// 因为内存中的数据是最新的
-			// 如果是事务，那也是已经commit并且成功的事务才会更新到内存中
-			if logRecordPos != nil && logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset {
-				// 清除事务标记，因为都是有效的key
-				logRecord.Key = encodeRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-
-				// 重写数据，写入到merge目录中
-				pos, err := mergeDB.appendLogRecord(logRecord)
-				if err != nil {
-					return nil
-				}
-
-				// 记录hint文件，其实就是记录索引信息，pos大小一般比value会小
-				// !!这里注意hint文件不需要记录事务序列号，存储realKey
-				hintRecord := &data.LogRecord{
-					Key:   realKey,
-					Value: data.EncodeLogRecordPos(pos),
-				}
-
-				enc, _ := data.EncodeLogRecord(hintRecord)
-				if err := hintFile.Write(enc); err != nil {
-					return nil
-				}
-			}
-
-			offset += size
+			mergedFileIds = append(mergedFileIds, dataFile.FileId)
+		}
+	} else {
+		if err := db.rewriteFiles(task, mergePath, mergeFiles, hintFile, getMergeFile); err != nil {
+			return err
 		}
 	}
 
@@ -154,34 +201,203 @@ func (db *DB) Merge() error {
 		return err
 	}
 
-	if err := mergeDB.Sync(); err != nil {
-		return nil
-	}
-
 	// 持久化完成后，写记录Merge完成，单独开一个mergeFinished文件
 	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
 	if err != nil {
-		return nil
+		return err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 
 	mergeFinishedRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKey),
+		Key:   []byte(data.MergeFinishedKey),
 		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
 		Type:  0,
 	}
 
-	encRecord, _ := data.EncodeLogRecord(mergeFinishedRecord)
+	encRecord, _, err := data.EncodeLogRecordWithKeys(mergeFinishedRecord, nil, 0, db.keyRing)
+	if err != nil {
+		return err
+	}
 	if err = mergeFinishedFile.Write(encRecord); err != nil {
 		return err
 	}
 
+	if mergedFileIds != nil {
+		ids := make([]string, len(mergedFileIds))
+		for i, fid := range mergedFileIds {
+			ids[i] = strconv.Itoa(int(fid))
+		}
+		mergeFilesRecord := &data.LogRecord{
+			Key:   []byte(data.MergeFilesKey),
+			Value: []byte(strings.Join(ids, ",")),
+		}
+		encRecord, _, err := data.EncodeLogRecordWithKeys(mergeFilesRecord, nil, 0, db.keyRing)
+		if err != nil {
+			return err
+		}
+		if err = mergeFinishedFile.Write(encRecord); err != nil {
+			return err
+		}
+	}
+
 	if err = mergeFinishedFile.Sync(); err != nil {
 		return err
 	}
 
+	// 统计本次merge回收的空间
+	var mergedSize int64
+	for _, file := range mergeFiles {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		mergedSize += size
+	}
+	outputSize, err := utils.DirSize(mergePath)
+	if err != nil {
+		return err
+	}
+
+	// 旧文件以及其中的无效数据在下次启动时才会被替换，在此之前无效数据的统计保持不变
+	db.mu.Lock()
+	db.mergeStat = mergeStat{
+		lastTime:      time.Now(),
+		lastDuration:  time.Since(mergeStart),
+		lastReclaimed: mergedSize - outputSize,
+	}
+	db.mu.Unlock()
+
+	return nil
+}
+
+// rewriteFiles 将所有文件中的有效数据依次写入到merge目录下新的数据文件中，文件id从0开始重新编号
+func (db *DB) rewriteFiles(task *mergeTask, mergePath string, mergeFiles []*data.SegDataFile, hintFile *data.SegDataFile,
+	getMergeFile func(fid uint32) *data.SegDataFile) error {
+	// 重新打开一个bitcask实例去merge
+	mergeOption := db.option
+	mergeOption.DirPath = mergePath
+	mergeOption.SyncWrites = false
+	mergeOption.AutoMergeInterval = 0
+	mergeOption.IndexSnapshot = false
+	// 只需要追加写入数据，使用内存索引即可，B+树索引文件不能被同时打开
+	mergeOption.IndexType = index.BtreeIndex
+	mergeOption.indexPath = ""
+	mergeDB, err := Open(mergeOption)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = mergeDB.Close()
+	}()
+
+	// 遍历处理每个数据文件
+	now := time.Now().UnixNano()
+	for _, dataFile := range mergeFiles {
+		err := db.foreachLiveRecord(task, dataFile, getMergeFile, now, func(realKey []byte, logRecord *data.LogRecord) error {
+			// 重写数据，写入到merge目录中
+			pos, err := mergeDB.appendLogRecord(logRecord)
+			if err != nil {
+				return err
+			}
+			if err := task.written(int64(pos.Size)); err != nil {
+				return err
+			}
+			return db.writeHintRecord(hintFile, realKey, data.LogRecordNormal, pos)
+		}, nil)
+		if err != nil {
+			return err
+		}
+		task.finishFile()
+	}
+
+	return mergeDB.Sync()
+}
+
+// foreachLiveRecord 遍历文件中仍然有效的记录
+// 传给fn的记录已经清除了事务标记，合并记录也已经替换为合并之后的完整值
+// onRemoved不为nil时，对已经被删除或者过期的key的记录调用onRemoved, 同一个key可能被调用多次
+// 每读取一条记录都会通知task, task被取消时返回ctx.Err()
+func (db *DB) foreachLiveRecord(task *mergeTask, dataFile *data.SegDataFile, getMergeFile func(fid uint32) *data.SegDataFile, now int64,
+	fn func(realKey []byte, logRecord *data.LogRecord) error, onRemoved func(realKey []byte) error) error {
+	if err := task.ctx.Err(); err != nil {
+		return err
+	}
+
+	var offset = dataFile.DataOffset()
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			// TailRecoverySkip时保留下来的损坏尾部不会被写入merge之后的文件
+			if err == io.EOF || (db.option.TailRecovery == TailRecoverySkip && isTornRecordErr(err)) {
+				break
+			}
+
+			return err
+		}
+
+		if err := task.advance(size); err != nil {
+			return err
+		}
+
+		realKey, _ := data.DecodeRecordKeyWithSeq(logRecord.Key)
+		logRecordPos := db.index.Get(realKey)
+
+		// 将读取出的数据和内存中的数据比较，如果一致则说明该数据是有效的
+		// 因为内存中的数据是最新的
+		// 如果是事务，那也是已经commit并且成功的事务才会更新到内存中
+		// 已经过期的数据直接丢弃
+		if logRecordPos != nil && logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset &&
+			!logRecordPos.IsExpired(now) {
+			// 清除事务标记，因为都是有效的key
+			logRecord.Key = data.EncodeRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+
+			// 合并记录引用的旧记录不会被保留，需要写入合并之后的完整值
+			if logRecord.Type == data.LogRecordMerge {
+				value, _, err := db.readValue(getMergeFile, logRecordPos)
+				if err != nil {
+					return err
+				}
+				logRecord.Value = value
+				logRecord.Type = data.LogRecordNormal
+			}
+
+			if err := fn(realKey, logRecord); err != nil {
+				return err
+			}
+		} else if onRemoved != nil && logRecord.Type != data.LogRecordTxnFinished &&
+			(logRecordPos == nil || logRecordPos.IsExpired(now)) {
+			// 索引中没有该key或者已经过期，说明最后一条记录是删除记录或者过期的记录
+			if err := onRemoved(realKey); err != nil {
+				return err
+			}
+		}
+
+		offset += size
+	}
+
 	return nil
 }
 
+// writeHintRecord 记录hint文件，其实就是记录索引信息，pos大小一般比value会小
+// !!这里注意hint文件不需要记录事务序列号，存储realKey
+// 配置了密钥时hint文件同样需要加密，否则会泄露key
+// typ为LogRecordDeleted时pos是压缩之后的文件中删除标记的位置
+func (db *DB) writeHintRecord(hintFile *data.SegDataFile, realKey []byte, typ data.LogRecordType, pos *data.LogRecordPos) error {
+	hintRecord := &data.LogRecord{
+		Key:   realKey,
+		Value: data.EncodeLogRecordPos(pos),
+		Type:  typ,
+	}
+
+	enc, _, err := data.EncodeLogRecordWithKeys(hintRecord, nil, 0, db.keyRing)
+	if err != nil {
+		return err
+	}
+	return hintFile.Write(enc)
+}
+
 // needMerge 判断是否需要merge
 func (db *DB) needMerge() (bool, error) {
 	totalSize, err := utils.DirSize(db.option.DirPath)
@@ -220,7 +436,13 @@ func (db *DB) getMergePath() string {
 	dir := filepath.Dir(filepath.Clean(db.option.DirPath))
 	base := filepath.Base(db.option.DirPath)
 
-	return filepath.Join(dir, base+mergeDirName)
+	return filepath.Join(dir, base+data.MergeDirSuffix)
+}
+
+// mergeFinishedExists 判断merge目录中是否有已经完成但还没有加载的merge
+func mergeFinishedExists(mergePath string) bool {
+	_, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName))
+	return err == nil
 }
 
 // 加载merge目录
@@ -230,6 +452,19 @@ func (db *DB) loadMergeFiles() error {
 		return nil
 	}
 
+	// 只读实例打开期间不能替换数据文件，merge目录保留到下次启动时再加载
+	readerLock := flock.New(filepath.Join(db.option.DirPath, readerLockName))
+	hold, err := readerLock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !hold {
+		return nil
+	}
+	defer func() {
+		_ = readerLock.Unlock()
+	}()
+
 	// 加载完成之后删除merge目录
 	defer func() {
 		if err := os.RemoveAll(mergePath); err != nil {
@@ -264,15 +499,35 @@ func (db *DB) loadMergeFiles() error {
 		return nil
 	}
 
-	// 找到最大的没有merge的文件id，将已经merge的文件进行删除
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	// 找到最大的没有merge的文件id以及参与merge的文件，将已经merge的文件进行删除
+	nonMergeFileId, mergedFileIds, err := db.readMergeFinished(mergePath)
 	if err != nil {
 		return err
 	}
 
+	// 替换文件之后索引快照中的位置不再有效，在删除旧文件之前删除快照
+	if err := removeIndexSnapshot(db.option.DirPath); err != nil {
+		return err
+	}
+
+	// 没有记录参与merge的文件，说明是全量merge, 之前的文件都参与了merge
+	if mergedFileIds == nil {
+		for fileId := uint32(0); fileId < nonMergeFileId; fileId++ {
+			mergedFileIds = append(mergedFileIds, fileId)
+		}
+	}
+
+	// B+树索引是持久化的，在替换文件之前先用hint文件更新索引
+	// 更新索引可以重复执行，替换文件的过程中崩溃，下次启动时重新执行即可
+	if db.option.IndexType == index.BPlusTreeIndex {
+		if err := db.applyMergeToBPlusTree(mergePath, mergedFileIds); err != nil {
+			return err
+		}
+	}
+
 	// 删除旧的数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
+	// 旧文件只会在启动时被删除，此时还不存在快照，快照引用的数据文件在运行期间不会被删除
+	for _, fileId := range mergedFileIds {
 		fileName := data.GetDataFileName(db.option.DirPath, fileId)
 		if _, err := os.Stat(fileName); os.IsNotExist(err) {
 			continue
@@ -299,59 +554,99 @@ func (db *DB) loadMergeFiles() error {
 	return nil
 }
 
-// 加载索引文件
-func (db *DB) loadIndexFromHintFile() error {
-	hintFileName := filepath.Join(db.option.DirPath, data.HintFileName)
-	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+// applyMergeToBPlusTree 将hint文件中merge之后的位置写入到B+树索引中
+func (db *DB) applyMergeToBPlusTree(mergePath string, mergedFileIds []uint32) error {
+	bpTree, ok := db.index.(*index.BPlusTree)
+	if !ok {
 		return nil
 	}
 
-	hintFile, err := data.OpenHintFile(db.option.DirPath)
+	hint, err := openHintReader(mergePath, db.keyRing)
 	if err != nil {
 		return err
 	}
+	if hint == nil {
+		return nil
+	}
+	defer func() {
+		_ = hint.close()
+	}()
 
-	// 读取文件中的索引
-	var offset int64 = 0
-	for {
-		logRecord, size, err := hintFile.ReadLogRecord(offset)
-		if err != nil {
-			if err == io.EOF {
-				break
+	merged := make(map[uint32]bool, len(mergedFileIds))
+	for _, fid := range mergedFileIds {
+		merged[fid] = true
+	}
+	isMerged := func(fid uint32) bool {
+		return merged[fid]
+	}
+
+	next := func() ([]byte, *data.LogRecordPos, error) {
+		// B+树索引中已经没有被删除的key, 不需要处理删除标记
+		for hint.pos != nil && hint.typ == data.LogRecordDeleted {
+			if err := hint.next(); err != nil {
+				return nil, nil, err
 			}
-			return err
 		}
-
-		pos := data.DecodeLogRecordPos(logRecord.Value)
-
-		// hint文件中存的是realKey, 不需要处理事务id
-		db.index.Put(logRecord.Key, pos)
-
-		offset += size
+		key, pos := hint.key, hint.pos
+		if pos == nil {
+			return nil, nil, nil
+		}
+		if err := hint.next(); err != nil {
+			return nil, nil, err
+		}
+		return key, pos, nil
 	}
 
-	return nil
+	return bpTree.ReplaceMerged(isMerged, time.Now().UnixNano(), next)
 }
 
-func (db *DB) getNonMergeFileId(mergePath string) (uint32, error) {
+// readMergeFinished 读取merge完成文件，得到最小的没有参与merge的文件id
+// 只合并了部分文件时同时返回参与merge的文件id, 全量merge时返回nil
+func (db *DB) readMergeFinished(mergePath string) (uint32, []uint32, error) {
 	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+	mergeFinishedFile.Keys = db.keyRing
 
-	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	offset := mergeFinishedFile.DataOffset()
+	record, size, err := mergeFinishedFile.ReadLogRecord(offset)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
-	if string(record.Key) != mergeFinishedKey {
-		return 0, err
+	if string(record.Key) != data.MergeFinishedKey {
+		return 0, nil, ErrMergeFinishedCorrupted
 	}
 
 	nonMergeFileId, err := strconv.Atoi(string(record.Value))
 	if err != nil {
-		return 0, err
+		return 0, nil, err
+	}
+
+	// 之前版本的merge_finished文件只有一条记录
+	record, _, err = mergeFinishedFile.ReadLogRecord(offset + size)
+	if err == io.EOF {
+		return uint32(nonMergeFileId), nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if string(record.Key) != data.MergeFilesKey {
+		return 0, nil, ErrMergeFinishedCorrupted
+	}
+
+	mergedFileIds := make([]uint32, 0)
+	for _, s := range strings.Split(string(record.Value), ",") {
+		fid, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, nil, ErrMergeFinishedCorrupted
+		}
+		mergedFileIds = append(mergedFileIds, uint32(fid))
 	}
 
-	return uint32(nonMergeFileId), nil
+	return uint32(nonMergeFileId), mergedFileIds, nil
 }
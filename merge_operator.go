@@ -0,0 +1,304 @@
+package bitcaskKV
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go-bitcask-kv/data"
+	"sort"
+	"strconv"
+)
+
+// 合并操作符，用于原子地修改一个key的值，比如计数器自增、追加写入等
+// 客户端自己Get再Put在并发下会丢失更新，而Apply在db互斥锁中完成读取和写入
+//
+// Apply写入的是类型为LogRecordMerge的记录，只包含操作符名称、操作数以及上一条记录的位置，
+// 读取时沿着链表找到基础值，再按照写入顺序依次应用操作数，
+// 因此重启之后重放日志得到的索引同样能够还原出正确的值。
+// 链表长度超过maxMergeChainDepth时直接写入合并之后的完整值，避免读取时需要访问过多的记录
+
+// MergeOperator 合并操作符
+type MergeOperator interface {
+	// Name 操作符名称，会被写入到日志记录中，重启之后需要注册同名的操作符
+	Name() string
+
+	// Merge 将operand合并到existing上，key不存在时existing为nil
+	Merge(existing []byte, operand []byte) ([]byte, error)
+}
+
+const (
+	// 合并记录链表的最大长度
+	maxMergeChainDepth = 16
+
+	Int64AddOperatorName = "int64add"
+	AppendOperatorName   = "append"
+	MaxOperatorName      = "max"
+	SetUnionOperatorName = "setunion"
+)
+
+// 内置的合并操作符，数值使用十进制字符串表示，和Put写入的数字字符串兼容
+var builtinMergeOperators = []MergeOperator{
+	int64AddOperator{},
+	appendOperator{},
+	maxOperator{},
+	setUnionOperator{},
+}
+
+// int64AddOperator 将操作数加到原来的值上，key不存在时原值视为0
+type int64AddOperator struct{}
+
+func (int64AddOperator) Name() string { return Int64AddOperatorName }
+
+func (int64AddOperator) Merge(existing []byte, operand []byte) ([]byte, error) {
+	base, err := parseInt64Value(existing)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := parseInt64Value(operand)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.FormatInt(base+delta, 10)), nil
+}
+
+// appendOperator 将操作数追加到原来的值后面
+type appendOperator struct{}
+
+func (appendOperator) Name() string { return AppendOperatorName }
+
+func (appendOperator) Merge(existing []byte, operand []byte) ([]byte, error) {
+	value := make([]byte, 0, len(existing)+len(operand))
+	value = append(value, existing...)
+	return append(value, operand...), nil
+}
+
+// maxOperator 保留原来的值和操作数中较大的一个
+type maxOperator struct{}
+
+func (maxOperator) Name() string { return MaxOperatorName }
+
+func (maxOperator) Merge(existing []byte, operand []byte) ([]byte, error) {
+	n, err := parseInt64Value(operand)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return []byte(strconv.FormatInt(n, 10)), nil
+	}
+
+	base, err := parseInt64Value(existing)
+	if err != nil {
+		return nil, err
+	}
+	if n > base {
+		base = n
+	}
+	return []byte(strconv.FormatInt(base, 10)), nil
+}
+
+// setUnionOperator 集合求并集，原值和操作数都使用EncodeSetMembers编码
+type setUnionOperator struct{}
+
+func (setUnionOperator) Name() string { return SetUnionOperatorName }
+
+func (setUnionOperator) Merge(existing []byte, operand []byte) ([]byte, error) {
+	members, err := DecodeSetMembers(existing)
+	if err != nil {
+		return nil, err
+	}
+	added, err := DecodeSetMembers(operand)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeSetMembers(append(members, added...)), nil
+}
+
+// parseInt64Value 解析十进制数值，nil视为0
+func parseInt64Value(value []byte) (int64, error) {
+	if value == nil {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidMergeOperand
+	}
+	return n, nil
+}
+
+// EncodeSetMembers 将集合成员编码为setunion操作符使用的格式
+// 成员排序去重之后依次写入 | size(uvarint) | member |
+func EncodeSetMembers(members [][]byte) []byte {
+	sorted := make([][]byte, len(members))
+	copy(sorted, members)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	var buf []byte
+	var sizeBuf [binary.MaxVarintLen64]byte
+	for i, member := range sorted {
+		if i > 0 && bytes.Equal(member, sorted[i-1]) {
+			continue
+		}
+		n := binary.PutUvarint(sizeBuf[:], uint64(len(member)))
+		buf = append(buf, sizeBuf[:n]...)
+		buf = append(buf, member...)
+	}
+	return buf
+}
+
+// DecodeSetMembers 解析EncodeSetMembers编码的集合成员
+func DecodeSetMembers(buf []byte) ([][]byte, error) {
+	var members [][]byte
+	for len(buf) > 0 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			return nil, ErrInvalidMergeOperand
+		}
+		buf = buf[n:]
+		members = append(members, buf[:size])
+		buf = buf[size:]
+	}
+	return members, nil
+}
+
+// Apply 使用名称为operator的合并操作符将operand原子地合并到key当前的值上，返回合并之后的值
+// 原来的过期时间会被保留，key不存在或者已经过期时按照不存在处理
+func (db *DB) Apply(key []byte, operator string, operand []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	op, ok := db.mergeOperators[operator]
+	if !ok {
+		return nil, ErrMergeOperatorNotFound
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pos := db.getValidPosition(key)
+
+	// 先计算出合并之后的值，操作数不合法时不会写入
+	var existing []byte
+	var depth uint64 = 1
+	if pos != nil {
+		value, prev, err := db.readValue(db.getDataFile, pos)
+		if err != nil {
+			return nil, err
+		}
+		existing = value
+		if prev != nil {
+			depth = prev.Depth + 1
+		}
+	}
+
+	newValue, err := op.Merge(existing, operand)
+	if err != nil {
+		return nil, err
+	}
+
+	var expire int64
+	if pos != nil {
+		expire = pos.Expire
+	}
+
+	// 链表过长，或者上一条记录所在的文件正在被merge重写，直接写入完整的值
+	if depth > maxMergeChainDepth || (pos != nil && pos.Fid < db.mergeBoundary) {
+		if err := db.putRecord(key, newValue, expire); err != nil {
+			return nil, err
+		}
+		return newValue, nil
+	}
+
+	logRecord := &data.LogRecord{
+		Key: data.EncodeRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value: data.EncodeMergeValue(&data.MergeValue{
+			Depth:    depth,
+			Prev:     pos,
+			Operator: operator,
+			Operand:  operand,
+		}),
+		Type:   data.LogRecordMerge,
+		Expire: expire,
+	}
+
+	newPos, err := db.appendLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
+	db.mergeRecordNum[newPos.Fid]++
+
+	// 之前的记录仍然会被读取，但是merge时只会写入合并之后的值，因此同样计入可回收空间
+	if oldValue, _ := db.index.Put(key, newPos); oldValue != nil {
+		db.markGarbage(oldValue)
+	}
+
+	return newValue, nil
+}
+
+// readValue 根据位置信息读取value
+// 如果是合并记录，沿着链表找到基础值，再按照写入顺序依次应用操作数，
+// 同时返回位置信息对应的合并记录，普通记录返回nil
+func (db *DB) readValue(getFile func(fid uint32) *data.SegDataFile, pos *data.LogRecordPos) ([]byte, *data.MergeValue, error) {
+	var chain []*data.MergeValue
+	var value []byte
+
+	for cur := pos; cur != nil; {
+		dataFile := getFile(cur.Fid)
+		if dataFile == nil {
+			return nil, nil, ErrDataFileNotFound
+		}
+
+		logRecord, _, err := dataFile.ReadLogRecord(cur.Offset)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if logRecord.Type == data.LogRecordDeleted {
+			return nil, nil, ErrKeyNotFound
+		}
+
+		if logRecord.Type != data.LogRecordMerge {
+			value = logRecord.Value
+			break
+		}
+
+		mv, err := data.DecodeMergeValue(logRecord.Value)
+		if err != nil {
+			return nil, nil, ErrInvalidMergeOperand
+		}
+		chain = append(chain, mv)
+		cur = mv.Prev
+	}
+
+	// 从最早的操作数开始应用
+	for i := len(chain) - 1; i >= 0; i-- {
+		op, ok := db.mergeOperators[chain[i].Operator]
+		if !ok {
+			return nil, nil, ErrMergeOperatorNotFound
+		}
+
+		merged, err := op.Merge(value, chain[i].Operand)
+		if err != nil {
+			return nil, nil, err
+		}
+		value = merged
+	}
+
+	if len(chain) == 0 {
+		return value, nil, nil
+	}
+	return value, chain[0], nil
+}
+
+// newMergeOperators 注册内置的合并操作符以及配置项中的自定义操作符，同名的自定义操作符会覆盖内置的
+func newMergeOperators(custom []MergeOperator) map[string]MergeOperator {
+	operators := make(map[string]MergeOperator, len(builtinMergeOperators)+len(custom))
+	for _, op := range builtinMergeOperators {
+		operators[op.Name()] = op
+	}
+	for _, op := range custom {
+		operators[op.Name()] = op
+	}
+	return operators
+}
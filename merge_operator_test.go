@@ -0,0 +1,202 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDB_Apply(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-apply")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// key不存在时原值视为空
+	val, err := db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("5"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("5"), val)
+	val, err = db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("-7"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("-2"), val)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("-2"), val)
+
+	// 操作数不合法时不会写入
+	_, err = db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("abc"))
+	assert.Equal(t, ErrInvalidMergeOperand, err)
+	_, err = db.Apply(utils.GetTestKey(1), "unknown", []byte("1"))
+	assert.Equal(t, ErrMergeOperatorNotFound, err)
+
+	err = db.Put(utils.GetTestKey(2), []byte("hello"))
+	assert.Nil(t, err)
+	val, err = db.Apply(utils.GetTestKey(2), AppendOperatorName, []byte(" world"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), val)
+
+	_, err = db.Apply(utils.GetTestKey(3), MaxOperatorName, []byte("10"))
+	assert.Nil(t, err)
+	_, err = db.Apply(utils.GetTestKey(3), MaxOperatorName, []byte("3"))
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), val)
+
+	_, err = db.Apply(utils.GetTestKey(4), SetUnionOperatorName, EncodeSetMembers([][]byte{[]byte("b"), []byte("a")}))
+	assert.Nil(t, err)
+	_, err = db.Apply(utils.GetTestKey(4), SetUnionOperatorName, EncodeSetMembers([][]byte{[]byte("c"), []byte("a")}))
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	members, err := DecodeSetMembers(val)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, members)
+
+	// 删除之后重新开始计数
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val, err = db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+}
+
+func TestDB_Apply_Concurrent(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-apply-concurrent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("1"))
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1000"), val)
+}
+
+func TestDB_Apply_Restart(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-apply-restart")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 超过链表最大长度以及跨多个数据文件
+	for i := 0; i < 1000; i++ {
+		_, err := db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("2"))
+		assert.Nil(t, err)
+		_, err = db.Apply(utils.GetTestKey(2), AppendOperatorName, []byte("x"))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(i+10), utils.GetTestRandomValue(16))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(strconv.Itoa(2000)), val)
+	val, err = db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(val))
+}
+
+func TestDB_Apply_Merge(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-apply-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		_, err := db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("1"))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(i+10), utils.GetTestRandomValue(16))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, db.Merge())
+
+	// merge之后的写入不能引用被重写的文件中的记录
+	for i := 0; i < 10; i++ {
+		_, err := db.Apply(utils.GetTestKey(1), Int64AddOperatorName, []byte("1"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("510"), val)
+}
+
+func TestDB_Apply_CustomOperator(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-apply-custom")
+	opts.DirPath = dir
+	opts.MergeOperators = []MergeOperator{upperCaseOperator{}}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	val, err := db.Apply(utils.GetTestKey(1), "upper", []byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ABC"), val)
+
+	// 快照中读取到的是创建时的值
+	snap := db.Snapshot()
+	defer snap.Release()
+	_, err = db.Apply(utils.GetTestKey(1), "upper", []byte("def"))
+	assert.Nil(t, err)
+
+	val, err = snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ABC"), val)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ABCDEF"), val)
+}
+
+type upperCaseOperator struct{}
+
+func (upperCaseOperator) Name() string { return "upper" }
+
+func (upperCaseOperator) Merge(existing []byte, operand []byte) ([]byte, error) {
+	value := append([]byte{}, existing...)
+	for _, b := range operand {
+		if b >= 'a' && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+		value = append(value, b)
+	}
+	return value, nil
+}
@@ -0,0 +1,92 @@
+package bitcaskKV
+
+import (
+	"context"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/utils"
+)
+
+// 每读取这么多字节汇报一次进度，并检查merge是否被取消
+const mergeProgressInterval = 1024 * 1024
+
+// MergeProgress merge的执行进度
+type MergeProgress struct {
+	// 参与merge的文件数量
+	TotalFiles int
+
+	// 已经处理完的文件数量
+	FilesProcessed int
+
+	// 参与merge的文件中记录的总大小，不包括文件头
+	TotalBytes int64
+
+	// 已经读取的字节数
+	BytesProcessed int64
+}
+
+// mergeTask 一次merge的执行状态，用于取消merge以及汇报进度
+type mergeTask struct {
+	ctx      context.Context
+	progress func(MergeProgress)
+	stat     MergeProgress
+
+	// 限制merge读写的速度
+	limiter *utils.RateLimiter
+
+	// 上次汇报进度时已经读取的字节数
+	reported int64
+}
+
+func newMergeTask(ctx context.Context, mergeFiles []*data.SegDataFile, progress func(MergeProgress),
+	limiter *utils.RateLimiter) (*mergeTask, error) {
+	task := &mergeTask{
+		ctx:      ctx,
+		progress: progress,
+		stat:     MergeProgress{TotalFiles: len(mergeFiles)},
+		limiter:  limiter,
+	}
+
+	for _, file := range mergeFiles {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		task.stat.TotalBytes += size - file.DataOffset()
+	}
+
+	task.report()
+	return task, nil
+}
+
+// advance 读取了n个字节，累积到一定大小之后汇报进度并检查是否被取消
+func (t *mergeTask) advance(n int64) error {
+	if err := t.limiter.Wait(t.ctx, n); err != nil {
+		return err
+	}
+	t.stat.BytesProcessed += n
+	if t.stat.BytesProcessed-t.reported < mergeProgressInterval {
+		return nil
+	}
+
+	t.reported = t.stat.BytesProcessed
+	t.report()
+	return t.ctx.Err()
+}
+
+// written 写入了n个字节，等待限速时merge被取消返回ctx.Err()
+func (t *mergeTask) written(n int64) error {
+	return t.limiter.Wait(t.ctx, n)
+}
+
+// finishFile 处理完一个文件
+func (t *mergeTask) finishFile() {
+	t.stat.FilesProcessed++
+	t.reported = t.stat.BytesProcessed
+	t.report()
+}
+
+func (t *mergeTask) report() {
+	if t.progress != nil {
+		t.progress(t.stat)
+	}
+}
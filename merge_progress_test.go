@@ -0,0 +1,110 @@
+package bitcaskKV
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+// 写入数据并删除一半，达到merge条件
+func openMergeTestDB(t *testing.T, name string) (*DB, Option) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", name)
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	return db, opts
+}
+
+func TestDB_MergeWithContext_Progress(t *testing.T) {
+	db, _ := openMergeTestDB(t, "bitcask-merge-progress")
+	defer destroyDB(db)
+
+	var reports []MergeProgress
+	err := db.MergeWithContext(context.Background(), func(p MergeProgress) {
+		reports = append(reports, p)
+	})
+	assert.Nil(t, err)
+	assert.True(t, len(reports) > 2)
+
+	first, last := reports[0], reports[len(reports)-1]
+	assert.Equal(t, 0, first.FilesProcessed)
+	assert.Equal(t, int64(0), first.BytesProcessed)
+	assert.True(t, last.TotalFiles > 1)
+	assert.Equal(t, last.TotalFiles, last.FilesProcessed)
+	assert.Equal(t, last.TotalBytes, last.BytesProcessed)
+	for i := 1; i < len(reports); i++ {
+		assert.True(t, reports[i].BytesProcessed >= reports[i-1].BytesProcessed)
+	}
+}
+
+func TestDB_MergeWithContext_Cancel(t *testing.T) {
+	db, opts := openMergeTestDB(t, "bitcask-merge-cancel")
+	defer destroyDB(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := db.MergeWithContext(ctx, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	// 取消之后merge目录被删除，可以再次merge
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Merge())
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, 1000, db2.index.Size())
+}
+
+func TestDB_Close_AbortMerge(t *testing.T) {
+	db, opts := openMergeTestDB(t, "bitcask-merge-close")
+	defer func() {
+		_ = os.RemoveAll(opts.DirPath)
+	}()
+
+	started := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- db.MergeWithContext(context.Background(), func(p MergeProgress) {
+			if p.FilesProcessed == 0 && p.BytesProcessed == 0 {
+				close(started)
+			}
+			time.Sleep(10 * time.Millisecond)
+		})
+	}()
+
+	<-started
+	assert.Nil(t, db.Close())
+	assert.Equal(t, context.Canceled, <-errCh)
+
+	_, err := os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, ErrDatabaseIsClosed, db.Merge())
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 1000, db2.index.Size())
+	for i := 1000; i < 2000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
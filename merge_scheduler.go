@@ -0,0 +1,86 @@
+package bitcaskKV
+
+import (
+	"sync"
+	"time"
+)
+
+// mergeScheduler 后台定期检查是否需要merge, 满足条件并且在允许的时间窗口内时执行merge
+type mergeScheduler struct {
+	db *DB
+
+	closeCh chan struct{}
+	wg      *sync.WaitGroup
+	once    *sync.Once
+}
+
+// mergeStat 最近一次merge的统计信息
+type mergeStat struct {
+	lastTime      time.Time
+	lastDuration  time.Duration
+	lastReclaimed int64
+}
+
+func newMergeScheduler(db *DB) *mergeScheduler {
+	return &mergeScheduler{
+		db:      db,
+		closeCh: make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+		once:    new(sync.Once),
+	}
+}
+
+func (s *mergeScheduler) start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// stop 通知后台协程退出，并等待正在执行的merge完成
+func (s *mergeScheduler) stop() {
+	s.once.Do(func() {
+		close(s.closeCh)
+	})
+	s.wg.Wait()
+}
+
+func (s *mergeScheduler) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.db.option.AutoMergeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case now := <-ticker.C:
+			if !s.db.option.inMergeWindow(now) {
+				continue
+			}
+
+			// 未达到merge条件或者已经有merge在执行都直接等待下一个周期
+			// merge之后的文件在下次启动时才会替换旧文件，在此之前无法再次merge, 停止自动merge
+			// 通过Stat().MergePending可以知道需要重启
+			if err := s.db.Merge(); err == nil || err == ErrMergeNotApplied {
+				return
+			}
+		}
+	}
+}
+
+// inMergeWindow 判断t是否在允许自动merge的时间窗口内
+func (option Option) inMergeWindow(t time.Time) bool {
+	start, end := option.AutoMergeWindowStart, option.AutoMergeWindowEnd
+	if start == end {
+		return true
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	// 开始时间大于结束时间表示窗口跨越零点
+	if start < end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
@@ -0,0 +1,96 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOption_InMergeWindow(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2023, 11, 1, hour, min, 0, 0, time.Local)
+	}
+
+	// 不限制
+	opts := DefaultOption
+	assert.True(t, opts.inMergeWindow(at(12, 0)))
+
+	// 02:00 - 06:00
+	opts.AutoMergeWindowStart = 2 * time.Hour
+	opts.AutoMergeWindowEnd = 6 * time.Hour
+	assert.True(t, opts.inMergeWindow(at(2, 0)))
+	assert.True(t, opts.inMergeWindow(at(5, 59)))
+	assert.False(t, opts.inMergeWindow(at(6, 0)))
+	assert.False(t, opts.inMergeWindow(at(1, 59)))
+
+	// 22:00 - 06:00, 跨越零点
+	opts.AutoMergeWindowStart = 22 * time.Hour
+	assert.True(t, opts.inMergeWindow(at(23, 30)))
+	assert.True(t, opts.inMergeWindow(at(0, 30)))
+	assert.False(t, opts.inMergeWindow(at(12, 0)))
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-auto-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	opts.mergeRatioThr = 0.3
+	opts.AutoMergeInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 没有无效数据时不会merge
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(64))
+		assert.Nil(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, db.Stat().LastMergeTime.IsZero())
+
+	// 覆盖写入产生无效数据
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(64))
+		assert.Nil(t, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stat().LastMergeTime.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stat := db.Stat()
+	assert.False(t, stat.LastMergeTime.IsZero())
+	assert.True(t, stat.LastMergeDuration > 0)
+	assert.True(t, stat.LastMergeReclaimed > 0)
+	assert.True(t, stat.MergePending)
+
+	// merge之后的文件等待重启时替换，后台协程不再重复merge
+	exited := make(chan struct{})
+	go func() {
+		db.mergeScheduler.wg.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("merge scheduler did not stop after merge")
+	}
+	assert.Equal(t, stat.LastMergeTime, db.Stat().LastMergeTime)
+	assert.Nil(t, db.Close())
+
+	// 重启之后加载merge之后的文件
+	opts.AutoMergeInterval = 0
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1000), db2.Stat().KeyNum)
+	for i := 0; i < 1000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
@@ -2,6 +2,7 @@ package bitcaskKV
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/index"
 	"go-bitcask-kv/utils"
 	"os"
 	"sync"
@@ -213,3 +214,117 @@ func TestDB_Merge4(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+// 测试使用B+树索引时merge之后持久化索引同样被更新
+func TestDB_Merge_BPlusTree(t *testing.T) {
+	for _, ratio := range []float32{0, 0.3} {
+		opts := DefaultOption
+		dir, _ := os.MkdirTemp("", "bitcask-merge-bptree")
+		opts.DirPath = dir
+		opts.IndexType = index.BPlusTreeIndex
+		opts.indexPath = dir
+		opts.DataFileSize = 32 * 1024
+		opts.mergeMinSizeThr = 0
+		opts.mergeRatioThr = 0.01
+		opts.MergeFileGarbageRatio = ratio
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		values := make(map[int][]byte)
+		for i := 0; i < 2000; i++ {
+			values[i] = utils.GetTestRandomValue(128)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+		for i := 0; i < 500; i++ {
+			values[i] = utils.GetTestRandomValue(128)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+		for i := 500; i < 1000; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, i)
+		}
+		assert.Nil(t, db.PutWithTTL([]byte("expired"), []byte("value"), 10*time.Millisecond))
+		time.Sleep(20 * time.Millisecond)
+
+		assert.Nil(t, db.Merge())
+
+		// merge之后写入和删除的数据不会被覆盖
+		for i := 1000; i < 1100; i++ {
+			values[i] = utils.GetTestRandomValue(128)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+		for i := 1100; i < 1200; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, i)
+		}
+		assert.Nil(t, db.Close())
+
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		check := func(db *DB) {
+			assert.Equal(t, len(values), db.index.Size())
+			for i, value := range values {
+				val, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, value, val)
+			}
+		}
+		check(db2)
+
+		// 重启之后继续写入
+		for i := 5000; i < 5100; i++ {
+			values[i] = utils.GetTestRandomValue(128)
+			assert.Nil(t, db2.Put(utils.GetTestKey(i), values[i]))
+		}
+		check(db2)
+		assert.Nil(t, db2.Close())
+
+		db3, err := Open(opts)
+		assert.Nil(t, err)
+		check(db3)
+		destroyDB(db3)
+	}
+}
+
+func TestDB_Merge_NotApplied(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-merge-not-applied")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.False(t, db.Stat().MergePending)
+	recycleSize := db.Stat().RecycleSize
+	assert.Nil(t, db.Merge())
+
+	// 旧文件在重启之前仍然保留，无效数据的统计不变
+	stat := db.Stat()
+	assert.True(t, stat.MergePending)
+	assert.Equal(t, recycleSize, stat.RecycleSize)
+
+	// 之前的merge还没有在启动时加载，再次merge不会删除merge目录
+	for i := 500; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+	assert.Equal(t, ErrMergeNotApplied, db.Merge())
+	_, err = os.Stat(db.getMergePath())
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// 重启加载之后可以继续merge
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 500, len(db.ListKeys()))
+	assert.False(t, db.Stat().MergePending)
+	assert.Nil(t, db.Merge())
+}
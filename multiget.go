@@ -0,0 +1,115 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"sort"
+	"time"
+)
+
+const (
+	// 两条记录之间的间隔不超过该值时合并为一次读取
+	multiGetMaxGap = 4 * 1024
+
+	// 合并之后单次读取的最大字节数
+	multiGetMaxReadSize = 1024 * 1024
+)
+
+// multiGetItem 一个需要读取的key
+type multiGetItem struct {
+	idx int
+	pos *data.LogRecordPos
+}
+
+// MultiGet 批量读取多个key, 返回的values和errs与keys一一对应
+// 所有key的位置信息在一次加锁中获取，之后按照文件分组、按照偏移排序，相邻的记录合并为一次读取
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// 按照文件id对需要读取的记录分组
+	now := time.Now().UnixNano()
+	groups := make(map[uint32][]*multiGetItem)
+	for i, key := range keys {
+		if len(key) == 0 {
+			errs[i] = ErrKeyIsEmpty
+			continue
+		}
+
+		pos := db.index.Get(key)
+		if pos == nil || pos.IsExpired(now) {
+			errs[i] = ErrKeyNotFound
+			continue
+		}
+		groups[pos.Fid] = append(groups[pos.Fid], &multiGetItem{idx: i, pos: pos})
+	}
+
+	for fid, items := range groups {
+		dataFile := db.getDataFile(fid)
+		if dataFile == nil {
+			for _, item := range items {
+				errs[item.idx] = ErrDataFileNotFound
+			}
+			continue
+		}
+
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].pos.Offset < items[j].pos.Offset
+		})
+
+		// 每次取出一段可以合并读取的记录
+		for start := 0; start < len(items); {
+			end := start + 1
+			rangeEnd := items[start].pos.Offset + int64(items[start].pos.Size)
+			for ; end < len(items); end++ {
+				pos := items[end].pos
+				if pos.Offset > rangeEnd+multiGetMaxGap ||
+					pos.Offset+int64(pos.Size)-items[start].pos.Offset > multiGetMaxReadSize {
+					break
+				}
+				if pos.Offset+int64(pos.Size) > rangeEnd {
+					rangeEnd = pos.Offset + int64(pos.Size)
+				}
+			}
+
+			db.readCoalesced(dataFile, items[start:end], rangeEnd, values, errs)
+			start = end
+		}
+	}
+
+	return values, errs
+}
+
+// readCoalesced 一次读取items覆盖的范围，再从中解析出每一条记录
+func (db *DB) readCoalesced(dataFile *data.SegDataFile, items []*multiGetItem, rangeEnd int64,
+	values [][]byte, errs []error) {
+	rangeStart := items[0].pos.Offset
+	buf, err := dataFile.ReadRange(rangeStart, rangeEnd-rangeStart)
+	if err != nil {
+		for _, item := range items {
+			errs[item.idx] = err
+		}
+		return
+	}
+
+	for _, item := range items {
+		off := item.pos.Offset - rangeStart
+		logRecord, _, err := data.DecodeLogRecordBufWithKeys(buf[off:off+int64(item.pos.Size)], db.keyRing, db.compressors)
+		if err != nil {
+			errs[item.idx] = err
+			continue
+		}
+
+		switch logRecord.Type {
+		case data.LogRecordDeleted:
+			errs[item.idx] = ErrKeyNotFound
+		case data.LogRecordMerge:
+			// 合并记录需要沿着链表读取基础值
+			values[item.idx], errs[item.idx] = db.getValueByPosition(item.pos)
+		default:
+			values[item.idx] = logRecord.Value
+		}
+	}
+}
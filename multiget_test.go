@@ -0,0 +1,60 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_MultiGet(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-multi-get")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 写入的数据分布在多个文件中
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 2000; i += 3 {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(32))
+		assert.Nil(t, err)
+	}
+	assert.True(t, db.Stat().DataFilNum > 1)
+
+	err = db.Delete(utils.GetTestKey(5))
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(6), []byte("expired"), time.Millisecond)
+	assert.Nil(t, err)
+	_, err = db.Apply(utils.GetTestKey(7), AppendOperatorName, []byte("-suffix"))
+	assert.Nil(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	var keys [][]byte
+	for i := 2100; i >= 0; i -= 7 {
+		keys = append(keys, utils.GetTestKey(i))
+	}
+	keys = append(keys, nil, utils.GetTestKey(5), utils.GetTestKey(6), utils.GetTestKey(7), utils.GetTestKey(14))
+
+	values, errs := db.MultiGet(keys)
+	assert.Equal(t, len(keys), len(values))
+	assert.Equal(t, len(keys), len(errs))
+
+	for i, key := range keys {
+		if len(key) == 0 {
+			assert.Equal(t, ErrKeyIsEmpty, errs[i])
+			continue
+		}
+
+		expected, err := db.Get(key)
+		assert.Equal(t, err, errs[i])
+		assert.Equal(t, expected, values[i])
+	}
+}
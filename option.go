@@ -1,12 +1,17 @@
 package bitcaskKV
 
 import (
+	"go-bitcask-kv/data"
 	"go-bitcask-kv/index"
 	"os"
+	"time"
 )
 
 const (
 	fileLockName = "flock"
+
+	// 只读实例持有该文件的共享锁，写入进程在启动时替换merge之后的文件前需要获取排他锁
+	readerLockName = "flock_reader"
 )
 
 // Option 存储引擎配置项
@@ -31,7 +36,7 @@ type Option struct {
 	// 索引类型
 	IndexType index.IndexerType
 
-	// 持久化索引存放路径，主要针对B+Tree，暂时不做实现
+	// 持久化索引存放路径，主要针对B+Tree，为空时使用DirPath
 	indexPath string
 
 	// merge空间最多占用剩余空间系数
@@ -45,15 +50,93 @@ type Option struct {
 
 	// merge操作 最大大小阈值
 	mergeMaxSizeThr uint32
+
+	// 单个文件无效数据占比达到该值时才参与merge, 参与merge的文件原地压缩，其他文件保持不变
+	// 0表示每次merge都重写所有的文件
+	MergeFileGarbageRatio float32
+
+	// merge每秒最多读写的字节数，0表示不限速
+	MergeRateLimit int64
+
+	// 备份每秒最多拷贝的字节数，0表示不限速
+	BackupRateLimit int64
+
+	// 写入记录时使用的压缩算法，nil表示不压缩，读取时根据记录中的算法编号解压，
+	// 因此可以随时修改配置，之前使用内置算法写入的记录仍然可以读取，自定义的算法只在当前DB中生效，读取时需要配置同样的算法
+	Compressor data.Compressor
+
+	// value达到该大小时才进行压缩
+	CompressMinSize int
+
+	// 加密数据文件、hint文件以及merge完成文件使用的AES密钥，长度为16、24或32字节，nil表示不加密
+	// 只加密写入文件的记录，B+树索引文件中的key不会加密
+	EncryptionKey []byte
+
+	// 当前密钥的编号，写入到每条加密的记录中
+	EncryptionKeyId uint32
+
+	// 之前使用过的密钥，用于读取密钥轮换之前写入的记录，key为密钥编号
+	// merge时会使用当前密钥重新加密这些记录，merge完成之后就可以不再提供旧的密钥
+	OldEncryptionKeys map[uint32][]byte
+
+	// 关闭数据库时将内存索引写入快照文件，下次启动时只需要加载快照之后写入的数据，B+树索引不需要快照
+	// 默认关闭，快照文件的大小和内存索引相当
+	IndexSnapshot bool
+
+	// 定期写入索引快照的间隔，0表示只在关闭时写入，需要同时开启IndexSnapshot
+	IndexSnapshotInterval time.Duration
+
+	// 启动时并发扫描数据文件加载索引的协程数量，0表示使用CPU核数，1表示依次扫描每个文件
+	IndexLoadParallelism int
+
+	// 启动时数据文件末尾有不完整或者损坏的记录时的处理方式，默认截断
+	TailRecovery TailRecoveryMode
+
+	// 以只读方式打开，可以和写入进程以及其他只读实例同时打开同一个目录
+	// 不会创建active文件以及merge目录，写入以及merge操作返回ErrReadOnly，不支持B+树索引
+	ReadOnly bool
+
+	// 只读模式下后台自动刷新的间隔，加载写入进程之后追加的数据，0表示只在调用Refresh时刷新
+	RefreshInterval time.Duration
+
+	// 自定义的合并操作符，和内置操作符同名时会覆盖内置的
+	MergeOperators []MergeOperator
+
+	// 后台自动merge的检查间隔，0表示不开启自动merge
+	// merge之后的文件在下次启动时才会生效，因此每次启动最多自动merge一次
+	AutoMergeInterval time.Duration
+
+	// 允许自动merge的时间窗口，为距离当天零点的时长，开始和结束相同表示不限制
+	// 开始大于结束时表示窗口跨越零点，比如22:00到次日06:00
+	AutoMergeWindowStart time.Duration
+	AutoMergeWindowEnd   time.Duration
 }
 
 // IteratorOption 指定迭代器配置项
 type IteratorOption struct {
-	// 指定前缀匹配
-	prefix []byte
+	// 指定前缀匹配，为空表示不进行前缀匹配
+	Prefix []byte
 
 	// 反转
-	reverse bool
+	Reverse bool
+
+	// 范围下界，为nil表示没有下界，默认包含下界
+	LowerBound []byte
+
+	// 为true时不包含下界
+	LowerBoundExclusive bool
+
+	// 范围上界，为nil表示没有上界，默认不包含上界
+	UpperBound []byte
+
+	// 为true时包含上界
+	UpperBoundInclusive bool
+
+	// 只遍历key, 不读取value
+	KeysOnly bool
+
+	// 每次Rewind或者Seek之后最多遍历的key数量，0表示不限制
+	Limit int
 }
 
 // WriteBatchOption Batch配置项
@@ -95,8 +178,8 @@ var DefaultOption = Option{
 }
 
 var DefaultIteratorOption = IteratorOption{
-	prefix:  nil,
-	reverse: false,
+	Prefix:  nil,
+	Reverse: false,
 }
 
 var DefaultWriteBachOption = WriteBatchOption{
@@ -0,0 +1,73 @@
+package bitcaskKV
+
+import (
+	"bytes"
+	"go-bitcask-kv/data"
+	"time"
+)
+
+// 范围删除，所有匹配的key的墓碑和WriteBatch一样在同一个事务中提交
+// 重启时只有读取到事务完成标记才会生效，因此不会出现只删除了一部分的情况
+// 删除的key数量不受WriteBatch的maxBatchNum限制，所有墓碑使用同一个事务id，只写入一条事务完成标记
+
+// DeleteRange 原子地删除[start, end)范围内的所有key, 返回删除的key数量
+// start为nil表示从第一个key开始，end为nil表示没有上界
+func (db *DB) DeleteRange(start []byte, end []byte) (int, error) {
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, nil
+	}
+
+	return db.deleteMatched(start, func(key []byte) bool {
+		return end == nil || bytes.Compare(key, end) < 0
+	})
+}
+
+// DeletePrefix 原子地删除所有以prefix为前缀的key, 返回删除的key数量
+func (db *DB) DeletePrefix(prefix []byte) (int, error) {
+	if len(prefix) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+
+	return db.deleteMatched(prefix, func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	})
+}
+
+// deleteMatched 从start开始顺序遍历索引，删除所有满足inRange的key，遇到第一个不满足的key时停止
+func (db *DB) deleteMatched(start []byte, inRange func(key []byte) bool) (int, error) {
+	if db.option.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	records := make(map[string]*data.LogRecord)
+	var count int
+
+	// 先收集需要删除的key，提交时会修改索引，不能边遍历边删除
+	now := time.Now().UnixNano()
+	it := db.index.Iterator(false)
+	for it.Seek(start); it.Valid() && inRange(it.Key()); it.Next() {
+		key := it.Key()
+		records[string(key)] = &data.LogRecord{
+			Key:  key,
+			Type: data.LogRecordDeleted,
+		}
+
+		// 已经过期的key同样写入墓碑，但不计入删除数量
+		if !it.Value().IsExpired(now) {
+			count++
+		}
+	}
+	it.Close()
+
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	if err := db.commitRecords(records, db.option.SyncWrites); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,127 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_DeleteRange(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-delete-range")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(16))
+		assert.Nil(t, err)
+	}
+
+	// 范围为空
+	n, err := db.DeleteRange(utils.GetTestKey(20), utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// [10, 20)
+	n, err = db.DeleteRange(utils.GetTestKey(10), utils.GetTestKey(20))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	for i := 0; i < 100; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		if i >= 10 && i < 20 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, uint32(90), db.Stat().KeyNum)
+
+	// 没有上界
+	n, err = db.DeleteRange(utils.GetTestKey(90), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, uint32(80), db.Stat().KeyNum)
+	assert.Nil(t, db.Close())
+
+	// 重启之后仍然是删除的状态
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(80), db2.Stat().KeyNum)
+	_, err = db2.Get(utils.GetTestKey(15))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db2.Get(utils.GetTestKey(95))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db2.Get(utils.GetTestKey(20))
+	assert.Nil(t, err)
+}
+
+func TestDB_DeletePrefix(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-delete-prefix")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	_, err = db.DeletePrefix(nil)
+	assert.Equal(t, ErrKeyIsEmpty, err)
+
+	for _, key := range []string{"tenant1:a", "tenant1:b", "tenant1:c", "tenant10:a", "tenant2:a"} {
+		err := db.Put([]byte(key), []byte("value"))
+		assert.Nil(t, err)
+	}
+
+	n, err := db.DeletePrefix([]byte("tenant1:"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	keys := db.ListKeys()
+	assert.Equal(t, [][]byte{[]byte("tenant10:a"), []byte("tenant2:a")}, keys)
+
+	n, err = db.DeletePrefix([]byte("tenant3:"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// 删除的记录都可以回收
+	assert.True(t, db.Stat().RecycleSize > 0)
+}
+
+func TestDB_DeleteRange_Large(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-delete-range-large")
+	opts.DirPath = dir
+	// 墓碑跨越多个数据文件，重启时并发扫描数据文件重建索引
+	opts.DataFileSize = 64 * 1024
+	opts.IndexSnapshot = false
+	opts.IndexLoadParallelism = 4
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	num := DefaultWriteBachOption.maxBatchNum * 5
+	for i := 0; i < num; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(16))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Put([]byte("other"), []byte("value")))
+
+	n, err := db.DeletePrefix([]byte("bitcask-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, num, n)
+	assert.Equal(t, uint32(1), db.Stat().KeyNum)
+	assert.True(t, len(db.olderFiles) > 1)
+	assert.Nil(t, db.Close())
+
+	// 重启之后所有key仍然是删除的状态
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("other")}, db2.ListKeys())
+	_, err = db2.Get(utils.GetTestKey(num - 1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
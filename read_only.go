@@ -0,0 +1,162 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/fio"
+	"sync"
+	"time"
+)
+
+// 只读模式可以和写入进程同时打开同一个目录，写入进程持有flock的排他锁，只读实例持有flock_reader的共享锁
+// 写入进程运行期间只会追加写入active文件以及创建新的数据文件，只读实例通过Refresh加载这些新写入的数据
+// merge之后的文件在写入进程启动时才会替换旧文件，此时需要获取flock_reader的排他锁，有只读实例打开时推迟到下次启动
+
+// fileIOType 加载完成之后读写数据文件使用的IO类型
+func (db *DB) fileIOType() fio.IOType {
+	if db.option.ReadOnly {
+		return fio.ReadOnlyIO
+	}
+	return fio.StandardIO
+}
+
+// Refresh 只读模式下加载写入进程在打开或者上次刷新之后写入的数据，包括active文件中追加的记录以及新创建的数据文件
+// 写入进程正在提交的事务在读取到完成标识之后才会生效，非只读模式下内存索引始终是最新的，直接返回nil
+func (db *DB) Refresh() error {
+	if !db.option.ReadOnly {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.isClosed {
+		return ErrDatabaseIsClosed
+	}
+
+	// 必须先找出新的文件再扫描active文件，新文件创建之前写入进程已经写完了之前的文件
+	newFiles, err := db.openNewDataFiles()
+	if err != nil {
+		return err
+	}
+
+	var jobs []fileScanJob
+	if db.activeFile != nil {
+		jobs = append(jobs, fileScanJob{file: db.activeFile, offset: db.activeFile.WriteOff})
+	}
+	for _, dataFile := range newFiles {
+		jobs = append(jobs, fileScanJob{file: dataFile, offset: dataFile.DataOffset()})
+	}
+
+	// 所有文件都扫描成功之后再更新索引，失败时保持刷新之前的状态
+	scans := make([]*fileScan, len(jobs))
+	scanner := startFileScanner(jobs, db.option.IndexLoadParallelism)
+	for i := range jobs {
+		scans[i] = scanner.result(i)
+	}
+	scanner.stop()
+	for _, scan := range scans {
+		if scan.err != nil {
+			for _, dataFile := range newFiles {
+				_ = dataFile.Close()
+			}
+			return scan.err
+		}
+	}
+
+	// 文件末尾不完整的记录可能正在被写入，下次刷新时从最后一条完整记录之后继续读取
+	loader := newIndexLoader(db, time.Now().UnixNano(), db.pendingTxnRecords, db.seqNo)
+	for i, job := range jobs {
+		loader.apply(job.file.FileId, scans[i].records)
+		job.file.WriteOff = scans[i].validEnd
+	}
+	db.seqNo = loader.seqNo
+	db.pendingTxnRecords = loader.txnRecords
+
+	// 最后一个新文件成为active文件
+	for _, dataFile := range newFiles {
+		if db.activeFile != nil {
+			db.olderFiles[db.activeFile.FileId] = db.activeFile
+		}
+		db.activeFile = dataFile
+		db.fileIds = append(db.fileIds, int(dataFile.FileId))
+	}
+	return nil
+}
+
+// openNewDataFiles 打开写入进程在已经加载的文件之后创建的数据文件
+func (db *DB) openNewDataFiles() ([]*data.SegDataFile, error) {
+	fileIds, err := listDataFileIds(db.option.DirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var newFiles []*data.SegDataFile
+	for _, fid := range fileIds {
+		if db.activeFile != nil && uint32(fid) <= db.activeFile.FileId {
+			continue
+		}
+
+		dataFile, err := data.OpenDataFileReadOnly(db.option.DirPath, uint32(fid), fio.ReadOnlyIO)
+		if err == data.ErrFileHeaderIncomplete {
+			// 写入进程刚刚创建的文件，该文件以及之后的文件在下次刷新时再加载
+			break
+		}
+		if err != nil {
+			for _, file := range newFiles {
+				_ = file.Close()
+			}
+			return nil, err
+		}
+		dataFile.Keys = db.keyRing
+		dataFile.Compressors = db.compressors
+		newFiles = append(newFiles, dataFile)
+	}
+	return newFiles, nil
+}
+
+// refreshScheduler 只读模式下后台定期刷新
+type refreshScheduler struct {
+	db *DB
+
+	closeCh chan struct{}
+	wg      *sync.WaitGroup
+	once    *sync.Once
+}
+
+func newRefreshScheduler(db *DB) *refreshScheduler {
+	return &refreshScheduler{
+		db:      db,
+		closeCh: make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+		once:    new(sync.Once),
+	}
+}
+
+func (s *refreshScheduler) start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// stop 通知后台协程退出，并等待正在执行的刷新完成
+func (s *refreshScheduler) stop() {
+	s.once.Do(func() {
+		close(s.closeCh)
+	})
+	s.wg.Wait()
+}
+
+func (s *refreshScheduler) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.db.option.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			// 刷新失败时等待下一个周期重试
+			_ = s.db.Refresh()
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/index"
+	"go-bitcask-kv/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpen_ReadOnly(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-read-only")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	writer, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(writer)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, writer.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+
+	// 写入进程运行期间可以同时打开多个只读实例
+	readOpts := opts
+	readOpts.ReadOnly = true
+	reader, err := Open(readOpts)
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, reader.Close())
+	}()
+	other, err := Open(readOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, other.Close())
+
+	// 写入进程仍然是排他的
+	_, err = Open(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	assert.Equal(t, 100, len(reader.ListKeys()))
+	val, err := reader.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 所有的写操作都返回ErrReadOnly，不会创建新的文件
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrReadOnly, reader.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrReadOnly, reader.Delete(utils.GetTestKey(10)))
+	assert.Equal(t, ErrReadOnly, reader.Delete([]byte("not-exist")))
+	assert.Equal(t, ErrReadOnly, reader.PutWithTTL([]byte("key"), []byte("value"), time.Second))
+	assert.Equal(t, ErrReadOnly, reader.Merge())
+	assert.Equal(t, ErrReadOnly, reader.Backup(filepath.Join(dir, "backup")))
+	_, err = reader.PutIfAbsent([]byte("key"), []byte("value"))
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = reader.DeletePrefix([]byte("bitcask-key"))
+	assert.Equal(t, ErrReadOnly, err)
+	wb := reader.NewWriteBatch(DefaultWriteBachOption)
+	assert.Nil(t, wb.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrReadOnly, wb.Commit())
+	newEntries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, newEntries)
+	_, err = os.Stat(reader.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+
+	// 刷新之后读取到写入进程追加到active文件以及新创建的文件中的数据
+	for i := 100; i < 2000; i++ {
+		assert.Nil(t, writer.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+	assert.Nil(t, writer.Delete(utils.GetTestKey(0)))
+	wb = writer.NewWriteBatch(DefaultWriteBachOption)
+	assert.Nil(t, wb.Put([]byte("txn-key"), []byte("txn-value")))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(1)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, writer.Sync())
+
+	_, err = reader.Get(utils.GetTestKey(1500))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, reader.Refresh())
+	assert.Equal(t, 1999, len(reader.ListKeys()))
+	assert.Equal(t, writer.activeFile.FileId, reader.activeFile.FileId)
+	assert.Equal(t, writer.seqNo, reader.seqNo)
+	_, err = reader.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = reader.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = reader.Get([]byte("txn-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn-value"), val)
+	for i := 2; i < 2000; i += 100 {
+		expected, err := writer.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		val, err := reader.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+
+	// 写入进程的刷新直接返回
+	assert.Nil(t, writer.Refresh())
+}
+
+func TestDB_RefreshInProgressWrites(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-read-only-refresh")
+	opts.DirPath = dir
+	opts.TailRecovery = TailRecoveryFail
+	writer, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Put([]byte("key-1"), []byte("value-1")))
+	assert.Nil(t, writer.Close())
+
+	activeFile := data.GetDataFileName(dir, 0)
+	appendFile := func(buf []byte) {
+		file, err := os.OpenFile(activeFile, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = file.Write(buf)
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+	}
+
+	// 只写入了一半的记录在只读模式下不是损坏的尾部
+	record, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   data.EncodeRecordKeyWithSeq([]byte("key-2"), nonTransactionSeqNo),
+		Value: []byte("value-2"),
+		Type:  data.LogRecordNormal,
+	})
+	appendFile(record[:len(record)/2])
+
+	opts.ReadOnly = true
+	reader, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(reader)
+	_, err = reader.Get([]byte("key-2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	appendFile(record[len(record)/2:])
+	assert.Nil(t, reader.Refresh())
+	val, err := reader.Get([]byte("key-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-2"), val)
+
+	// 还没有写入完成标识的事务不会生效
+	txnRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   data.EncodeRecordKeyWithSeq([]byte("key-3"), 100),
+		Value: []byte("value-3"),
+		Type:  data.LogRecordNormal,
+	})
+	appendFile(txnRecord)
+	assert.Nil(t, reader.Refresh())
+	_, err = reader.Get([]byte("key-3"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	finishedRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:  data.EncodeRecordKeyWithSeq(txnFish, 100),
+		Type: data.LogRecordTxnFinished,
+	})
+	appendFile(finishedRecord)
+	assert.Nil(t, reader.Refresh())
+	val, err = reader.Get([]byte("key-3"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-3"), val)
+	assert.Equal(t, uint64(100), reader.seqNo)
+
+	// 刚刚创建还没有写完文件头的文件在之后刷新时再加载
+	assert.Nil(t, os.WriteFile(data.GetDataFileName(dir, 1), nil, 0644))
+	assert.Nil(t, reader.Refresh())
+	assert.Equal(t, uint32(0), reader.activeFile.FileId)
+}
+
+func TestOpen_ReadOnlyEmptyDir(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-read-only-empty")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = dir
+	opts.ReadOnly = true
+	opts.RefreshInterval = time.Millisecond * 10
+
+	// 只读模式不会创建目录
+	missingOpts := opts
+	missingOpts.DirPath = filepath.Join(dir, "missing")
+	_, err := Open(missingOpts)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(missingOpts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	reader, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, reader.Close())
+	}()
+	assert.Nil(t, reader.activeFile)
+	assert.Equal(t, 0, len(reader.ListKeys()))
+
+	// 后台定期刷新，读取到写入进程之后创建的文件
+	opts.ReadOnly = false
+	opts.RefreshInterval = 0
+	writer, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Put([]byte("key"), []byte("value")))
+	assert.Nil(t, writer.Close())
+	assert.Eventually(t, func() bool {
+		_, err := reader.Get([]byte("key"))
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestOpen_ReadOnlyDefersMerge(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-read-only-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	writer, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, writer.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, writer.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, writer.Merge())
+	assert.Nil(t, writer.Close())
+
+	readOpts := opts
+	readOpts.ReadOnly = true
+	reader, err := Open(readOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(reader.ListKeys()))
+
+	// 有只读实例打开时不会替换数据文件
+	writer, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(writer.getMergePath())
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(writer.ListKeys()))
+	assert.Nil(t, writer.Close())
+	for i := 500; i < 1000; i += 50 {
+		_, err := reader.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, reader.Close())
+
+	// 只读实例关闭之后写入进程启动时替换文件
+	writer, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(writer)
+	_, err = os.Stat(writer.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 500, len(writer.ListKeys()))
+}
+
+func TestOpen_ReadOnlyOptions(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-read-only-options")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	opts.DirPath = dir
+
+	opts.RefreshInterval = time.Second
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+
+	opts.ReadOnly = true
+	opts.RefreshInterval = -time.Second
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	opts.RefreshInterval = 0
+	opts.IndexType = index.BPlusTreeIndex
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	opts.IndexType = index.BtreeIndex
+	opts.AutoMergeInterval = time.Minute
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
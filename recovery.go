@@ -0,0 +1,155 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"io"
+	"os"
+)
+
+// 写入过程中进程崩溃时，active文件的末尾可能留下不完整的记录，
+// 启动加载数据文件时从最后一条完整记录之后的部分都视为损坏的尾部，按照TailRecovery处理
+// 损坏的位置之后还有可以解析的记录时，说明是文件中间的数据损坏而不是写入中断，返回ErrDataFileCorrupted，需要使用bitcask-fsck修复
+
+// TailRecoveryMode 启动时发现数据文件尾部损坏的处理方式
+type TailRecoveryMode int8
+
+const (
+	// TailRecoveryTruncate 将active文件截断到最后一条完整的记录
+	TailRecoveryTruncate TailRecoveryMode = iota
+
+	// TailRecoveryFail 打开数据库失败，返回ErrDataFileTailCorrupted
+	TailRecoveryFail
+
+	// TailRecoverySkip 保留损坏的数据，该文件不再写入，之后的写入使用新的active文件
+	// 之前以该方式打开过的数据库中，older文件也可能有损坏的尾部
+	TailRecoverySkip
+)
+
+// TailRecovery 启动时发现的一段损坏的尾部
+type TailRecovery struct {
+	FileId uint32
+
+	// 最后一条完整记录的结束位置
+	Offset int64
+
+	// 被丢弃的字节数，TailRecoverySkip时这部分数据保留在文件中
+	DiscardedBytes int64
+}
+
+// TailRecoveries 获取打开数据库时发现的损坏尾部
+func (db *DB) TailRecoveries() []TailRecovery {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	recoveries := make([]TailRecovery, len(db.tailRecoveries))
+	copy(recoveries, db.tailRecoveries)
+	return recoveries
+}
+
+// recoverTail 处理数据文件中validEnd之后损坏的尾部
+// 只有active文件会被截断，older文件只在TailRecoverySkip时允许有损坏的尾部
+func (db *DB) recoverTail(dataFile *data.SegDataFile, validEnd int64) error {
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if validEnd >= size {
+		return nil
+	}
+
+	mode := db.option.TailRecovery
+	isActive := dataFile == db.activeFile
+
+	// 只读模式下active文件可能正在被写入进程追加，不完整的记录在之后刷新时再读取
+	if isActive && db.option.ReadOnly {
+		return nil
+	}
+
+	tail, err := dataFile.ReadRange(validEnd, size-validEnd)
+	if err != nil {
+		return err
+	}
+	if data.FindNextLogRecord(tail) >= 0 {
+		return ErrDataFileCorrupted
+	}
+
+	if mode == TailRecoveryFail || (!isActive && mode != TailRecoverySkip) {
+		return ErrDataFileTailCorrupted
+	}
+
+	db.tailRecoveries = append(db.tailRecoveries, TailRecovery{
+		FileId:         dataFile.FileId,
+		Offset:         validEnd,
+		DiscardedBytes: size - validEnd,
+	})
+
+	if mode == TailRecoverySkip {
+		// 保留下来的损坏数据计入可回收空间，merge之后被清理
+		db.markGarbage(&data.LogRecordPos{Fid: dataFile.FileId, Offset: validEnd, Size: uint32(size - validEnd)})
+		return nil
+	}
+
+	// 使用MMap加载时，映射的长度在重置IO类型之后才会更新，截断之后不会再读取尾部
+	return os.Truncate(data.GetDataFileName(db.option.DirPath, dataFile.FileId), validEnd)
+}
+
+// tailEnd 获取文件中最后一条完整记录的结束位置，文件没有损坏的尾部时返回false
+func (db *DB) tailEnd(fid uint32) (int64, bool) {
+	for _, recovery := range db.tailRecoveries {
+		if recovery.FileId == fid {
+			return recovery.Offset, true
+		}
+	}
+	return 0, false
+}
+
+// scanValidEnd 遍历文件中的记录，返回最后一条完整记录的结束位置
+// B+树索引不需要加载数据文件，只通过该方法检查active文件的尾部
+func scanValidEnd(dataFile *data.SegDataFile) (int64, error) {
+	var offset = dataFile.DataOffset()
+	for {
+		_, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if isTornRecordErr(err) {
+				return offset, nil
+			}
+			return 0, err
+		}
+		offset += size
+	}
+}
+
+// recoverBPlusTreeTail B+树索引启动时处理active文件损坏的尾部，并设置写入的偏移
+func (db *DB) recoverBPlusTreeTail() error {
+	if db.activeFile == nil {
+		return nil
+	}
+
+	validEnd, err := scanValidEnd(db.activeFile)
+	if err != nil {
+		return err
+	}
+	if err := db.recoverTail(db.activeFile, validEnd); err != nil {
+		return err
+	}
+	db.activeFile.WriteOff = validEnd
+	return nil
+}
+
+// sealTornActiveFile TailRecoverySkip时active文件中保留了损坏的数据，不能继续追加写入
+func (db *DB) sealTornActiveFile() error {
+	if db.activeFile == nil || db.option.TailRecovery != TailRecoverySkip {
+		return nil
+	}
+	if _, ok := db.tailEnd(db.activeFile.FileId); !ok {
+		return nil
+	}
+
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	return db.setNewActiveDataFile()
+}
+
+// isTornRecordErr 读取记录时遇到不完整或者校验失败的记录
+func isTornRecordErr(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == data.ErrInvalidCRC
+}
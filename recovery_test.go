@@ -0,0 +1,253 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/index"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+)
+
+// 写入数据之后关闭，在active文件末尾追加tail模拟写入过程中崩溃
+func prepareTornTailDB(t *testing.T, opts Option, tail []byte) (uint32, int64) {
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(64)))
+	}
+	fid, size := db.activeFile.FileId, db.activeFile.WriteOff
+	assert.Nil(t, db.Close())
+
+	file, err := os.OpenFile(data.GetDataFileName(opts.DirPath, fid), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(tail)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	return fid, size
+}
+
+// 只写入了一半的记录
+func partialRecord() []byte {
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   data.EncodeRecordKeyWithSeq([]byte("torn-key"), nonTransactionSeqNo),
+		Value: utils.GetTestRandomValue(64),
+		Type:  data.LogRecordNormal,
+	})
+	return encRecord[:len(encRecord)/2]
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	return info.Size()
+}
+
+func TestOpen_TailRecoveryTruncate(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-tail-truncate")
+	opts.DirPath = dir
+	tail := partialRecord()
+	fid, size := prepareTornTailDB(t, opts, tail)
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, []TailRecovery{{FileId: fid, Offset: size, DiscardedBytes: int64(len(tail))}}, db.TailRecoveries())
+	assert.Equal(t, size, fileSize(t, data.GetDataFileName(dir, fid)))
+	assert.Equal(t, 100, db.index.Size())
+	_, err = db.Get([]byte("torn-key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 截断之后继续写入，重启之后不再有损坏的尾部
+	assert.Nil(t, db.Put(utils.GetTestKey(100), []byte("value")))
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Empty(t, db2.TailRecoveries())
+	assert.Equal(t, 101, db2.index.Size())
+	val, err := db2.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestOpen_TailRecoveryTruncate_InvalidCRC(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-tail-crc")
+	opts.DirPath = dir
+	opts.MMapAtStartup = false
+
+	// 完整的记录，但是数据在写入过程中损坏
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   data.EncodeRecordKeyWithSeq([]byte("torn-key"), nonTransactionSeqNo),
+		Value: []byte("value"),
+		Type:  data.LogRecordNormal,
+	})
+	encRecord[len(encRecord)-1] ^= 0xff
+	tail := append(encRecord, 0, 0, 0)
+	fid, size := prepareTornTailDB(t, opts, tail)
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, []TailRecovery{{FileId: fid, Offset: size, DiscardedBytes: int64(len(tail))}}, db.TailRecoveries())
+	assert.Equal(t, 100, db.index.Size())
+	_, err = db.Get([]byte("torn-key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestOpen_TailRecoveryTruncate_UncommittedTxn(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-tail-txn")
+	opts.DirPath = dir
+
+	// 事务的数据已经写入，但是事务完成标识只写入了一部分
+	var tail []byte
+	for i := 0; i < 2; i++ {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   data.EncodeRecordKeyWithSeq(utils.GetTestKey(200+i), 10),
+			Value: []byte("value"),
+			Type:  data.LogRecordNormal,
+		})
+		tail = append(tail, encRecord...)
+	}
+	finished, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:  data.EncodeRecordKeyWithSeq(txnFish, 10),
+		Type: data.LogRecordTxnFinished,
+	})
+	validLen := int64(len(tail))
+	tail = append(tail, finished[:len(finished)-1]...)
+	fid, size := prepareTornTailDB(t, opts, tail)
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, []TailRecovery{{FileId: fid, Offset: size + validLen, DiscardedBytes: int64(len(finished) - 1)}},
+		db.TailRecoveries())
+	assert.Equal(t, 100, db.index.Size())
+	_, err = db.Get(utils.GetTestKey(200))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestOpen_TailRecoveryFail(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-tail-fail")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	tail := partialRecord()
+	fid, size := prepareTornTailDB(t, opts, tail)
+
+	opts.TailRecovery = TailRecoveryFail
+	db, err := Open(opts)
+	assert.Nil(t, db)
+	assert.Equal(t, ErrDataFileTailCorrupted, err)
+	assert.Equal(t, size+int64(len(tail)), fileSize(t, data.GetDataFileName(dir, fid)))
+}
+
+func TestOpen_TailRecovery_CorruptedInMiddle(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-tail-middle")
+	opts.DirPath = dir
+	opts.IndexSnapshot = false
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(64)))
+	}
+	pos := db.index.Get(utils.GetTestKey(50))
+	assert.Nil(t, db.Close())
+
+	// 文件中间的一条记录损坏，之后的记录仍然完整，不能当作损坏的尾部截断
+	path := data.GetDataFileName(dir, pos.Fid)
+	size := fileSize(t, path)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte{0xff}, pos.Offset+int64(pos.Size)-1)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	for _, mode := range []TailRecoveryMode{TailRecoveryTruncate, TailRecoveryFail, TailRecoverySkip} {
+		opts.TailRecovery = mode
+		db, err := Open(opts)
+		assert.Nil(t, db)
+		assert.Equal(t, ErrDataFileCorrupted, err)
+		assert.Equal(t, size, fileSize(t, path))
+	}
+}
+
+func TestOpen_TailRecoverySkip(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-tail-skip")
+	opts.DirPath = dir
+	opts.mergeMinSizeThr = 0
+	// 每次启动都需要扫描到损坏的尾部，不能从索引快照加载
+	opts.IndexSnapshot = false
+	tail := partialRecord()
+	fid, size := prepareTornTailDB(t, opts, tail)
+
+	opts.TailRecovery = TailRecoverySkip
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	recoveries := []TailRecovery{{FileId: fid, Offset: size, DiscardedBytes: int64(len(tail))}}
+	assert.Equal(t, recoveries, db.TailRecoveries())
+
+	// 损坏的数据保留在文件中，之后的写入使用新的文件
+	assert.Equal(t, size+int64(len(tail)), fileSize(t, data.GetDataFileName(dir, fid)))
+	assert.Equal(t, fid+1, db.activeFile.FileId)
+	assert.Nil(t, db.Put(utils.GetTestKey(100), []byte("value")))
+	assert.Equal(t, uint32(len(tail)), db.Stat().RecycleSize)
+	assert.Nil(t, db.Close())
+
+	// 损坏的尾部已经在older文件中，只有TailRecoverySkip可以打开
+	opts.TailRecovery = TailRecoveryTruncate
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataFileTailCorrupted, err)
+
+	opts.TailRecovery = TailRecoverySkip
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, recoveries, db2.TailRecoveries())
+	assert.Equal(t, fid+1, db2.activeFile.FileId)
+	assert.Equal(t, 101, db2.index.Size())
+
+	// merge之后损坏的尾部被清理
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db2.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db2.Merge())
+	assert.Nil(t, db2.Close())
+
+	opts.TailRecovery = TailRecoveryTruncate
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db3)
+	assert.Empty(t, db3.TailRecoveries())
+	assert.Equal(t, 51, db3.index.Size())
+}
+
+func TestOpen_TailRecovery_BPlusTree(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-tail-bptree")
+	opts.DirPath = dir
+	opts.IndexType = index.BPlusTreeIndex
+	tail := partialRecord()
+	fid, size := prepareTornTailDB(t, opts, tail)
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, []TailRecovery{{FileId: fid, Offset: size, DiscardedBytes: int64(len(tail))}}, db.TailRecoveries())
+	assert.Equal(t, size, db.activeFile.WriteOff)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(100), []byte("value")))
+	val, err := db.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
@@ -4,6 +4,9 @@ import "errors"
 
 // Del 删除对应的key，通用方法
 func (rds *RedisData) Del(key []byte) error {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
 	return rds.db.Delete(key)
 }
 
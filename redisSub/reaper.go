@@ -0,0 +1,295 @@
+package redisSub
+
+import (
+	"bytes"
+	"encoding/binary"
+	bitcask "go-bitcask-kv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 参考Redis的主动过期策略:
+// 每个周期抽样一批带过期时间的key, 删除其中已经过期的
+// 如果过期比例超过阈值, 说明过期key较多, 继续下一轮抽样, 直到超出本周期的时间限制
+const (
+	reaperInterval = 100 * time.Millisecond
+
+	// 单个周期最长执行时间，避免长时间占用写锁
+	reaperCycleDuration = 25 * time.Millisecond
+
+	// 每一轮抽样带过期时间的key的数量
+	reaperSampleSize = 20
+
+	// 每一轮最多扫描的key数量，大部分key没有过期时间时避免扫描过多
+	reaperScanSize = 400
+
+	// 过期比例超过该阈值时继续下一轮抽样
+	reaperExpiredRatio = 0.25
+
+	// 删除集合子key时每个batch中的最大数量
+	reaperBatchSize = 512
+)
+
+// ReaperStat 后台过期清理的统计信息
+type ReaperStat struct {
+	// 清理的String数量
+	StringsReaped uint64
+
+	// 清理的Hash、Set等集合数量
+	CollectionsReaped uint64
+
+	// 随集合一起清理的子key数量
+	SubKeysReaped uint64
+}
+
+type expireReaper struct {
+	rds *RedisData
+
+	// 下一轮抽样开始的位置, 为空表示从头开始
+	cursor []byte
+
+	closeCh chan struct{}
+	wg      *sync.WaitGroup
+
+	stringsReaped     uint64
+	collectionsReaped uint64
+	subKeysReaped     uint64
+}
+
+func newExpireReaper(rds *RedisData) *expireReaper {
+	return &expireReaper{
+		rds:     rds,
+		closeCh: make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+	}
+}
+
+func (r *expireReaper) start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+// stop 通知后台协程退出，并等待当前周期执行完成
+func (r *expireReaper) stop() {
+	select {
+	case <-r.closeCh:
+		// 已经关闭过
+		return
+	default:
+		close(r.closeCh)
+	}
+	r.wg.Wait()
+}
+
+func (r *expireReaper) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.closeCh:
+			return
+		case <-ticker.C:
+			r.reapCycle()
+		}
+	}
+}
+
+// reapCycle 执行一个清理周期
+func (r *expireReaper) reapCycle() {
+	start := time.Now()
+
+	iter := r.rds.db.NewIterator(bitcask.DefaultIteratorOption)
+	defer iter.Close()
+
+	if r.cursor == nil {
+		iter.Rewind()
+	} else {
+		iter.Seek(r.cursor)
+	}
+
+	for {
+		sampled, expired := r.sample(iter)
+
+		// 遍历完一遍之后从头开始
+		if !iter.Valid() {
+			r.cursor = nil
+			return
+		}
+
+		if sampled == 0 || float64(expired)/float64(sampled) <= reaperExpiredRatio {
+			return
+		}
+
+		if time.Since(start) > reaperCycleDuration {
+			return
+		}
+
+		select {
+		case <-r.closeCh:
+			return
+		default:
+		}
+	}
+}
+
+// sample 从迭代器当前位置开始抽样一轮，返回抽样到的带过期时间的key数量以及其中过期的数量
+func (r *expireReaper) sample(iter *bitcask.Iterator) (int, int) {
+	var sampled, expired, scanned int
+	now := time.Now().UnixNano()
+
+	for ; iter.Valid() && sampled < reaperSampleSize && scanned < reaperScanSize; iter.Next() {
+		scanned++
+		key := iter.Key()
+		r.cursor = key
+
+		encValue, err := iter.Value()
+		if err != nil {
+			continue
+		}
+
+		_, expire := parseExpire(encValue)
+		if expire == 0 {
+			continue
+		}
+
+		sampled++
+		if expire > now {
+			continue
+		}
+
+		if r.reapKey(key) {
+			expired++
+		}
+	}
+
+	return sampled, expired
+}
+
+// reapKey 删除一个过期的key，如果是集合则连同所有子key一起删除
+func (r *expireReaper) reapKey(key []byte) bool {
+	rds := r.rds
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	// 加锁之后重新读取，可能在抽样之后被重新写入了
+	encValue, err := rds.db.Get(key)
+	if err != nil {
+		return false
+	}
+
+	dataType, expire := parseExpire(encValue)
+	if expire == 0 || expire > time.Now().UnixNano() {
+		return false
+	}
+
+	// 集合的子key对应的value是用户数据，可能恰好能被解析为过期的数据
+	if r.isSubKey(key) {
+		return false
+	}
+
+	if dataType == String {
+		if err := rds.db.Delete(key); err != nil {
+			return false
+		}
+		atomic.AddUint64(&r.stringsReaped, 1)
+		return true
+	}
+
+	meta := decodeMetadata(encValue)
+	subKeys := r.collectSubKeys(key, meta.version)
+
+	// 元数据和第一批子key放在同一个batch中删除，之后集合对读操作就不可见了
+	// 剩余的子key属于旧版本，即使中途失败也只会残留无法访问的数据
+	wb := rds.db.NewWriteBatch(bitcask.DefaultWriteBachOption)
+	_ = wb.Delete(key)
+	var pending = 1
+	for _, subKey := range subKeys {
+		if pending >= reaperBatchSize {
+			if err := wb.Commit(); err != nil {
+				return false
+			}
+			pending = 0
+		}
+		_ = wb.Delete(subKey)
+		pending++
+	}
+	if err := wb.Commit(); err != nil {
+		return false
+	}
+
+	atomic.AddUint64(&r.collectionsReaped, 1)
+	atomic.AddUint64(&r.subKeysReaped, uint64(len(subKeys)))
+	return true
+}
+
+// collectSubKeys 获取集合当前版本下的所有子key
+func (r *expireReaper) collectSubKeys(key []byte, version int64) [][]byte {
+	prefix := make([]byte, len(key)+8)
+	copy(prefix, key)
+	binary.LittleEndian.PutUint64(prefix[len(key):], uint64(version))
+
+	iter := r.rds.db.NewIterator(bitcask.DefaultIteratorOption)
+	defer iter.Close()
+
+	var subKeys [][]byte
+	for iter.Seek(prefix); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
+		subKeys = append(subKeys, iter.Key())
+	}
+	return subKeys
+}
+
+// isSubKey 判断key是否是某个集合的子key
+// 子key的格式为 key + version + field, 只要存在一个前缀是集合的元数据并且版本号一致即可
+func (r *expireReaper) isSubKey(key []byte) bool {
+	for p := 1; p+8 <= len(key); p++ {
+		metaBuf, err := r.rds.db.Get(key[:p])
+		if err != nil {
+			continue
+		}
+
+		dataType, _ := parseExpire(metaBuf)
+		if dataType != Hash && dataType != Set {
+			continue
+		}
+
+		meta := decodeMetadata(metaBuf)
+		if binary.LittleEndian.Uint64(key[p:p+8]) == uint64(meta.version) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpire 从编码后的value中解析出数据类型和过期时间
+func parseExpire(encValue []byte) (redisDataType, int64) {
+	if len(encValue) == 0 {
+		return 0, 0
+	}
+
+	dataType := redisDataType(encValue[0])
+	switch dataType {
+	case String:
+		expire, n := binary.Varint(encValue[1:])
+		if n <= 0 {
+			return 0, 0
+		}
+		return String, expire
+	case Hash, Set, List, ZSet:
+		return dataType, decodeMetadata(encValue).expire
+	default:
+		return 0, 0
+	}
+}
+
+// ReaperStat 获取后台过期清理的统计信息
+func (rds *RedisData) ReaperStat() ReaperStat {
+	return ReaperStat{
+		StringsReaped:     atomic.LoadUint64(&rds.reaper.stringsReaped),
+		CollectionsReaped: atomic.LoadUint64(&rds.reaper.collectionsReaped),
+		SubKeysReaped:     atomic.LoadUint64(&rds.reaper.subKeysReaped),
+	}
+}
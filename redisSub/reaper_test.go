@@ -0,0 +1,139 @@
+package redisSub
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	bitcask "go-bitcask-kv"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+// reapOnePass 在测试协程中直接执行清理周期，直到完整地扫描一遍所有的key
+// 调用前需要先停止后台协程
+func reapOnePass(r *expireReaper) {
+	for {
+		r.reapCycle()
+		if r.cursor == nil {
+			return
+		}
+	}
+}
+
+func TestRedisData_ReapExpiredString(t *testing.T) {
+	opts := bitcask.DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-reap-string")
+	opts.DirPath = dir
+	rds, err := NewRedisData(opts)
+	assert.Nil(t, err)
+	rds.reaper.stop()
+
+	defer func() {
+		_ = rds.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	// ttl为负数，写入时就已经过期
+	for i := 0; i < 100; i++ {
+		err = rds.Set(utils.GetTestKey(i), -time.Second, utils.GetTestRandomValue(10))
+		assert.Nil(t, err)
+	}
+	err = rds.Set(utils.GetTestKey(1000), 0, []byte("persist"))
+	assert.Nil(t, err)
+
+	reapOnePass(rds.reaper)
+
+	// 过期的key从引擎中被真正删除
+	keys := rds.db.ListKeys()
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, utils.GetTestKey(1000), keys[0])
+	assert.Equal(t, uint64(100), rds.ReaperStat().StringsReaped)
+
+	val, err := rds.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("persist"), val)
+}
+
+func TestRedisData_ReapExpiredCollection(t *testing.T) {
+	opts := bitcask.DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-reap-collection")
+	opts.DirPath = dir
+	rds, err := NewRedisData(opts)
+	assert.Nil(t, err)
+	rds.reaper.stop()
+
+	defer func() {
+		_ = rds.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 子key的value恰好可以被解析为一个已经过期的String
+	fakeValue := make([]byte, 1+binary.MaxVarintLen64)
+	fakeValue[0] = byte(String)
+	n := binary.PutVarint(fakeValue[1:], 1)
+	fakeValue = fakeValue[:1+n]
+
+	_, err = rds.HSet(utils.GetTestKey(1), []byte("field1"), fakeValue)
+	assert.Nil(t, err)
+	_, err = rds.HSet(utils.GetTestKey(1), []byte("field2"), utils.GetTestRandomValue(10))
+	assert.Nil(t, err)
+
+	for i := 0; i < 600; i++ {
+		_, err = rds.SAdd(utils.GetTestKey(2), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	reapOnePass(rds.reaper)
+
+	// 没有过期的集合不受影响
+	val, err := rds.HGet(utils.GetTestKey(1), []byte("field1"))
+	assert.Nil(t, err)
+	assert.Equal(t, fakeValue, val)
+	assert.Equal(t, uint64(0), rds.ReaperStat().StringsReaped)
+
+	// 手动将Set的元数据设置为过期
+	meta, err := rds.findMetadata(utils.GetTestKey(2), Set)
+	assert.Nil(t, err)
+	meta.expire = time.Now().Add(-time.Second).UnixNano()
+	err = rds.db.Put(utils.GetTestKey(2), meta.encode())
+	assert.Nil(t, err)
+
+	reapOnePass(rds.reaper)
+
+	stat := rds.ReaperStat()
+	assert.Equal(t, uint64(1), stat.CollectionsReaped)
+	assert.Equal(t, uint64(600), stat.SubKeysReaped)
+
+	// 只剩下Hash的元数据和两个field
+	assert.Equal(t, 3, len(rds.db.ListKeys()))
+}
+
+func TestRedisData_ReaperBackground(t *testing.T) {
+	opts := bitcask.DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-reap-background")
+	opts.DirPath = dir
+	rds, err := NewRedisData(opts)
+	assert.Nil(t, err)
+
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	for i := 0; i < 100; i++ {
+		err = rds.Set(utils.GetTestKey(i), -time.Second, utils.GetTestRandomValue(10))
+		assert.Nil(t, err)
+	}
+
+	// 等待后台协程清理完所有过期的key
+	deadline := time.Now().Add(5 * time.Second)
+	for rds.ReaperStat().StringsReaped < 100 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(100), rds.ReaperStat().StringsReaped)
+	assert.Equal(t, 0, len(rds.db.ListKeys()))
+
+	// Close会停止后台协程并等待其退出
+	err = rds.Close()
+	assert.Nil(t, err)
+}
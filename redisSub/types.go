@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	bitcask "go-bitcask-kv"
+	"sync"
 	"time"
 )
 
@@ -23,6 +24,12 @@ const (
 
 type RedisData struct {
 	db *bitcask.DB
+
+	// 写操作都是先读后写，需要和后台过期清理互斥
+	mu *sync.Mutex
+
+	// 后台主动清理过期key
+	reaper *expireReaper
 }
 
 func NewRedisData(option bitcask.Option) (*RedisData, error) {
@@ -30,9 +37,16 @@ func NewRedisData(option bitcask.Option) (*RedisData, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &RedisData{
+	rds := &RedisData{
 		db: db,
-	}, nil
+		mu: new(sync.Mutex),
+	}
+
+	// 启动后台过期清理
+	rds.reaper = newExpireReaper(rds)
+	rds.reaper.start()
+
+	return rds, nil
 }
 
 // ============================ String =============================
@@ -44,6 +58,9 @@ func (rds *RedisData) Set(key []byte, ttl time.Duration, value []byte) error {
 		return nil
 	}
 
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
 	var index = 0
 	buf := make([]byte, binary.MaxVarintLen64+1+len(value))
 
@@ -80,6 +97,7 @@ func (rds *RedisData) Get(key []byte) ([]byte, error) {
 	}
 
 	// 判断过期时间，过期则返回nil
+	// 已经被后台清理掉的过期key和不存在的key一样返回ErrKeyNotFound
 	expire, n := binary.Varint(encValue[index:])
 	index += n
 	if expire > 0 && expire < time.Now().UnixNano() {
@@ -95,6 +113,9 @@ func (rds *RedisData) Get(key []byte) ([]byte, error) {
 
 // HSet field不存在返回true, 更新返回false
 func (rds *RedisData) HSet(key, field, value []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
 	// 先查找元数据
 	meta, err := rds.findMetadata(key, Hash)
 	if err != nil {
@@ -156,6 +177,9 @@ func (rds *RedisData) HGet(key, field []byte) ([]byte, error) {
 }
 
 func (rds *RedisData) HDel(key, field []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
 	// 先找元数据
 	meta, err := rds.findMetadata(key, Hash)
 	if err != nil {
@@ -202,6 +226,9 @@ func (rds *RedisData) HDel(key, field []byte) (bool, error) {
 // 增加member_size是为了方便从末尾直接获取member元素
 
 func (rds *RedisData) SAdd(key, member []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
 	// 先获取元数据
 	meta, err := rds.findMetadata(key, Set)
 	if err != nil {
@@ -261,6 +288,9 @@ func (rds *RedisData) SIsMember(key, member []byte) (bool, error) {
 }
 
 func (rds *RedisData) SRem(key, member []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
 	meta, err := rds.findMetadata(key, Set)
 	if err != nil {
 		return false, err
@@ -305,8 +335,9 @@ func (rds *RedisData) SRem(key, member []byte) (bool, error) {
 // key + version + member						-> 	score
 // key + version + score + member + memberSize 	-> 	nil
 
-// Close 关闭db实例
+// Close 停止后台过期清理，关闭db实例
 func (rds *RedisData) Close() error {
+	rds.reaper.stop()
 	return rds.db.Close()
 }
 
@@ -15,6 +15,8 @@ func TestRedisData_Set_Get(t *testing.T) {
 	opts.DirPath = dir
 	rds, err := NewRedisData(opts)
 	assert.Nil(t, err)
+	// 只验证读取时对过期key的处理，过期的key不能被后台清理
+	rds.reaper.stop()
 
 	defer func() {
 		_ = rds.db.Close()
@@ -0,0 +1,100 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"go-bitcask-kv/index"
+	"sync"
+	"time"
+)
+
+// Snapshot 某一时刻DB的只读视图
+// 快照持有创建时索引的副本以及当时所有的数据文件，之后的写入、删除对快照都不可见
+// 数据文件只会追加写入，而merge生成的新文件需要重启之后才会替换旧文件，
+// 因此快照引用的数据文件在DB关闭之前都不会被删除
+type Snapshot struct {
+	db    *DB
+	mu    *sync.RWMutex
+	index index.Indexer
+
+	// 创建快照时的所有数据文件
+	files map[uint32]*data.SegDataFile
+
+	released bool
+}
+
+// Snapshot 创建一个快照，使用完之后需要调用Release释放
+func (db *DB) Snapshot() *Snapshot {
+	// 加锁保证索引和数据文件是同一时刻的状态
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	files := make(map[uint32]*data.SegDataFile, len(db.olderFiles)+1)
+	for fid, file := range db.olderFiles {
+		files[fid] = file
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileId] = db.activeFile
+	}
+
+	snap := &Snapshot{
+		db:       db,
+		mu:       new(sync.RWMutex),
+		index:    db.index.Clone(),
+		files:    files,
+		released: db.isClosed,
+	}
+
+	if !db.isClosed {
+		db.snapshots[snap] = struct{}{}
+	}
+	return snap
+}
+
+// Get 读取快照创建时key对应的value
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	pos := s.index.Get(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+
+	return s.getValueByPosition(pos)
+}
+
+// NewIterator 在快照上创建迭代器
+func (s *Snapshot) NewIterator(opt IteratorOption) *Iterator {
+	return newIterator(s.db, s, s.index.Iterator(opt.Reverse), opt)
+}
+
+// Release 释放快照，释放之后快照不能再被读取
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	delete(s.db.snapshots, s)
+	s.db.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	_ = s.index.Close()
+	s.files = nil
+}
+
+func (s *Snapshot) getValueByPosition(pos *data.LogRecordPos) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	value, _, err := s.db.readValue(func(fid uint32) *data.SegDataFile {
+		return s.files[fid]
+	}, pos)
+	return value, err
+}
@@ -0,0 +1,99 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/index"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-snapshot")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	// 快照之后的修改、删除、新增
+	for i := 0; i < 50; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 50; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 100; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+
+	// 快照中看到的仍然是创建时的数据
+	for i := 0; i < 100; i++ {
+		val, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	_, err = snap.Get(utils.GetTestKey(150))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	iter := snap.NewIterator(DefaultIteratorOption)
+	var cnt int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iter.Key(), val)
+		cnt++
+	}
+	iter.Close()
+	assert.Equal(t, 100, cnt)
+
+	// 当前DB中的数据不受影响
+	_, err = db.Get(utils.GetTestKey(60))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 150, len(db.ListKeys()))
+
+	// 释放之后不能再读取
+	snap.Release()
+	_, err = snap.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrSnapshotReleased, err)
+	assert.Equal(t, 0, len(db.snapshots))
+}
+
+func TestDB_Snapshot_Close(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-snapshot-close")
+	opts.DirPath = dir
+	opts.IndexType = index.ARTIndex
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestRandomValue(10))
+	assert.Nil(t, err)
+
+	snap := db.Snapshot()
+	_, err = snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	// DB关闭之后快照被释放
+	err = db.Close()
+	assert.Nil(t, err)
+	_, err = snap.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrSnapshotReleased, err)
+	snap.Release()
+}
@@ -0,0 +1,116 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"time"
+)
+
+// PutWithTTL 写入带过期时间的key-value
+// 过期后的key对Get、Iterator、Fold、ListKeys都不可见，并且会在merge时被清理
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Expire 为已经存在的key重新设置过期时间
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.resetExpire(key, time.Now().Add(ttl).UnixNano())
+}
+
+// Persist 移除key的过期时间，使其永不过期
+func (db *DB) Persist(key []byte) error {
+	return db.resetExpire(key, 0)
+}
+
+// TTL 返回key的剩余存活时间，永不过期的key返回-1
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+
+	pos := db.index.Get(key)
+	if pos == nil {
+		return 0, ErrKeyNotFound
+	}
+
+	if pos.Expire == 0 {
+		return -1, nil
+	}
+
+	now := time.Now().UnixNano()
+	if pos.IsExpired(now) {
+		db.removeExpiredKey(key, pos)
+		return 0, ErrKeyNotFound
+	}
+
+	return time.Duration(pos.Expire - now), nil
+}
+
+// resetExpire 使用新的过期时间重写一条记录
+// 过期时间存储在日志记录中，因此需要把原来的value读出来再追加写入一次
+func (db *DB) resetExpire(key []byte, expire int64) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	// 读取旧值和追加写入必须在同一把锁中完成
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pos := db.getValidPosition(key)
+	if pos == nil {
+		return ErrKeyNotFound
+	}
+
+	// 过期时间没有变化，不需要重写
+	if pos.Expire == expire {
+		return nil
+	}
+
+	value, err := db.getValueByPosition(pos)
+	if err != nil {
+		return err
+	}
+
+	return db.putRecord(key, value, expire)
+}
+
+// removeExpiredKey 惰性删除过期的key
+// 只需要从内存索引中移除，不需要写墓碑，重启时过期的记录同样不会被加载
+func (db *DB) removeExpiredKey(key []byte, pos *data.LogRecordPos) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 加锁之后再次确认索引没有被并发更新
+	if !isSamePosition(db.index.Get(key), pos) {
+		return
+	}
+
+	if oldValue, _ := db.index.Delete(key); oldValue != nil {
+		db.markGarbage(oldValue)
+	}
+}
+
+// sweepExpiredKeys 从内存索引中移除所有已经过期的key，并将它们计入无效数据
+// 没有被访问过的过期key不会被惰性删除，merge判断阈值之前需要先统计这部分数据
+// 访问该方法前必须持有db互斥锁
+func (db *DB) sweepExpiredKeys(now int64) {
+	var expired [][]byte
+	it := db.index.Iterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if pos := it.Value(); pos.IsExpired(now) {
+			expired = append(expired, it.Key())
+			db.markGarbage(pos)
+		}
+	}
+	it.Close()
+
+	for _, key := range expired {
+		db.index.Delete(key)
+	}
+}
@@ -0,0 +1,182 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-ttl-put")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 非法的ttl
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.GetTestRandomValue(10), 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.GetTestRandomValue(10), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), utils.GetTestRandomValue(10))
+	assert.Nil(t, err)
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Equal(t, 2, len(db.ListKeys()))
+
+	time.Sleep(150 * time.Millisecond)
+
+	// 过期之后对Get、ListKeys、Fold、Iterator都不可见
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 1, len(db.ListKeys()))
+
+	var cnt int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		cnt++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+
+	iter := db.NewIterator(DefaultIteratorOption)
+	cnt = 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, utils.GetTestKey(2), iter.Key())
+		cnt++
+	}
+	iter.Close()
+	assert.Equal(t, 1, cnt)
+
+	// 惰性删除之后计入可回收空间
+	assert.True(t, db.recycleSize > 0)
+}
+
+func TestDB_Expire_TTL_Persist(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-ttl-expire")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 不存在的key
+	err = db.Expire(utils.GetTestKey(1), time.Second)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	val := utils.GetTestRandomValue(10)
+	err = db.Put(utils.GetTestKey(1), val)
+	assert.Nil(t, err)
+
+	// 永不过期
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	// 设置过期时间
+	err = db.Expire(utils.GetTestKey(1), time.Minute)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+	res, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val, res)
+
+	// 移除过期时间
+	err = db.Persist(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	// 过期后无法再设置
+	err = db.Expire(utils.GetTestKey(1), 50*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	err = db.Persist(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_TTL_Restart(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-ttl-restart")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 先写入永久数据，再用带过期时间的数据覆盖
+	err = db.Put(utils.GetTestKey(1), utils.GetTestRandomValue(10))
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.GetTestRandomValue(10), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.GetTestRandomValue(10), time.Minute)
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	time.Sleep(150 * time.Millisecond)
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+
+	// 过期的记录覆盖了之前的旧值
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, uint32(1), db2.Stat().KeyNum)
+
+	ttl, err := db2.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+}
+
+// 没有被访问过的过期key同样计入可回收空间，可以触发merge
+func TestDB_Merge_UntouchedExpiredKeys(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-ttl-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.mergeMinSizeThr = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.GetTestRandomValue(24), 100*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := 1000; i < 1100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestRandomValue(24))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, ErrMergeCondUnreached, db.Merge())
+
+	time.Sleep(150 * time.Millisecond)
+
+	// 过期的key没有被读取过，没有被惰性删除
+	assert.Equal(t, uint32(0), db.Stat().RecycleSize)
+	assert.Nil(t, db.Merge())
+	assert.True(t, db.Stat().RecycleSize > 0)
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(100), db2.Stat().KeyNum)
+	assert.Equal(t, uint32(0), db2.Stat().RecycleSize)
+}
@@ -0,0 +1,175 @@
+package bitcaskKV
+
+import (
+	"go-bitcask-kv/data"
+	"sync"
+)
+
+// Txn 乐观事务
+// 读操作直接读取DB中的最新数据，并记录读取时key对应的位置信息
+// 写操作和WriteBatch一样先暂存起来，提交时统一写入
+// 提交时如果读取过的key已经被其他写入修改，则说明发生了冲突，事务提交失败
+type Txn struct {
+	option WriteBatchOption
+	mu     *sync.Mutex
+	db     *DB
+
+	// 暂存事务中的写操作
+	pendingWrites map[string]*data.LogRecord
+
+	// 读集合，记录读取时key对应的位置信息，key不存在时为nil
+	readSet map[string]*data.LogRecordPos
+
+	// 提交或者回滚之后事务结束
+	finished bool
+}
+
+// Begin 开启一个乐观事务
+func (db *DB) Begin() *Txn {
+	return &Txn{
+		option:        DefaultWriteBachOption,
+		mu:            new(sync.Mutex),
+		db:            db,
+		pendingWrites: make(map[string]*data.LogRecord),
+		readSet:       make(map[string]*data.LogRecordPos),
+	}
+}
+
+// Get 读取数据，优先读取事务中还未提交的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+
+	// 读自己的写
+	if record, ok := txn.pendingWrites[string(key)]; ok {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+
+	db := txn.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	pos := db.getValidPosition(key)
+
+	// 同一个key只记录第一次读取的位置
+	if _, ok := txn.readSet[string(key)]; !ok {
+		txn.readSet[string(key)] = pos
+	}
+
+	if pos == nil {
+		return nil, ErrKeyNotFound
+	}
+	return db.getValueByPosition(pos)
+}
+
+// Put 在事务中写入数据
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{
+		Key:   key,
+		Value: value,
+		Type:  data.LogRecordNormal,
+	}
+	return nil
+}
+
+// Delete 在事务中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{
+		Key:   key,
+		Value: nil,
+		Type:  data.LogRecordDeleted,
+	}
+	return nil
+}
+
+// Commit 提交事务，读取过的key被修改时返回ErrTxnConflict
+// 无论提交成功与否，事务都会结束
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.finished = true
+
+	if len(txn.pendingWrites) > txn.option.maxBatchNum {
+		return ErrExceedMaxBatchNum
+	}
+
+	// 冲突检测和写入需要在同一把锁中完成
+	db := txn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key, readPos := range txn.readSet {
+		if !isSamePosition(readPos, db.getValidPosition([]byte(key))) {
+			return ErrTxnConflict
+		}
+	}
+
+	// 删除不存在的key不需要写入
+	for key, record := range txn.pendingWrites {
+		if record.Type == data.LogRecordDeleted && db.index.Get(record.Key) == nil {
+			delete(txn.pendingWrites, key)
+		}
+	}
+
+	// 只读事务或者没有需要写入的数据
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+
+	return db.commitRecords(txn.pendingWrites, txn.option.SyncWriteBatch)
+}
+
+// Rollback 回滚事务，丢弃所有暂存的写操作
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	txn.finished = true
+	txn.pendingWrites = nil
+	txn.readSet = nil
+}
+
+// isSamePosition 判断两个位置信息是否指向同一条记录
+func isSamePosition(a, b *data.LogRecordPos) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Fid == b.Fid && a.Offset == b.Offset
+}
@@ -0,0 +1,158 @@
+package bitcaskKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-bitcask-kv/utils"
+	"os"
+	"testing"
+)
+
+func TestTxn_Commit(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-txn-commit")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("100"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("200"))
+	assert.Nil(t, err)
+
+	txn := db.Begin()
+	val, err := txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("100"), val)
+
+	err = txn.Put(utils.GetTestKey(1), []byte("101"))
+	assert.Nil(t, err)
+	err = txn.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	err = txn.Put(utils.GetTestKey(3), []byte("300"))
+	assert.Nil(t, err)
+
+	// 读自己的写
+	val, err = txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("101"), val)
+	_, err = txn.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 提交之前对外不可见
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("100"), val)
+
+	err = txn.Commit()
+	assert.Nil(t, err)
+
+	// 事务结束之后不能再使用
+	err = txn.Put(utils.GetTestKey(4), []byte("400"))
+	assert.Equal(t, ErrTxnFinished, err)
+
+	// 重启之后校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+
+	val, err = db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("101"), val)
+	_, err = db2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db2.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("300"), val)
+}
+
+func TestTxn_Conflict(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-txn-conflict")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("100"))
+	assert.Nil(t, err)
+
+	// 读取之后key被其他写入修改
+	txn1 := db.Begin()
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = txn1.Put(utils.GetTestKey(1), []byte("101"))
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("200"))
+	assert.Nil(t, err)
+
+	err = txn1.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("200"), val)
+
+	// 读取时不存在的key之后被写入
+	txn2 := db.Begin()
+	_, err = txn2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = txn2.Put(utils.GetTestKey(3), []byte("300"))
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(2), []byte("200"))
+	assert.Nil(t, err)
+
+	err = txn2.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 只写不读的事务不会冲突
+	txn3 := db.Begin()
+	err = txn3.Put(utils.GetTestKey(1), []byte("300"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), []byte("400"))
+	assert.Nil(t, err)
+	err = txn3.Commit()
+	assert.Nil(t, err)
+
+	// 两个事务读取同一个key，先提交的成功
+	txn4 := db.Begin()
+	txn5 := db.Begin()
+	_, err = txn4.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = txn5.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_ = txn4.Put(utils.GetTestKey(1), []byte("txn4"))
+	_ = txn5.Put(utils.GetTestKey(1), []byte("txn5"))
+	assert.Nil(t, txn4.Commit())
+	assert.Equal(t, ErrTxnConflict, txn5.Commit())
+
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn4"), val)
+}
+
+func TestTxn_Rollback(t *testing.T) {
+	opts := DefaultOption
+	dir, _ := os.MkdirTemp("", "bitcask-txn-rollback")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	txn := db.Begin()
+	err = txn.Put(utils.GetTestKey(1), []byte("100"))
+	assert.Nil(t, err)
+	txn.Rollback()
+
+	assert.Equal(t, ErrTxnFinished, txn.Commit())
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"context"
+	"hash/crc32"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -8,6 +11,9 @@ import (
 	"syscall"
 )
 
+// 拷贝文件时每次读取的大小
+const copyChunkSize = 64 * 1024
+
 func DirSize(dirPath string) (int64, error) {
 	var totalSize int64 = 0
 	err := filepath.Walk(dirPath, func(path string, info fs.FileInfo, err error) error {
@@ -40,6 +46,11 @@ func AvailableDiskSize() (uint64, error) {
 }
 
 func CopyDir(src, dest string, exclude []string) error {
+	return CopyDirWithLimit(context.Background(), src, dest, exclude, nil)
+}
+
+// CopyDirWithLimit 拷贝目录，limiter不为nil时限制每秒读取的字节数，ctx被取消时中止拷贝
+func CopyDirWithLimit(ctx context.Context, src, dest string, exclude []string, limiter *RateLimiter) error {
 	// 判断目标目录是否存在，不存在则创建
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
 		if err := os.MkdirAll(dest, os.ModePerm); err != nil {
@@ -78,10 +89,79 @@ func CopyDir(src, dest string, exclude []string) error {
 		}
 
 		// 如果是文件，则拷贝出来写入
-		data, err := os.ReadFile(filepath.Join(src, fileName))
+		return CopyFile(ctx, filepath.Join(src, fileName), filepath.Join(dest, fileName), info.Mode(), limiter)
+	})
+}
+
+// CopyFile 分块拷贝文件，每读取一块都需要从limiter中获取令牌，ctx被取消时返回ctx.Err()
+func CopyFile(ctx context.Context, src, dest string, perm fs.FileMode, limiter *RateLimiter) error {
+	_, err := CopyFileChecksum(ctx, src, dest, perm, limiter)
+	return err
+}
+
+// CopyFileChecksum 和CopyFile相同，同时返回拷贝过程中从源文件读取到的内容的crc32校验值
+func CopyFileChecksum(ctx context.Context, src, dest string, perm fs.FileMode, limiter *RateLimiter) (uint32, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := crc32.NewIEEE()
+	reader := io.TeeReader(srcFile, hash)
+	buf := make([]byte, copyChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if err := limiter.Wait(ctx, int64(n)); err != nil {
+				_ = destFile.Close()
+				return 0, err
+			}
+			if _, err := destFile.Write(buf[:n]); err != nil {
+				_ = destFile.Close()
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return err
+			_ = destFile.Close()
+			return 0, err
 		}
-		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
-	})
+	}
+
+	return hash.Sum32(), destFile.Close()
+}
+
+// FileChecksum 计算文件内容的crc32校验值，limiter不为nil时限制每秒读取的字节数
+func FileChecksum(ctx context.Context, path string, limiter *RateLimiter) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var crc uint32
+	buf := make([]byte, copyChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := limiter.Wait(ctx, int64(n)); err != nil {
+				return 0, err
+			}
+			crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		}
+		if err == io.EOF {
+			return crc, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
 }
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"go-bitcask-kv/fio"
+	"hash/crc32"
 	"os"
 	"path/filepath"
 	"testing"
@@ -45,3 +47,22 @@ func TestAvailableDiskSize(t *testing.T) {
 	assert.Nil(t, err)
 	//t.Log(size / 1024 / 1024 / 1024)
 }
+
+func TestCopyFileChecksum(t *testing.T) {
+	path, err := os.MkdirTemp("", "bitcask-copy-checksum")
+	defer os.RemoveAll(path)
+	assert.Nil(t, err)
+
+	// 超过一次读取的大小
+	content := GetTestRandomValue(copyChunkSize*2 + 100)
+	src, dest := filepath.Join(path, "src"), filepath.Join(path, "dest")
+	assert.Nil(t, os.WriteFile(src, content, fio.DataFilePerm))
+
+	checksum, err := CopyFileChecksum(context.Background(), src, dest, fio.DataFilePerm, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, crc32.ChecksumIEEE(content), checksum)
+
+	copied, err := os.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, content, copied)
+}
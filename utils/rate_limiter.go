@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter 令牌桶限速器，限制每秒读写的字节数
+// 桶的容量为一秒的流量，令牌不足时先透支，调用方等待透支的令牌补充回来
+type RateLimiter struct {
+	mu *sync.Mutex
+
+	// 每秒产生的令牌数，小于等于0表示不限速
+	rate int64
+
+	// 当前可用的令牌数，透支时为负数
+	tokens float64
+
+	// 上次补充令牌的时间
+	last time.Time
+
+	// 调整限速时关闭并替换，唤醒正在等待的调用方按照新的速度重新计算等待时间
+	changed chan struct{}
+}
+
+// NewRateLimiter 创建每秒最多bytesPerSec字节的限速器，bytesPerSec小于等于0表示不限速
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{
+		mu:      new(sync.Mutex),
+		rate:    bytesPerSec,
+		tokens:  float64(bytesPerSec),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetRate 调整限速，已经透支的令牌按照新的速度补充
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = bytesPerSec
+	if l.tokens > float64(bytesPerSec) {
+		l.tokens = float64(bytesPerSec)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate 当前的限速
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait 消耗n个令牌，令牌不足时阻塞等待
+// ctx被取消时立即返回ctx.Err(), 调整限速时按照新的速度重新计算等待时间
+func (l *RateLimiter) Wait(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	wait, changed := l.overdraft(), l.changed
+	l.mu.Unlock()
+
+	for wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+			timer.Stop()
+		}
+
+		l.mu.Lock()
+		l.refill(time.Now())
+		wait, changed = l.overdraft(), l.changed
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+// overdraft 按照当前的速度补充透支的令牌需要的时间，不限速时返回0
+// 访问该方法前必须持有锁
+func (l *RateLimiter) overdraft() time.Duration {
+	if l.rate <= 0 || l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// refill 根据经过的时间补充令牌，最多补充到一秒的流量
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
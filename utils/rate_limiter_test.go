@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	l := NewRateLimiter(100 * 1024)
+	ctx := context.Background()
+
+	// 桶中初始有一秒的令牌
+	start := time.Now()
+	assert.Nil(t, l.Wait(ctx, 100*1024))
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	// 之后需要等待令牌补充
+	start = time.Now()
+	assert.Nil(t, l.Wait(ctx, 30*1024))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 250*time.Millisecond, elapsed)
+	assert.True(t, elapsed < time.Second, elapsed)
+}
+
+func TestRateLimiter_SetRate(t *testing.T) {
+	l := NewRateLimiter(1024)
+	ctx := context.Background()
+	assert.Nil(t, l.Wait(ctx, 1024))
+
+	// 不限速时直接返回
+	l.SetRate(0)
+	assert.Equal(t, int64(0), l.Rate())
+	start := time.Now()
+	assert.Nil(t, l.Wait(ctx, 1024*1024))
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	l.SetRate(10 * 1024)
+	start = time.Now()
+	assert.Nil(t, l.Wait(ctx, 12*1024))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 100*time.Millisecond, elapsed)
+
+	// nil表示不限速
+	var nilLimiter *RateLimiter
+	assert.Nil(t, nilLimiter.Wait(ctx, 1024))
+}
+
+func TestRateLimiter_Wait_Cancel(t *testing.T) {
+	l := NewRateLimiter(1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, l.Wait(ctx, 1024))
+
+	// 透支的令牌需要一个小时才能补充回来
+	done := make(chan error)
+	go func() {
+		done <- l.Wait(ctx, 3600*1024)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait is not interrupted by ctx")
+	}
+}
+
+func TestRateLimiter_SetRate_WakeWaiters(t *testing.T) {
+	l := NewRateLimiter(1024)
+	ctx := context.Background()
+	assert.Nil(t, l.Wait(ctx, 1024))
+
+	done := make(chan error)
+	go func() {
+		done <- l.Wait(ctx, 3600*1024)
+	}()
+
+	// 取消限速之后等待的调用方立即返回
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0)
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait is not woken up by SetRate")
+	}
+}